@@ -6,6 +6,8 @@ import (
 	"encoding/json"
 	"io"
 	"testing"
+
+	"github.com/der-antikeks/schemalessql"
 )
 
 func BenchmarkDecodeJsonInt(b *testing.B) {
@@ -115,3 +117,17 @@ func BenchmarkDecodeGobComplex(b *testing.B) {
 		}
 	}
 }
+
+func BenchmarkDecodeMsgPackComplex(b *testing.B) {
+	b.StopTimer()
+	data, _ := schemalessql.MsgPack.Marshal(sampleComplex)
+
+	var result R
+
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		if err := schemalessql.MsgPack.Unmarshal(data, &result); err != nil {
+			b.Fatal("decode error:", err)
+		}
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"encoding/gob"
 	"encoding/json"
 	"testing"
+
+	"github.com/der-antikeks/schemalessql"
 )
 
 type P struct {
@@ -108,3 +110,11 @@ func BenchmarkEncodeGobComplex(b *testing.B) {
 		}
 	}
 }
+
+func BenchmarkEncodeMsgPackComplex(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		if _, err := schemalessql.MsgPack.Marshal(sampleComplex); err != nil {
+			b.Fatal("encode error:", err)
+		}
+	}
+}
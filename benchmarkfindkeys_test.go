@@ -0,0 +1,144 @@
+package schemalessql_test
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/der-antikeks/schemalessql"
+)
+
+type BenchEntity struct {
+	Group int64
+	Flag  bool
+	Name  string
+}
+
+const benchEntities = 100000
+
+var benchQuery = map[string]interface{}{
+	"Group": 7,
+	"Flag":  true,
+}
+
+var (
+	benchOnce sync.Once
+	benchDB   *schemalessql.Datastore
+)
+
+// benchDatastore returns a datastore filled with benchEntities entities, of which 1/200 match benchQuery.
+func benchDatastore(b *testing.B) *schemalessql.Datastore {
+	benchOnce.Do(func() {
+		db, err := schemalessql.Open("sqlite3", ":memory:")
+		if err != nil {
+			b.Fatal("error connecting:", err)
+		}
+
+		// every connection of an in-memory database has its own data
+		db.SetMaxOpenConns(1)
+
+		entities := make([]BenchEntity, benchEntities)
+		for i := range entities {
+			entities[i] = BenchEntity{int64(i % 100), i/100%2 == 0, "name"}
+		}
+
+		if _, err := db.PutMulti(nil, entities, schemalessql.Atomic); err != nil {
+			b.Fatal("error creating entities:", err)
+		}
+
+		// statistics of the index tables, by which SQLite joins the most selective index table first
+		if _, err := db.Exec(`ANALYZE`); err != nil {
+			b.Fatal("error analyzing tables:", err)
+		}
+
+		benchDB = db
+	})
+
+	if benchDB == nil {
+		b.Fatal("error creating datastore")
+	}
+
+	return benchDB
+}
+
+func BenchmarkFindKeys(b *testing.B) {
+	b.StopTimer()
+	db := benchDatastore(b)
+
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		keys, err := db.FindKeys("BenchEntity", benchQuery)
+		if err != nil {
+			b.Fatal("error finding:", err)
+		}
+
+		if len(keys) != benchEntities/200 {
+			b.Fatal("wrong number of keys:", len(keys))
+		}
+	}
+}
+
+// BenchmarkFindKeysInMemory intersects the results of one query per field in a map, as FindKeys did before.
+func BenchmarkFindKeysInMemory(b *testing.B) {
+	b.StopTimer()
+	db := benchDatastore(b)
+
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		tmp := make(map[int64]int)
+
+		for fieldname, value := range benchQuery {
+			rows, err := db.DB.Query(`SELECT entitiy_id FROM 'index_BenchEntity_`+fieldname+`' WHERE value=?`, value)
+			if err != nil {
+				b.Fatal("error finding:", err)
+			}
+
+			for rows.Next() {
+				var id int64
+				rows.Scan(&id)
+				tmp[id]++
+			}
+			rows.Close()
+		}
+
+		var keys []int64
+		for id, n := range tmp {
+			if n == len(benchQuery) {
+				keys = append(keys, id)
+			}
+		}
+
+		if len(keys) != benchEntities/200 {
+			b.Fatal("wrong number of keys:", len(keys))
+		}
+	}
+}
+
+// BenchmarkFindKeysUnselectiveFirst forces the joined query to be driven by the index table of the field that matches half of the entities,
+// as SQLite may do without statistics.
+func BenchmarkFindKeysUnselectiveFirst(b *testing.B) {
+	b.StopTimer()
+	db := benchDatastore(b)
+
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		rows, err := db.DB.Query(`SELECT e.id FROM 'index_BenchEntity_Flag' AS f0`+
+			` CROSS JOIN 'entities' AS e ON e.id=f0.entitiy_id`+
+			` CROSS JOIN 'index_BenchEntity_Group' AS f1 ON f1.entitiy_id=f0.entitiy_id`+
+			` WHERE f0.value=? AND f1.value=? AND e.kind=? ORDER BY e.id ASC`, benchQuery["Flag"], benchQuery["Group"], "BenchEntity")
+		if err != nil {
+			b.Fatal("error finding:", err)
+		}
+
+		var keys []int64
+		for rows.Next() {
+			var id int64
+			rows.Scan(&id)
+			keys = append(keys, id)
+		}
+		rows.Close()
+
+		if len(keys) != benchEntities/200 {
+			b.Fatal("wrong number of keys:", len(keys))
+		}
+	}
+}
@@ -0,0 +1,694 @@
+package schemalessql
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"time"
+)
+
+// Codec encodes entities into the data column and decodes them.
+// The name of the codec is stored with every entity, so that entities remain readable after another codec has been configured.
+type Codec interface {
+	// Name identifies the codec, it must not be longer than 32 characters.
+	Name() string
+
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// Gob encodes entities with encoding/gob, it is the default codec.
+var Gob Codec = gobCodec{}
+
+// JSON encodes entities with encoding/json, which makes them readable by other tools.
+var JSON Codec = jsonCodec{}
+
+// MsgPack encodes entities in the compact binary MessagePack format, structs are encoded as maps of their exported field names and keys as their Encode representation.
+// Values of interface fields are decoded as nil, bool, int64, uint64, float32, float64, string, []byte, time.Time, []interface{} or map[string]interface{}.
+var MsgPack Codec = msgpackCodec{}
+
+// builtinCodecs are the codecs that can always be decoded.
+var builtinCodecs = []Codec{Gob, JSON, MsgPack}
+
+type gobCodec struct{}
+
+func (gobCodec) Name() string {
+	return "gob"
+}
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(v); err != nil {
+		return nil, err
+	}
+
+	return buffer.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string {
+	return "json"
+}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Name() string {
+	return "msgpack"
+}
+
+func (msgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	var e msgpackEncoder
+	if err := e.encode(reflect.ValueOf(v)); err != nil {
+		return nil, err
+	}
+
+	return e.buf, nil
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return fmt.Errorf("msgpack: cannot decode into %T", v)
+	}
+
+	d := msgpackDecoder{data: data}
+	x, err := d.decode()
+	if err != nil {
+		return err
+	}
+
+	if d.pos != len(data) {
+		return fmt.Errorf("msgpack: %v bytes of trailing data", len(data)-d.pos)
+	}
+
+	return msgpackAssign(rv.Elem(), x)
+}
+
+var (
+	timeType = reflect.TypeOf(time.Time{})
+	keyType  = reflect.TypeOf(Key{})
+)
+
+// msgpackEncoder appends the MessagePack encoding of values to its buffer.
+type msgpackEncoder struct {
+	buf []byte
+}
+
+func (e *msgpackEncoder) encode(v reflect.Value) error {
+	if !v.IsValid() {
+		e.buf = append(e.buf, 0xc0)
+		return nil
+	}
+
+	if v.Type() == timeType {
+		e.encodeTime(v.Interface().(time.Time))
+		return nil
+	}
+
+	// keys are encoded as their Encode representation
+	if v.Type() == keyType {
+		e.encodeString(v.Interface().(Key).Encode())
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			e.buf = append(e.buf, 0xc3)
+		} else {
+			e.buf = append(e.buf, 0xc2)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		e.encodeInt(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		e.encodeUint(v.Uint())
+	case reflect.Float32:
+		e.buf = binary.BigEndian.AppendUint32(append(e.buf, 0xca), math.Float32bits(float32(v.Float())))
+	case reflect.Float64:
+		e.buf = binary.BigEndian.AppendUint64(append(e.buf, 0xcb), math.Float64bits(v.Float()))
+	case reflect.String:
+		e.encodeString(v.String())
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			e.buf = append(e.buf, 0xc0)
+			return nil
+		}
+
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			b := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(b), v)
+			e.encodeBytes(b)
+			return nil
+		}
+
+		e.encodeHeader(v.Len(), 0x90, 0xdc, 0xdd)
+		for i := 0; i < v.Len(); i++ {
+			if err := e.encode(v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		if v.IsNil() {
+			e.buf = append(e.buf, 0xc0)
+			return nil
+		}
+
+		e.encodeHeader(v.Len(), 0x80, 0xde, 0xdf)
+		it := v.MapRange()
+		for it.Next() {
+			if err := e.encode(it.Key()); err != nil {
+				return err
+			}
+
+			if err := e.encode(it.Value()); err != nil {
+				return err
+			}
+		}
+	case reflect.Struct:
+		t := v.Type()
+		var fields []int
+		for i := 0; i < t.NumField(); i++ {
+			if t.Field(i).PkgPath == "" {
+				fields = append(fields, i)
+			}
+		}
+
+		e.encodeHeader(len(fields), 0x80, 0xde, 0xdf)
+		for _, i := range fields {
+			e.encodeString(t.Field(i).Name)
+			if err := e.encode(v.Field(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			e.buf = append(e.buf, 0xc0)
+			return nil
+		}
+
+		return e.encode(v.Elem())
+	default:
+		return fmt.Errorf("msgpack: unsupported type %v", v.Type())
+	}
+
+	return nil
+}
+
+func (e *msgpackEncoder) encodeInt(i int64) {
+	switch {
+	case i >= 0:
+		e.encodeUint(uint64(i))
+	case i >= -32:
+		e.buf = append(e.buf, byte(i))
+	case i >= math.MinInt8:
+		e.buf = append(e.buf, 0xd0, byte(i))
+	case i >= math.MinInt16:
+		e.buf = binary.BigEndian.AppendUint16(append(e.buf, 0xd1), uint16(i))
+	case i >= math.MinInt32:
+		e.buf = binary.BigEndian.AppendUint32(append(e.buf, 0xd2), uint32(i))
+	default:
+		e.buf = binary.BigEndian.AppendUint64(append(e.buf, 0xd3), uint64(i))
+	}
+}
+
+func (e *msgpackEncoder) encodeUint(u uint64) {
+	switch {
+	case u <= math.MaxInt8:
+		e.buf = append(e.buf, byte(u))
+	case u <= math.MaxUint8:
+		e.buf = append(e.buf, 0xcc, byte(u))
+	case u <= math.MaxUint16:
+		e.buf = binary.BigEndian.AppendUint16(append(e.buf, 0xcd), uint16(u))
+	case u <= math.MaxUint32:
+		e.buf = binary.BigEndian.AppendUint32(append(e.buf, 0xce), uint32(u))
+	default:
+		e.buf = binary.BigEndian.AppendUint64(append(e.buf, 0xcf), u)
+	}
+}
+
+func (e *msgpackEncoder) encodeString(s string) {
+	if len(s) < 32 {
+		e.buf = append(e.buf, 0xa0|byte(len(s)))
+	} else {
+		e.encodeLength(len(s), 0xd9, 0xda, 0xdb)
+	}
+
+	e.buf = append(e.buf, s...)
+}
+
+func (e *msgpackEncoder) encodeBytes(b []byte) {
+	e.encodeLength(len(b), 0xc4, 0xc5, 0xc6)
+	e.buf = append(e.buf, b...)
+}
+
+// encodeHeader encodes the length of an array or map, which fits into the fix type up to 15.
+func (e *msgpackEncoder) encodeHeader(n int, fix, type16, type32 byte) {
+	if n < 16 {
+		e.buf = append(e.buf, fix|byte(n))
+		return
+	}
+
+	if n <= math.MaxUint16 {
+		e.buf = binary.BigEndian.AppendUint16(append(e.buf, type16), uint16(n))
+	} else {
+		e.buf = binary.BigEndian.AppendUint32(append(e.buf, type32), uint32(n))
+	}
+}
+
+// encodeLength encodes the length of a string or binary with 8, 16 or 32 bits.
+func (e *msgpackEncoder) encodeLength(n int, type8, type16, type32 byte) {
+	switch {
+	case n <= math.MaxUint8:
+		e.buf = append(e.buf, type8, byte(n))
+	case n <= math.MaxUint16:
+		e.buf = binary.BigEndian.AppendUint16(append(e.buf, type16), uint16(n))
+	default:
+		e.buf = binary.BigEndian.AppendUint32(append(e.buf, type32), uint32(n))
+	}
+}
+
+// encodeTime encodes the time as timestamp extension, the location is not preserved.
+func (e *msgpackEncoder) encodeTime(t time.Time) {
+	sec, nsec := t.Unix(), uint64(t.Nanosecond())
+	switch {
+	case sec>>34 == 0 && nsec == 0 && sec <= math.MaxUint32:
+		e.buf = binary.BigEndian.AppendUint32(append(e.buf, 0xd6, 0xff), uint32(sec))
+	case sec>>34 == 0:
+		e.buf = binary.BigEndian.AppendUint64(append(e.buf, 0xd7, 0xff), nsec<<34|uint64(sec))
+	default:
+		e.buf = binary.BigEndian.AppendUint32(append(e.buf, 0xc7, 12, 0xff), uint32(nsec))
+		e.buf = binary.BigEndian.AppendUint64(e.buf, uint64(sec))
+	}
+}
+
+// msgpackMap is a decoded map, whose keys are not necessarily strings.
+type msgpackMap []struct {
+	key, value interface{}
+}
+
+// msgpackDecoder decodes MessagePack values into generic values.
+type msgpackDecoder struct {
+	data []byte
+	pos  int
+}
+
+var errMsgpackShort = fmt.Errorf("msgpack: unexpected end of data")
+
+// next returns the next n bytes.
+func (d *msgpackDecoder) next(n int) ([]byte, error) {
+	if n < 0 || len(d.data)-d.pos < n {
+		return nil, errMsgpackShort
+	}
+
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+// uint reads a big endian unsigned integer of n bytes.
+func (d *msgpackDecoder) uint(n int) (uint64, error) {
+	b, err := d.next(n)
+	if err != nil {
+		return 0, err
+	}
+
+	var u uint64
+	for _, c := range b {
+		u = u<<8 | uint64(c)
+	}
+
+	return u, nil
+}
+
+func (d *msgpackDecoder) decode() (interface{}, error) {
+	b, err := d.next(1)
+	if err != nil {
+		return nil, err
+	}
+
+	c := b[0]
+	switch {
+	case c <= 0x7f:
+		return int64(c), nil
+	case c >= 0xe0:
+		return int64(int8(c)), nil
+	case c&0xe0 == 0xa0:
+		return d.str(int(c & 0x1f))
+	case c&0xf0 == 0x90:
+		return d.array(int(c & 0x0f))
+	case c&0xf0 == 0x80:
+		return d.mapping(int(c & 0x0f))
+	}
+
+	switch c {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		u, err := d.uint(1 << (c - 0xcc))
+		if err != nil || u > math.MaxInt64 {
+			return u, err
+		}
+		return int64(u), nil
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		n := 1 << (c - 0xd0)
+		u, err := d.uint(n)
+		// sign extension
+		shift := 64 - 8*n
+		return int64(u<<shift) >> shift, err
+	case 0xca:
+		u, err := d.uint(4)
+		return math.Float32frombits(uint32(u)), err
+	case 0xcb:
+		u, err := d.uint(8)
+		return math.Float64frombits(u), err
+	case 0xd9, 0xda, 0xdb:
+		n, err := d.uint(1 << (c - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		return d.str(int(n))
+	case 0xc4, 0xc5, 0xc6:
+		n, err := d.uint(1 << (c - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+
+		b, err := d.next(int(n))
+		return append([]byte{}, b...), err
+	case 0xdc, 0xdd:
+		n, err := d.uint(2 << (c - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return d.array(int(n))
+	case 0xde, 0xdf:
+		n, err := d.uint(2 << (c - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return d.mapping(int(n))
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8:
+		return d.ext(1 << (c - 0xd4))
+	case 0xc7, 0xc8, 0xc9:
+		n, err := d.uint(1 << (c - 0xc7))
+		if err != nil {
+			return nil, err
+		}
+		return d.ext(int(n))
+	}
+
+	return nil, fmt.Errorf("msgpack: invalid type 0x%x", c)
+}
+
+func (d *msgpackDecoder) str(n int) (string, error) {
+	b, err := d.next(n)
+	return string(b), err
+}
+
+func (d *msgpackDecoder) array(n int) ([]interface{}, error) {
+	if n > len(d.data)-d.pos {
+		return nil, errMsgpackShort
+	}
+
+	a := make([]interface{}, n)
+	for i := range a {
+		var err error
+		if a[i], err = d.decode(); err != nil {
+			return nil, err
+		}
+	}
+
+	return a, nil
+}
+
+func (d *msgpackDecoder) mapping(n int) (msgpackMap, error) {
+	if n > len(d.data)-d.pos {
+		return nil, errMsgpackShort
+	}
+
+	m := make(msgpackMap, n)
+	for i := range m {
+		var err error
+		if m[i].key, err = d.decode(); err != nil {
+			return nil, err
+		}
+
+		if m[i].value, err = d.decode(); err != nil {
+			return nil, err
+		}
+	}
+
+	return m, nil
+}
+
+// ext decodes an extension of n bytes, only timestamps are supported.
+func (d *msgpackDecoder) ext(n int) (interface{}, error) {
+	t, err := d.timestamp(n)
+	if t.IsZero() {
+		// without the location of time.Unix
+		return time.Time{}, err
+	}
+
+	return t, err
+}
+
+func (d *msgpackDecoder) timestamp(n int) (time.Time, error) {
+	t, err := d.next(1)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	b, err := d.next(n)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if int8(t[0]) != -1 {
+		return time.Time{}, fmt.Errorf("msgpack: unsupported extension type %v", int8(t[0]))
+	}
+
+	switch n {
+	case 4:
+		return time.Unix(int64(binary.BigEndian.Uint32(b)), 0), nil
+	case 8:
+		u := binary.BigEndian.Uint64(b)
+		return time.Unix(int64(u&(1<<34-1)), int64(u>>34)), nil
+	case 12:
+		return time.Unix(int64(binary.BigEndian.Uint64(b[4:])), int64(binary.BigEndian.Uint32(b))), nil
+	}
+
+	return time.Time{}, fmt.Errorf("msgpack: invalid timestamp length %v", n)
+}
+
+// msgpackGeneric converts the decoded maps of a value into map[string]interface{}.
+func msgpackGeneric(x interface{}) interface{} {
+	switch xi := x.(type) {
+	case msgpackMap:
+		m := make(map[string]interface{}, len(xi))
+		for _, kv := range xi {
+			m[fmt.Sprint(kv.key)] = msgpackGeneric(kv.value)
+		}
+		return m
+	case []interface{}:
+		for i := range xi {
+			xi[i] = msgpackGeneric(xi[i])
+		}
+	}
+
+	return x
+}
+
+// msgpackAssign sets the value to the decoded value.
+func msgpackAssign(v reflect.Value, x interface{}) error {
+	mismatch := func() error {
+		return fmt.Errorf("msgpack: cannot decode %T into %v", x, v.Type())
+	}
+
+	if x == nil {
+		v.Set(reflect.Zero(v.Type()))
+		return nil
+	}
+
+	if v.Type() == timeType {
+		t, ok := x.(time.Time)
+		if !ok {
+			return mismatch()
+		}
+
+		v.Set(reflect.ValueOf(t))
+		return nil
+	}
+
+	if v.Type() == keyType {
+		s, ok := x.(string)
+		if !ok {
+			return mismatch()
+		}
+
+		return v.Addr().Interface().(*Key).UnmarshalText([]byte(s))
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return msgpackAssign(v.Elem(), x)
+	case reflect.Interface:
+		if v.NumMethod() > 0 {
+			return mismatch()
+		}
+		v.Set(reflect.ValueOf(msgpackGeneric(x)))
+	case reflect.Bool:
+		b, ok := x.(bool)
+		if !ok {
+			return mismatch()
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, ok := x.(int64)
+		if !ok || v.OverflowInt(i) {
+			return mismatch()
+		}
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		var u uint64
+		switch xi := x.(type) {
+		case int64:
+			if xi < 0 {
+				return mismatch()
+			}
+			u = uint64(xi)
+		case uint64:
+			u = xi
+		default:
+			return mismatch()
+		}
+
+		if v.OverflowUint(u) {
+			return mismatch()
+		}
+		v.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		switch xi := x.(type) {
+		case float32:
+			v.SetFloat(float64(xi))
+		case float64:
+			v.SetFloat(xi)
+		case int64:
+			v.SetFloat(float64(xi))
+		case uint64:
+			v.SetFloat(float64(xi))
+		default:
+			return mismatch()
+		}
+	case reflect.String:
+		s, ok := x.(string)
+		if !ok {
+			return mismatch()
+		}
+		v.SetString(s)
+	case reflect.Slice, reflect.Array:
+		if b, ok := x.([]byte); ok && v.Type().Elem().Kind() == reflect.Uint8 {
+			if v.Kind() == reflect.Array {
+				if len(b) != v.Len() {
+					return mismatch()
+				}
+				reflect.Copy(v, reflect.ValueOf(b))
+				return nil
+			}
+
+			s := reflect.MakeSlice(v.Type(), len(b), len(b))
+			reflect.Copy(s, reflect.ValueOf(b))
+			v.Set(s)
+			return nil
+		}
+
+		a, ok := x.([]interface{})
+		if !ok {
+			return mismatch()
+		}
+
+		if v.Kind() == reflect.Array {
+			if len(a) != v.Len() {
+				return mismatch()
+			}
+		} else {
+			v.Set(reflect.MakeSlice(v.Type(), len(a), len(a)))
+		}
+
+		for i, xi := range a {
+			if err := msgpackAssign(v.Index(i), xi); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		m, ok := x.(msgpackMap)
+		if !ok {
+			return mismatch()
+		}
+
+		t := v.Type()
+		v.Set(reflect.MakeMapWithSize(t, len(m)))
+		for _, kv := range m {
+			key := reflect.New(t.Key()).Elem()
+			if err := msgpackAssign(key, kv.key); err != nil {
+				return err
+			}
+
+			value := reflect.New(t.Elem()).Elem()
+			if err := msgpackAssign(value, kv.value); err != nil {
+				return err
+			}
+
+			v.SetMapIndex(key, value)
+		}
+	case reflect.Struct:
+		m, ok := x.(msgpackMap)
+		if !ok {
+			return mismatch()
+		}
+
+		for _, kv := range m {
+			name, ok := kv.key.(string)
+			if !ok {
+				return mismatch()
+			}
+
+			// fields of other struct types of the same kind are ignored
+			field, found := v.Type().FieldByName(name)
+			if !found || field.PkgPath != "" || len(field.Index) != 1 {
+				continue
+			}
+
+			if err := msgpackAssign(v.FieldByIndex(field.Index), kv.value); err != nil {
+				return err
+			}
+		}
+	default:
+		return mismatch()
+	}
+
+	return nil
+}
@@ -0,0 +1,207 @@
+package schemalessql_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/der-antikeks/schemalessql"
+)
+
+type EntityCodec struct {
+	Int     int64
+	Small   int8
+	Uint    uint32
+	Float   float64
+	Bool    bool
+	Bytes   []byte
+	String  string
+	Time    time.Time
+	Slice   []string
+	Array   [2]int
+	Map     map[string]float64
+	Pointer *EntityA
+	Nested  EntityB
+}
+
+func TestCodecs(t *testing.T) {
+	e := EntityCodec{
+		Int:     math.MinInt64,
+		Small:   -100,
+		Uint:    math.MaxUint32,
+		Float:   -1.25,
+		Bool:    true,
+		Bytes:   []byte{0, 1, 255},
+		String:  strings.Repeat("long string ", 30),
+		Time:    time.Now().Round(0),
+		Slice:   []string{"a", ""},
+		Array:   [2]int{-1, 1 << 40},
+		Map:     map[string]float64{"x": 1.5},
+		Pointer: &EntityA{2.5},
+		Nested:  EntityB{"foo"},
+	}
+
+	for _, codec := range []schemalessql.Codec{schemalessql.Gob, schemalessql.JSON, schemalessql.MsgPack} {
+		data, err := codec.Marshal(e)
+		if err != nil {
+			t.Fatalf("error encoding entity with %v: %v", codec.Name(), err)
+		}
+
+		// the location of the time is not preserved by every codec
+		var r EntityCodec
+		if err := codec.Unmarshal(data, &r); err != nil || !r.Time.Equal(e.Time) {
+			t.Fatalf("error decoding entity with %v %v: %v", codec.Name(), r, err)
+		}
+
+		r.Time = e.Time
+		if !reflect.DeepEqual(e, r) {
+			t.Fatalf("error decoding entity with %v %v", codec.Name(), r)
+		}
+	}
+}
+
+func TestCodecMsgPackInterface(t *testing.T) {
+	e := Entity{IgnoreMe: map[string]interface{}{"a": int64(-1), "b": []interface{}{"x", 1.5, nil, true}}}
+	data, err := schemalessql.MsgPack.Marshal(e)
+	if err != nil {
+		t.Fatalf("error encoding entity: %v", err)
+	}
+
+	var r Entity
+	if err := schemalessql.MsgPack.Unmarshal(data, &r); err != nil || !reflect.DeepEqual(e, r) {
+		t.Fatalf("error decoding entity %v: %v", r, err)
+	}
+
+	if err := schemalessql.MsgPack.Unmarshal(data[:len(data)-1], &r); err == nil {
+		t.Fatalf("should receive error for truncated data")
+	}
+
+	var b EntityB
+	if err := schemalessql.MsgPack.Unmarshal(data, &b); err != nil {
+		t.Fatalf("should ignore unknown fields: %v", err)
+	}
+}
+
+// prefixCodec encodes entities as JSON behind a prefix.
+type prefixCodec struct{}
+
+func (prefixCodec) Name() string {
+	return "prefix"
+}
+
+func (prefixCodec) Marshal(v interface{}) ([]byte, error) {
+	data, err := json.Marshal(v)
+	return append([]byte("prefix:"), data...), err
+}
+
+func (prefixCodec) Unmarshal(data []byte, v interface{}) error {
+	if !bytes.HasPrefix(data, []byte("prefix:")) {
+		return errors.New("missing prefix")
+	}
+
+	return json.Unmarshal(data[len("prefix:"):], v)
+}
+
+func TestCodecStores(t *testing.T) {
+	for _, codec := range []schemalessql.Codec{schemalessql.JSON, schemalessql.MsgPack, prefixCodec{}} {
+		driver, dsn := testDSN(t)
+		db, err := schemalessql.Open(driver, dsn, schemalessql.WithCodec(codec))
+		if err != nil {
+			t.Fatalf("error connecting to database: %v", err)
+		}
+		defer closeDB(t, db)
+
+		for _, store := range []schemalessql.Store{db, schemalessql.NewMemoryStore(schemalessql.WithCodec(codec))} {
+			e := Entity{123, 123.456, true, []byte{12, 34, 56}, "foo", time.Now().Round(0), nil}
+			key, err := store.Put(nil, e)
+			if err != nil {
+				t.Fatalf("error creating entity with %v: %v", codec.Name(), err)
+			}
+
+			var r Entity
+			if err := store.Get(key, &r); err != nil || r.A != e.A || !r.F.Equal(e.F) {
+				t.Fatalf("error reading entity with %v %v: %v", codec.Name(), r, err)
+			}
+
+			var found []Entity
+			if _, err := store.FindAll(store.NewQuery("Entity").Filter("E =", "foo"), &found); err != nil || len(found) != 1 || found[0].A != e.A {
+				t.Fatalf("error finding entity with %v %v: %v", codec.Name(), found, err)
+			}
+		}
+	}
+}
+
+func TestCodecSwitch(t *testing.T) {
+	driver, dsn := testDSN(t)
+	db, err := schemalessql.Open(driver, dsn, schemalessql.WithCodec(prefixCodec{}))
+	if err != nil {
+		t.Fatalf("error connecting to database: %v", err)
+	}
+
+	prefixed, err := db.Put(nil, EntityB{"foo"})
+	if err != nil {
+		t.Fatalf("error creating entity: %v", err)
+	}
+	closeDB(t, db)
+
+	db, err = schemalessql.Open(driver, dsn)
+	if err != nil {
+		t.Fatalf("error connecting to database: %v", err)
+	}
+
+	var b EntityB
+	if err := db.Get(prefixed, &b); err == nil || !strings.Contains(err.Error(), "unknown codec prefix") {
+		t.Fatalf("should receive error for unknown codec but got: %v", err)
+	}
+
+	if _, err := db.Put(prefixed, EntityB{"gob"}); err != nil {
+		t.Fatalf("error replacing entity: %v", err)
+	}
+	closeDB(t, db)
+
+	db, err = schemalessql.Open(driver, dsn, schemalessql.WithCodec(schemalessql.JSON), schemalessql.WithKindCodec("EntityA", schemalessql.MsgPack))
+	if err != nil {
+		t.Fatalf("error connecting to database: %v", err)
+	}
+	defer closeDB(t, db)
+
+	if _, err := db.Put(nil, EntityB{"json"}); err != nil {
+		t.Fatalf("error creating entity: %v", err)
+	}
+
+	if _, err := db.Put(nil, EntityA{1.5}); err != nil {
+		t.Fatalf("error creating entity: %v", err)
+	}
+
+	// entities of both codecs are decoded
+	var found []EntityB
+	if _, err := db.FindAll(db.NewQuery("EntityB").Order("Data"), &found); err != nil || len(found) != 2 || found[0].Data != "gob" || found[1].Data != "json" {
+		t.Fatalf("error finding entities of mixed codecs %v: %v", found, err)
+	}
+
+	for kind, expected := range map[string]string{"EntityA": "msgpack", "EntityB": "gob,json"} {
+		rows, err := db.Query(db.Dialect().Rebind(`SELECT codec FROM entities WHERE kind=? ORDER BY codec`), kind)
+		if err != nil {
+			t.Fatalf("error querying codecs: %v", err)
+		}
+
+		var codecs []string
+		for rows.Next() {
+			var codec string
+			if err := rows.Scan(&codec); err != nil {
+				t.Fatalf("error scanning codec: %v", err)
+			}
+			codecs = append(codecs, codec)
+		}
+		rows.Close()
+
+		if strings.Join(codecs, ",") != expected {
+			t.Fatalf("entities of kind %v should be encoded by %v but are encoded by %v", kind, expected, codecs)
+		}
+	}
+}
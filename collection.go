@@ -0,0 +1,190 @@
+package schemalessql
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+)
+
+// Collection provides type safe access to the entities of the struct type T.
+type Collection[T any] struct {
+	d    Store
+	kind string
+	err  error
+}
+
+// NewCollection returns a Collection of the entities of the struct type T in the store.
+func NewCollection[T any](d Store) *Collection[T] {
+	c := &Collection[T]{d: d}
+	c.kind, c.err = kindOf(reflect.TypeOf((*T)(nil)).Elem())
+	return c
+}
+
+// Kind returns the kind of the entities in the collection.
+func (c *Collection[T]) Kind() string {
+	return c.kind
+}
+
+// NewQuery creates a new Query for the entities of the collection.
+func (c *Collection[T]) NewQuery() *Query {
+	return c.d.NewQuery(c.kind)
+}
+
+// Put saves the entity, see Datastore.Put.
+func (c *Collection[T]) Put(ctx context.Context, key *Key, src *T) (*Key, error) {
+	if c.err != nil {
+		return key, c.err
+	}
+
+	return c.d.PutContext(ctx, key, src)
+}
+
+// PutIfVersion saves the entity if the stored entity is at the version, see Datastore.PutIfVersion.
+func (c *Collection[T]) PutIfVersion(ctx context.Context, key *Key, src *T, version int64) (*Key, error) {
+	if c.err != nil {
+		return key, c.err
+	}
+
+	return c.d.PutIfVersionContext(ctx, key, src, version)
+}
+
+// PutMulti saves the entities and returns their keys, see Datastore.PutMulti.
+// If keys is nil, new entities are created.
+func (c *Collection[T]) PutMulti(ctx context.Context, keys []*Key, srcs []*T, mode MultiMode) ([]*Key, error) {
+	if c.err != nil {
+		return keys, c.err
+	}
+
+	return c.d.PutMultiContext(ctx, keys, srcs, mode)
+}
+
+// Get fetches the entity of the key, see Datastore.Get.
+func (c *Collection[T]) Get(ctx context.Context, key *Key) (*T, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+
+	dst := new(T)
+	if err := c.d.GetContext(ctx, key, dst); err != nil {
+		return nil, err
+	}
+
+	return dst, nil
+}
+
+// GetMulti fetches the entities of the keys, see Datastore.GetMulti.
+func (c *Collection[T]) GetMulti(ctx context.Context, keys []*Key, mode MultiMode) ([]*T, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+
+	dsts := make([]T, len(keys))
+	err := c.d.GetMultiContext(ctx, keys, dsts, mode)
+
+	results := make([]*T, len(dsts))
+	for i := range dsts {
+		results[i] = &dsts[i]
+	}
+
+	return results, err
+}
+
+// Delete removes the entity of the key, see Datastore.Delete.
+func (c *Collection[T]) Delete(ctx context.Context, key *Key) error {
+	if c.err != nil {
+		return c.err
+	}
+
+	return c.d.DeleteContext(ctx, key)
+}
+
+// DeleteMulti removes the entities of the keys, see Datastore.DeleteMulti.
+func (c *Collection[T]) DeleteMulti(ctx context.Context, keys []*Key, mode MultiMode) error {
+	if c.err != nil {
+		return c.err
+	}
+
+	return c.d.DeleteMultiContext(ctx, keys, mode)
+}
+
+// FindAll returns all entities that match the query and their keys.
+// The query must be of the kind of the collection.
+func (c *Collection[T]) FindAll(ctx context.Context, q *Query) ([]T, []*Key, error) {
+	it := c.Run(ctx, q)
+	defer it.Close()
+
+	var dsts []T
+	var keys []*Key
+	for {
+		key, dst, err := it.Next()
+		if err == Done {
+			return dsts, keys, nil
+		}
+
+		if err != nil {
+			return dsts, keys, err
+		}
+
+		dsts = append(dsts, *dst)
+		keys = append(keys, key)
+	}
+}
+
+// Run runs the query and returns an iterator over its results.
+// The query must be of the kind of the collection.
+func (c *Collection[T]) Run(ctx context.Context, q *Query) *CollectionIterator[T] {
+	it := &CollectionIterator[T]{}
+
+	if c.err != nil {
+		it.err = c.err
+		return it
+	}
+
+	if q.kind != c.kind {
+		it.err = fmt.Errorf("schemalessql: query of kind %v in collection of kind %v", q.kind, c.kind)
+		return it
+	}
+
+	it.it = c.d.RunContext(ctx, q)
+	return it
+}
+
+// CollectionIterator is the result of running a query on a Collection.
+type CollectionIterator[T any] struct {
+	it  *Iterator
+	err error
+}
+
+// Next returns the key and entity of the next result.
+// When there are no more results, Done is returned.
+func (it *CollectionIterator[T]) Next() (*Key, *T, error) {
+	if it.err != nil {
+		return nil, nil, it.err
+	}
+
+	dst := new(T)
+	key, err := it.it.Next(dst)
+	if err != nil {
+		return key, nil, err
+	}
+
+	return key, dst, nil
+}
+
+// Cursor returns a cursor positioned after the last result returned by Next.
+func (it *CollectionIterator[T]) Cursor() Cursor {
+	if it.it == nil {
+		return Cursor{}
+	}
+
+	return it.it.Cursor()
+}
+
+// Close stops the iteration and releases the database resources.
+func (it *CollectionIterator[T]) Close() error {
+	if it.it == nil {
+		return nil
+	}
+
+	return it.it.Close()
+}
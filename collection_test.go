@@ -0,0 +1,137 @@
+package schemalessql_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/der-antikeks/schemalessql"
+)
+
+func TestCollection(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(t, db)
+
+	ctx := context.Background()
+	entities := schemalessql.NewCollection[Entity](db)
+
+	e := Entity{123, 123.456, true, []byte{12, 34, 56}, "foo", time.Now().Round(0), time.Duration(3) * time.Minute}
+	key, err := entities.Put(ctx, nil, &e)
+	if err != nil {
+		t.Fatalf("error creating entity: %v", err)
+	}
+
+	r, err := entities.Get(ctx, key)
+	if err != nil {
+		t.Fatalf("error reading entity: %v", err)
+	}
+
+	if !reflect.DeepEqual(e, *r) {
+		t.Fatalf("entities do not match: \n%v\n%v", e, *r)
+	}
+
+	if err := entities.Delete(ctx, key); err != nil {
+		t.Fatalf("error deleting entity: %v", err)
+	}
+
+	// other kinds are rejected
+	akey, err := schemalessql.NewCollection[EntityA](db).Put(ctx, nil, &EntityA{1.5})
+	if err != nil {
+		t.Fatalf("error creating entity: %v", err)
+	}
+
+	if _, err := entities.Get(ctx, akey); err == nil {
+		t.Fatalf("should receive error while reading entity of another kind")
+	}
+
+	if _, _, err := entities.FindAll(ctx, db.NewQuery("EntityA")); err == nil {
+		t.Fatalf("should receive error for query of another kind")
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := entities.Put(cancelled, nil, &e); !errors.Is(err, context.Canceled) {
+		t.Fatalf("should receive error for cancelled context but got: %v", err)
+	}
+}
+
+func TestCollectionQuery(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(t, db)
+
+	ctx := context.Background()
+	entities := schemalessql.NewCollection[Entity](db)
+
+	srcs := []*Entity{{A: 1, E: "a"}, {A: 2, E: "b"}, {A: 3, E: "c"}}
+	keys, err := entities.PutMulti(ctx, nil, srcs, schemalessql.Atomic)
+	if err != nil {
+		t.Fatalf("error creating entities: %v", err)
+	}
+
+	results, err := entities.GetMulti(ctx, keys, schemalessql.Atomic)
+	if err != nil {
+		t.Fatalf("error reading entities: %v", err)
+	}
+
+	if !reflect.DeepEqual(results, srcs) {
+		t.Fatalf("entities do not match: \n%v\n%v", srcs, results)
+	}
+
+	found, fkeys, err := entities.FindAll(ctx, entities.NewQuery().Filter("A >", 1).Order("-A"))
+	if err != nil {
+		t.Fatalf("error finding entities: %v", err)
+	}
+
+	if expected := []Entity{*srcs[2], *srcs[1]}; !reflect.DeepEqual(found, expected) || !reflect.DeepEqual(fkeys, []*schemalessql.Key{keys[2], keys[1]}) {
+		t.Fatalf("error finding entities, result does not match: \n%v\n%v", expected, found)
+	}
+
+	it := entities.Run(ctx, entities.NewQuery().Order("E"))
+	defer it.Close()
+
+	for i := range srcs {
+		key, e, err := it.Next()
+		if err != nil {
+			t.Fatalf("error iterating entities: %v", err)
+		}
+
+		if *key != *keys[i] || !reflect.DeepEqual(e, srcs[i]) {
+			t.Fatalf("error iterating entities, result does not match: \n%v\n%v", srcs[i], e)
+		}
+	}
+
+	if _, _, err := it.Next(); err != schemalessql.Done {
+		t.Fatalf("should receive Done after last result but got: %v", err)
+	}
+
+	// entities of other kinds are rejected
+	akey, err := schemalessql.NewCollection[EntityA](db).Put(ctx, nil, &EntityA{1.5})
+	if err != nil {
+		t.Fatalf("error creating entity: %v", err)
+	}
+
+	if results, err := entities.GetMulti(ctx, []*schemalessql.Key{keys[0], akey}, schemalessql.ContinueOnError); err == nil || !reflect.DeepEqual(results[0], srcs[0]) {
+		t.Fatalf("should read entity %v and receive error for entity of another kind but got %v: %v", srcs[0], results[0], err)
+	}
+
+	if err := entities.DeleteMulti(ctx, keys, schemalessql.Atomic); err != nil {
+		t.Fatalf("error deleting entities: %v", err)
+	}
+
+	if _, err := entities.GetMulti(ctx, keys, schemalessql.StopOnError); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("should receive sql.ErrNoRows for deleted entities but got: %v", err)
+	}
+
+	// the error of the collection is returned before accessing the datastore
+	invalid := schemalessql.NewCollection[int](db)
+	if _, err := invalid.PutMulti(ctx, nil, []*int{new(int)}, schemalessql.Atomic); err == nil {
+		t.Fatalf("should receive error for collection of non-struct type")
+	}
+
+	if err := invalid.DeleteMulti(ctx, keys, schemalessql.StopOnError); err == nil {
+		t.Fatalf("should receive error for collection of non-struct type")
+	}
+}
@@ -0,0 +1,63 @@
+package schemalessql
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+)
+
+// compression of the rows compressed with flate
+const flateCompression = "flate"
+
+// WithCompression compresses encoded entities of at least threshold bytes with flate, unless compression does not make them smaller.
+// Entities encoded by the JSON codec are stored as documents and never compressed.
+// Compressed and uncompressed entities can be read regardless of this option.
+func WithCompression(threshold int) Option {
+	return func(o *options) {
+		o.compress = true
+		o.threshold = threshold
+	}
+}
+
+// compress returns the compressed data of an entity encoded by the codec and its compression,
+// or the data and no compression if it is not compressed.
+func (d *datastore) compress(codec Codec, data []byte) ([]byte, string, error) {
+	if !d.compression.enabled || len(data) < d.compression.threshold || codec.Name() == JSON.Name() {
+		return data, "", nil
+	}
+
+	var buffer bytes.Buffer
+	w, err := flate.NewWriter(&buffer, flate.DefaultCompression)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if _, err := w.Write(data); err != nil {
+		return nil, "", err
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, "", err
+	}
+
+	if buffer.Len() >= len(data) {
+		return data, "", nil
+	}
+
+	return buffer.Bytes(), flateCompression, nil
+}
+
+// decompress reverses the compression of the data.
+func decompress(compression string, data []byte) ([]byte, error) {
+	switch compression {
+	case "":
+		return data, nil
+	case flateCompression:
+		r := flate.NewReader(bytes.NewReader(data))
+		defer r.Close()
+		return io.ReadAll(r)
+	}
+
+	return nil, fmt.Errorf("unknown compression %v", compression)
+}
@@ -0,0 +1,67 @@
+package schemalessql_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/der-antikeks/schemalessql"
+)
+
+type EntityText struct {
+	Title string
+	Text  string `datastore:"noindex"`
+}
+
+func TestCompression(t *testing.T) {
+	driver, dsn := testDSN(t)
+	db, err := schemalessql.Open(driver, dsn, schemalessql.WithCompression(256))
+	if err != nil {
+		t.Fatalf("error connecting to database: %v", err)
+	}
+
+	long := EntityText{"long", strings.Repeat("compressible text ", 1000)}
+	short := EntityText{"short", "text"}
+
+	for _, store := range []schemalessql.Store{db, schemalessql.NewMemoryStore(schemalessql.WithCompression(256))} {
+		keys, err := store.PutMulti(nil, []EntityText{long, short}, schemalessql.Atomic)
+		if err != nil {
+			t.Fatalf("error creating entities: %v", err)
+		}
+
+		var r EntityText
+		if err := store.Get(keys[0], &r); err != nil || r != long {
+			t.Fatalf("error reading compressed entity: %v", err)
+		}
+
+		var found []EntityText
+		if _, err := store.FindAll(store.NewQuery("EntityText").Order("Title"), &found); err != nil || len(found) != 2 || found[0] != long || found[1] != short {
+			t.Fatalf("error finding entities: %v", err)
+		}
+	}
+
+	// only entities above the threshold are compressed
+	for title, expected := range map[string]string{"long": "flate", "short": ""} {
+		var compression string
+		var size int
+		if err := db.QueryRow(db.Dialect().Rebind(`SELECT compression, LENGTH(data) FROM entities WHERE id IN (SELECT entitiy_id FROM `+db.Dialect().Quote("index_EntityText_Title")+` WHERE value=?)`), title).Scan(&compression, &size); err != nil {
+			t.Fatalf("error reading compression: %v", err)
+		}
+
+		if compression != expected || (expected != "" && size >= len(long.Text)) {
+			t.Fatalf("entity %v should be compressed by %q but is compressed by %q to %v bytes", title, expected, compression, size)
+		}
+	}
+	closeDB(t, db)
+
+	// compressed entities remain readable without compression
+	db, err = schemalessql.Open(driver, dsn)
+	if err != nil {
+		t.Fatalf("error connecting to database: %v", err)
+	}
+	defer closeDB(t, db)
+
+	var found []EntityText
+	if _, err := db.FindAll(db.NewQuery("EntityText").Filter("Title =", "long"), &found); err != nil || len(found) != 1 || found[0] != long {
+		t.Fatalf("error reading compressed entity: %v", err)
+	}
+}
@@ -0,0 +1,537 @@
+package schemalessql_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/der-antikeks/schemalessql"
+)
+
+// stores opens the implementations of Store that must behave identically.
+var stores = []struct {
+	name string
+	open func(t *testing.T) schemalessql.Store
+}{
+	{"Datastore", func(t *testing.T) schemalessql.Store { return newDB(t) }},
+	{"MemoryStore", func(t *testing.T) schemalessql.Store { return schemalessql.NewMemoryStore() }},
+}
+
+// conformance runs the test against every Store.
+func conformance(t *testing.T, test func(t *testing.T, db schemalessql.Store)) {
+	for _, store := range stores {
+		t.Run(store.name, func(t *testing.T) {
+			db := store.open(t)
+			defer func() {
+				if err := db.Close(); err != nil {
+					t.Fatalf("error closing store: %v", err)
+				}
+			}()
+
+			test(t, db)
+		})
+	}
+}
+
+func TestConformanceCRUD(t *testing.T) {
+	conformance(t, func(t *testing.T, db schemalessql.Store) {
+		e := Entity{123, 123.456, true, []byte{12, 34, 56}, "foo", time.Now().Round(0), nil}
+		key, err := db.Put(nil, e)
+		if err != nil {
+			t.Fatalf("error creating entity: %v", err)
+		}
+
+		var r Entity
+		if err := db.Get(key, &r); err != nil || !reflect.DeepEqual(e, r) {
+			t.Fatalf("error reading entity %v: %v", r, err)
+		}
+
+		e.E = "bar"
+		if nkey, err := db.Put(key, e); err != nil || *nkey != *key {
+			t.Fatalf("error updating entity %v: %v", nkey, err)
+		}
+
+		if err := db.FindOne(map[string]interface{}{"E": "bar"}, &r); err != nil || r.E != "bar" {
+			t.Fatalf("error finding updated entity %v: %v", r, err)
+		}
+
+		if err := db.Delete(key); err != nil {
+			t.Fatalf("error deleting entity: %v", err)
+		}
+
+		if keys, err := db.FindKeys("Entity", map[string]interface{}{"E": "bar"}); err != nil || len(keys) != 0 {
+			t.Fatalf("should not find deleted entity but found %v: %v", keys, err)
+		}
+
+		// a new entity does not reuse the key of the deleted one
+		nkey, err := db.Put(nil, e)
+		if err != nil || *nkey == *key {
+			t.Fatalf("error creating entity %v: %v", nkey, err)
+		}
+	})
+}
+
+func TestConformanceKeys(t *testing.T) {
+	conformance(t, func(t *testing.T, db schemalessql.Store) {
+		key := schemalessql.NewKey("EntityB", "alice@example.com")
+		if nkey, err := db.Put(key, EntityB{"foo"}); err != nil || nkey != key {
+			t.Fatalf("error creating entity with named key %v: %v", nkey, err)
+		}
+
+		if _, err := db.Put(schemalessql.NewKey("EntityB", "alice@example.com"), EntityB{"bar"}); err != nil {
+			t.Fatalf("error updating entity with named key: %v", err)
+		}
+
+		var b EntityB
+		if err := db.Get(key, &b); err != nil || b.Data != "bar" {
+			t.Fatalf("error reading entity with named key %v: %v", b, err)
+		}
+
+		ikey, err := db.Put(schemalessql.IDKey("EntityB", 1000), EntityB{"baz"})
+		if err != nil || ikey.ID() != 1000 || ikey.Kind() != "EntityB" || ikey.Name() != "" {
+			t.Fatalf("error creating entity with numeric key %v: %v", ikey, err)
+		}
+
+		// generated ids continue after the provided id
+		nkey, err := db.Put(nil, EntityB{"qux"})
+		if err != nil || nkey.ID() <= 1000 || nkey.Incomplete() {
+			t.Fatalf("error creating entity %v: %v", nkey, err)
+		}
+
+		keys, err := db.FindAllKeys(db.NewQuery("EntityB").Order("Data"))
+		if expected := []*schemalessql.Key{key, ikey, nkey}; err != nil || !reflect.DeepEqual(keys, expected) {
+			t.Fatalf("wrong keys of query results %v: %v", keys, err)
+		}
+
+		if _, err := db.Put(key, EntityA{1.5}); !errors.As(err, new(*schemalessql.KindMismatchError)) {
+			t.Fatalf("should receive kind mismatch error for key of another kind but got: %v", err)
+		}
+
+		if err := db.Delete(key); err != nil {
+			t.Fatalf("error deleting entity with named key: %v", err)
+		}
+
+		if err := db.Get(key, &b); err != sql.ErrNoRows {
+			t.Fatalf("should receive no rows error for deleted entity but got: %v", err)
+		}
+
+		if _, err := db.PutIfVersion(key, EntityB{"foo"}, 0); err != nil {
+			t.Fatalf("error recreating entity with named key: %v", err)
+		}
+	})
+}
+
+func TestConformanceAncestors(t *testing.T) {
+	conformance(t, func(t *testing.T, db schemalessql.Store) {
+		org, err := db.Put(schemalessql.NewKey("EntityA", "acme"), EntityA{1})
+		if err != nil {
+			t.Fatalf("error creating organisation: %v", err)
+		}
+
+		project, err := db.Put(schemalessql.IDKey("EntityB", 0).WithParent(org), EntityB{"project"})
+		if err != nil || !project.Parent().Equal(org) {
+			t.Fatalf("error creating project %v: %v", project, err)
+		}
+
+		tasks, err := db.PutMulti([]*schemalessql.Key{
+			schemalessql.NewKey("EntityTask", "first").WithParent(project),
+			schemalessql.IDKey("EntityTask", 0).WithParent(project),
+			nil,
+		}, []EntityTask{{Title: "a"}, {Title: "b"}, {Title: "c"}}, schemalessql.Atomic)
+		if err != nil {
+			t.Fatalf("error creating tasks: %v", err)
+		}
+
+		if _, err := db.Put(schemalessql.IDKey("EntityTask", 0).WithParent(schemalessql.NewKey("EntityA", "unknown")), EntityTask{Title: "d"}); err == nil {
+			t.Fatalf("should receive error for parent that does not exist")
+		}
+
+		if _, err := db.Put(schemalessql.IDKey("EntityTask", 0).WithParent(schemalessql.IDKey("EntityB", project.ID())), EntityTask{Title: "d"}); err == nil {
+			t.Fatalf("should receive error for parent key without its own parent")
+		}
+
+		if _, err := db.Put(schemalessql.NewKey("EntityTask", "first"), EntityTask{Title: "d"}); err == nil {
+			t.Fatalf("should receive error for changing the parent")
+		}
+
+		other, err := db.Put(schemalessql.IDKey("EntityB", 0).WithParent(org), EntityB{"other project"})
+		if err != nil {
+			t.Fatalf("error creating project: %v", err)
+		}
+
+		if _, err := db.Put(schemalessql.NewKey("EntityTask", "first").WithParent(other), EntityTask{Title: "d"}); err == nil {
+			t.Fatalf("should receive error for name of a task of another parent")
+		}
+
+		var task EntityTask
+		for _, key := range []*schemalessql.Key{
+			schemalessql.NewKey("EntityTask", "first"),
+			schemalessql.NewKey("EntityTask", "first").WithParent(other),
+			schemalessql.IDKey("EntityTask", tasks[1].ID()).WithParent(other),
+		} {
+			if err := db.Get(key, &task); err != sql.ErrNoRows {
+				t.Fatalf("should receive no rows error for reading %v but got: %v", key, err)
+			}
+
+			if err := db.Delete(key); err != sql.ErrNoRows {
+				t.Fatalf("should receive no rows error for deleting %v but got: %v", key, err)
+			}
+		}
+
+		if err := db.Get(tasks[0], &task); err != nil || task.Title != "a" {
+			t.Fatalf("should keep task of another parent but read %v: %v", task, err)
+		}
+
+		found, err := db.FindAllKeys(db.NewQuery("EntityTask").Ancestor(org).Order("Title"))
+		if expected := tasks[:2]; err != nil || !reflect.DeepEqual(found, expected) {
+			t.Fatalf("wrong descendants of organisation %v: %v", found, err)
+		}
+
+		if err := db.Delete(org); err != nil {
+			t.Fatalf("error deleting organisation: %v", err)
+		}
+
+		if err := db.DeleteCascade(project); err != nil {
+			t.Fatalf("error deleting project: %v", err)
+		}
+
+		if err := db.Get(tasks[1], &task); err != sql.ErrNoRows {
+			t.Fatalf("should receive no rows error for descendant of deleted project but got: %v", err)
+		}
+
+		if err := db.Get(tasks[2], &task); err != nil {
+			t.Fatalf("should not delete entity without parent: %v", err)
+		}
+	})
+}
+
+func TestConformanceErrors(t *testing.T) {
+	conformance(t, func(t *testing.T, db schemalessql.Store) {
+		key, err := db.Put(nil, EntityA{1.5})
+		if err != nil {
+			t.Fatalf("error creating entity: %v", err)
+		}
+
+		if err := db.Delete(key); err != nil {
+			t.Fatalf("error deleting entity: %v", err)
+		}
+
+		var a EntityA
+		if err := db.Get(key, &a); err != sql.ErrNoRows {
+			t.Fatalf("should receive no rows error for deleted entity but got: %v", err)
+		}
+
+		if err := db.Get(nil, &a); err != sql.ErrNoRows {
+			t.Fatalf("should receive no rows error for nil key but got: %v", err)
+		}
+
+		if err := db.Delete(key); err != sql.ErrNoRows {
+			t.Fatalf("should receive no rows error for deleting twice but got: %v", err)
+		}
+
+		if err := db.FindOne(map[string]interface{}{"Data": 1.5}, &a); err != sql.ErrNoRows {
+			t.Fatalf("should receive no rows error for finding nothing but got: %v", err)
+		}
+
+		if _, err := db.FindKeys("Entity", map[string]interface{}{"IgnoreMe": 1}); err != sql.ErrNoRows {
+			t.Fatalf("should receive no rows error for unindexed field but got: %v", err)
+		}
+
+		bkey, err := db.Put(nil, EntityB{"foo"})
+		if err != nil {
+			t.Fatalf("error creating entity: %v", err)
+		}
+
+		if err := db.Get(bkey, &a); !errors.As(err, new(*schemalessql.KindMismatchError)) {
+			t.Fatalf("should receive kind mismatch error for reading but got: %v", err)
+		}
+
+		if _, err := db.Put(bkey, EntityA{2.5}); !errors.As(err, new(*schemalessql.KindMismatchError)) {
+			t.Fatalf("should receive kind mismatch error for replacing but got: %v", err)
+		}
+
+		if err := db.Delete(schemalessql.IDKey("EntityA", bkey.ID())); !errors.As(err, new(*schemalessql.KindMismatchError)) {
+			t.Fatalf("should receive kind mismatch error for deleting but got: %v", err)
+		}
+
+		var b EntityB
+		if err := db.Get(bkey, &b); err != nil || b.Data != "foo" {
+			t.Fatalf("should keep entity of other kind but read %v: %v", b, err)
+		}
+
+		if err := db.Register(EntityRenamedB{}); err == nil {
+			t.Fatalf("should receive error for registering conflicting field")
+		}
+
+		if _, err := db.PutIfVersion(bkey, EntityB{"bar"}, 2); !errors.Is(err, schemalessql.ErrConflict) {
+			t.Fatalf("should receive conflict error but got: %v", err)
+		}
+	})
+}
+
+func TestConformanceHooks(t *testing.T) {
+	conformance(t, func(t *testing.T, db schemalessql.Store) {
+		e := EntityCreateHook{Data: "A"}
+		key, err := db.Put(nil, &e)
+		if err != nil || e.LastSaved.IsZero() || !e.Saved {
+			t.Fatalf("error calling save hooks %v: %v", e, err)
+		}
+
+		var r EntityReadHook
+		if _, err := db.Put(key, &EntityReadHook{Data: "B"}); err == nil {
+			t.Fatalf("should receive error for replacing entity of another kind")
+		}
+
+		rkey, err := db.Put(nil, &EntityReadHook{Data: "B"})
+		if err != nil {
+			t.Fatalf("error creating entity: %v", err)
+		}
+
+		if err := db.Get(rkey, &r); err != nil || !r.Loaded || !r.Test {
+			t.Fatalf("error calling load hooks %v: %v", r, err)
+		}
+
+		var found []EntityReadHook
+		if _, err := db.FindAll(db.NewQuery("EntityReadHook"), &found); err != nil || len(found) != 1 || !found[0].Loaded {
+			t.Fatalf("error calling load hooks of query results %v: %v", found, err)
+		}
+
+		// hooks of a failed transaction are not called
+		f := EntityCreateHook{Data: "C"}
+		err = db.RunInTransaction(context.Background(), func(tx *schemalessql.Tx) error {
+			if _, err := tx.Put(nil, &f); err != nil {
+				return err
+			}
+
+			return errors.New("abort")
+		})
+		if err == nil || f.Saved {
+			t.Fatalf("should not call after save hook of rolled back transaction %v: %v", f, err)
+		}
+	})
+}
+
+func TestConformanceVersions(t *testing.T) {
+	conformance(t, func(t *testing.T, db schemalessql.Store) {
+		e := &EntityVersioned{Data: "foo"}
+		key, err := db.Put(nil, e)
+		if err != nil || e.Version() != 1 {
+			t.Fatalf("error creating entity at version %v: %v", e.Version(), err)
+		}
+
+		var a, b EntityVersioned
+		if err := db.GetMulti([]*schemalessql.Key{key, key}, []*EntityVersioned{&a, &b}, schemalessql.Atomic); err == nil {
+			t.Fatalf("should receive error for destination slice of pointers")
+		}
+
+		if err := db.Get(key, &a); err != nil {
+			t.Fatalf("error reading entity: %v", err)
+		}
+
+		if err := db.Get(key, &b); err != nil {
+			t.Fatalf("error reading entity: %v", err)
+		}
+
+		if _, err := db.Put(key, &a); err != nil || a.Version() != 2 {
+			t.Fatalf("error updating entity to version %v: %v", a.Version(), err)
+		}
+
+		_, err = db.PutIfVersion(key, &b, b.Version())
+		var cerr *schemalessql.ConflictError
+		if !errors.As(err, &cerr) || cerr.Version != 1 || cerr.Stored != 2 {
+			t.Fatalf("should receive conflict error but got: %v", err)
+		}
+
+		// unconditional puts ignore the version of the entity
+		if _, err := db.Put(key, &b); err != nil || b.Version() != 3 {
+			t.Fatalf("error replacing entity at version %v: %v", b.Version(), err)
+		}
+
+		if _, err := db.PutIfVersion(nil, EntityA{1.5}, 1); !errors.Is(err, schemalessql.ErrConflict) {
+			t.Fatalf("should receive conflict error for new entity but got: %v", err)
+		}
+
+		if _, err := db.PutIfVersion(key, &EntityVersioned{Data: "bar"}, 3); err != nil {
+			t.Fatalf("error updating entity: %v", err)
+		}
+	})
+}
+
+func TestConformanceAtomic(t *testing.T) {
+	conformance(t, func(t *testing.T, db schemalessql.Store) {
+		other, err := db.Put(nil, EntityB{"foo"})
+		if err != nil {
+			t.Fatalf("error creating entity: %v", err)
+		}
+
+		// the second entity may not replace an entity of another kind
+		keys := []*schemalessql.Key{nil, other}
+		if _, err := db.PutMulti(keys, []EntityA{{1.5}, {2.5}}, schemalessql.Atomic); err == nil {
+			t.Fatalf("should receive error for replacing entity of another kind")
+		}
+
+		if found, err := db.FindKeys("EntityA", map[string]interface{}{"Data": 1.5}); err != nil || len(found) != 0 {
+			t.Fatalf("should not save any entity but found %v: %v", found, err)
+		}
+
+		if _, err := db.PutMulti(keys, []EntityA{{1.5}, {2.5}}, schemalessql.ContinueOnError); err == nil {
+			t.Fatalf("should receive error for replacing entity of another kind")
+		}
+
+		akeys, err := db.FindKeys("EntityA", map[string]interface{}{"Data": 1.5})
+		if err != nil || len(akeys) != 1 {
+			t.Fatalf("should save the first entity but found %v: %v", akeys, err)
+		}
+
+		if err := db.DeleteMulti(append(akeys, akeys[0]), schemalessql.Atomic); err != sql.ErrNoRows {
+			t.Fatalf("should receive no rows error for deleting twice but got: %v", err)
+		}
+
+		var a EntityA
+		if err := db.Get(akeys[0], &a); err != nil {
+			t.Fatalf("should not delete any entity: %v", err)
+		}
+
+		bs := make([]EntityB, 2)
+		if err := db.GetMulti([]*schemalessql.Key{other, akeys[0]}, bs, schemalessql.Atomic); !errors.As(err, new(*schemalessql.KindMismatchError)) {
+			t.Fatalf("should receive kind mismatch error but got: %v", err)
+		}
+	})
+}
+
+func TestConformanceTransaction(t *testing.T) {
+	conformance(t, func(t *testing.T, db schemalessql.Store) {
+		ctx := context.Background()
+		keys, err := db.PutMulti(nil, []Account{{"alice", 100}, {"bob", 50}}, schemalessql.Atomic)
+		if err != nil {
+			t.Fatalf("error creating accounts: %v", err)
+		}
+
+		if err := transfer(ctx, db, keys[0], keys[1], 30); err != nil {
+			t.Fatalf("error transferring balance: %v", err)
+		}
+
+		if err := transfer(ctx, db, keys[1], keys[0], 100); err == nil {
+			t.Fatalf("should receive error for insufficient balance")
+		}
+
+		if b := balances(t, db, keys); b[0] != 70 || b[1] != 80 {
+			t.Fatalf("wrong balances after transfers: %v", b)
+		}
+
+		// changes and registrations are rolled back
+		err = db.RunInTransaction(ctx, func(tx *schemalessql.Tx) error {
+			if _, err := tx.Put(nil, EntityTransaction{"foo"}); err != nil {
+				return err
+			}
+
+			if err := tx.Delete(keys[0]); err != nil {
+				return err
+			}
+
+			found, err := tx.FindAllKeys(db.NewQuery("EntityTransaction").Filter("Data =", "foo"))
+			if err != nil || len(found) != 1 {
+				t.Errorf("should find entity saved within the transaction but found %v: %v", found, err)
+			}
+
+			return errors.New("abort")
+		})
+		if err == nil || err.Error() != "abort" {
+			t.Fatalf("should receive error of the transaction function but got: %v", err)
+		}
+
+		if b := balances(t, db, keys); b[0] != 70 || b[1] != 80 {
+			t.Fatalf("wrong balances after rolled back transaction: %v", b)
+		}
+
+		if found, err := db.FindKeys("EntityTransaction", map[string]interface{}{"Data": "foo"}); err != sql.ErrNoRows {
+			t.Fatalf("should not find field of rolled back registration but found %v: %v", found, err)
+		}
+
+		if _, err := db.Put(nil, EntityTransaction{"bar"}); err != nil {
+			t.Fatalf("error creating entity after rolled back registration: %v", err)
+		}
+	})
+}
+
+func TestConformanceContext(t *testing.T) {
+	conformance(t, func(t *testing.T, db schemalessql.Store) {
+		ctx, cancel := context.WithCancel(context.Background())
+		key, err := db.PutContext(ctx, nil, EntityA{1.5})
+		if err != nil {
+			t.Fatalf("error creating entity: %v", err)
+		}
+
+		cancel()
+
+		if _, err := db.PutContext(ctx, key, EntityA{2.5}); !errors.Is(err, context.Canceled) {
+			t.Fatalf("should receive error for cancelled context but got: %v", err)
+		}
+
+		var a EntityA
+		if err := db.GetContext(ctx, key, &a); !errors.Is(err, context.Canceled) {
+			t.Fatalf("should receive error for cancelled context but got: %v", err)
+		}
+
+		if _, err := db.FindAllKeysContext(ctx, db.NewQuery("EntityA")); !errors.Is(err, context.Canceled) {
+			t.Fatalf("should receive error for cancelled context but got: %v", err)
+		}
+
+		if err := db.Get(key, &a); err != nil || a.Data != 1.5 {
+			t.Fatalf("error reading unmodified entity %v: %v", a, err)
+		}
+	})
+}
+
+// TestConformanceQueries compares the results of queries of both stores.
+func TestConformanceQueries(t *testing.T) {
+	results := make([][][]*schemalessql.Key, len(stores))
+	errs := make([][]bool, len(stores))
+
+	for i, store := range stores {
+		db := store.open(t)
+		defer db.Close()
+
+		entities, _ := putEntities(t, db, 30)
+		last := entities[29].F
+
+		queries := []*schemalessql.Query{
+			db.NewQuery("Entity"),
+			db.NewQuery("Entity").Filter("A >", 3).Filter("A <=", 16).Filter("C =", true),
+			db.NewQuery("Entity").Filter("A !=", 4).Order("-B").Limit(5).Offset(3),
+			db.NewQuery("Entity").Filter("B between", []float64{1, 7.5}).Order("E").Order("-A"),
+			db.NewQuery("Entity").Filter("A in", []int64{3, 5, 99}).Filter("E prefix", "d"),
+			db.NewQuery("Entity").Filter("E prefix", "").Order("D").Limit(7),
+			db.NewQuery("Entity").Filter("F >", last.Add(-time.Hour).In(time.Local)).Filter("F <=", last).Order("-F"),
+			db.NewQuery("Entity").Filter("C =", false).Order("C").Order("-E").Offset(5),
+			db.NewQuery("Entity").Filter("IgnoreMe =", 1),
+			db.NewQuery("Entity").Filter("A prefix", "1"),
+			db.NewQuery("Entity").Order("Unknown"),
+			db.NewQuery("Unknown"),
+		}
+
+		for _, q := range queries {
+			// the first page and the remaining pages
+			var keys []*schemalessql.Key
+			page, cursor, err := db.FindPage(q.Limit(4))
+			for err == nil && len(page) > 0 {
+				keys = append(keys, page...)
+				page, cursor, err = db.FindPage(q.Limit(4).Start(cursor))
+			}
+
+			results[i] = append(results[i], keys)
+			errs[i] = append(errs[i], err != nil)
+		}
+	}
+
+	for i := range results[0] {
+		for j := 1; j < len(stores); j++ {
+			if !reflect.DeepEqual(results[0][i], results[j][i]) || errs[0][i] != errs[j][i] {
+				t.Fatalf("results of query %v differ: \n%v: %v %v\n%v: %v %v", i, stores[0].name, results[0][i], errs[0][i], stores[j].name, results[j][i], errs[j][i])
+			}
+		}
+	}
+}
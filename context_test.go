@@ -0,0 +1,142 @@
+package schemalessql_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/der-antikeks/schemalessql"
+)
+
+type ctxKey struct{}
+
+type EntityContextHook struct {
+	Data  string
+	Saved string
+}
+
+func (e *EntityContextHook) BeforeSaveContext(ctx context.Context) {
+	e.Saved, _ = ctx.Value(ctxKey{}).(string)
+}
+
+func (e *EntityContextHook) AfterSaveContext(ctx context.Context) {
+	if cancel, ok := ctx.Value(cancelKey{}).(context.CancelFunc); ok {
+		cancel()
+	}
+}
+
+type cancelKey struct{}
+
+func TestContextHooks(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(t, db)
+
+	ctx := context.WithValue(context.Background(), ctxKey{}, "saved")
+
+	e := EntityContextHook{Data: "A"}
+	key, err := db.PutContext(ctx, nil, &e)
+	if err != nil {
+		t.Fatalf("error creating entity: %v", err)
+	}
+
+	var r EntityContextHook
+	if err := db.GetContext(ctx, key, &r); err != nil {
+		t.Fatalf("error reading entity: %v", err)
+	}
+
+	if r.Saved != "saved" {
+		t.Fatalf("hook did not receive context: %v", r)
+	}
+
+	// the first entity cancels the context of the remaining ones
+	ctx, cancel := context.WithCancel(ctx)
+	ctx = context.WithValue(ctx, cancelKey{}, cancel)
+
+	entities := []*EntityContextHook{{Data: "B"}, {Data: "C"}}
+	keys, err := db.PutMultiContext(ctx, nil, entities, schemalessql.StopOnError)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("should receive error for cancelled context but got: %v", err)
+	}
+
+	if keys[0] == nil || keys[1] != nil {
+		t.Fatalf("only the first entity should be saved: %v", keys)
+	}
+}
+
+func TestContextCancelled(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(t, db)
+
+	_, keys := putEntities(t, db, 5)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	var r Entity
+	if err := db.GetContext(ctx, keys[0], &r); !errors.Is(err, context.Canceled) {
+		t.Fatalf("should receive error for cancelled context but got: %v", err)
+	}
+
+	if err := db.DeleteContext(ctx, keys[0]); !errors.Is(err, context.Canceled) {
+		t.Fatalf("should receive error for cancelled context but got: %v", err)
+	}
+
+	if _, err := db.FindKeysContext(ctx, "Entity", map[string]interface{}{"C": true}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("should receive error for cancelled context but got: %v", err)
+	}
+
+	// cancel while iterating
+	ctx, cancel = context.WithCancel(context.Background())
+	it := db.RunContext(ctx, db.NewQuery("Entity"))
+	defer it.Close()
+
+	if _, err := it.Next(&r); err != nil {
+		t.Fatalf("error iterating entities: %v", err)
+	}
+
+	cancel()
+	if _, err := it.Next(&r); !errors.Is(err, context.Canceled) {
+		t.Fatalf("should receive error for cancelled context but got: %v", err)
+	}
+}
+
+func TestContextSlowQuery(t *testing.T) {
+	if testDialect != "sqlite3" {
+		t.Skip("the slow trigger is written for sqlite")
+	}
+
+	db, err := schemalessql.Open("sqlite3", filepath.Join(t.TempDir(), "slow.db"))
+	if err != nil {
+		t.Fatalf("error connecting to database: %v", err)
+	}
+	defer closeDB(t, db)
+
+	if err := db.Register(EntityA{}); err != nil {
+		t.Fatalf("error registering entity: %v", err)
+	}
+
+	// every insert runs an expensive query
+	if _, err := db.Exec(`CREATE TRIGGER slow AFTER INSERT ON entities BEGIN
+		SELECT count(*) FROM (WITH RECURSIVE c(x) AS (SELECT 1 UNION ALL SELECT x+1 FROM c) SELECT x FROM c LIMIT 1000000000);
+	END`); err != nil {
+		t.Fatalf("error creating trigger: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := db.PutContext(ctx, nil, EntityA{1.5}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("should receive error for exceeded deadline but got: %v", err)
+	}
+
+	if d := time.Since(start); d > 5*time.Second {
+		t.Fatalf("put was not cancelled at the deadline but took %v", d)
+	}
+
+	if keys, err := db.FindKeys("EntityA", nil); err != nil || len(keys) != 0 {
+		t.Fatalf("cancelled put should not save the entity: %v %v", err, keys)
+	}
+}
@@ -0,0 +1,240 @@
+package schemalessql
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Cursor is the position of an entity within the results of a query.
+// It consists of the sort values and the key of the entity and can be used to continue a query after this entity.
+type Cursor struct {
+	values []interface{}
+	id     int64
+}
+
+// types of the encoded cursor values
+const (
+	cursorNil    = 'n'
+	cursorInt    = 'i'
+	cursorFloat  = 'f'
+	cursorBool   = 'b'
+	cursorString = 's'
+	cursorBytes  = 'y'
+	cursorTime   = 't'
+)
+
+// String returns an opaque, URL-safe representation of the cursor.
+func (c Cursor) String() string {
+	if c.id == 0 {
+		return ""
+	}
+
+	buf := binary.AppendUvarint(nil, uint64(len(c.values)))
+	for _, v := range c.values {
+		switch vi := v.(type) {
+		case nil:
+			buf = append(buf, cursorNil)
+		case int64:
+			buf = binary.AppendVarint(append(buf, cursorInt), vi)
+		case float64:
+			buf = binary.BigEndian.AppendUint64(append(buf, cursorFloat), math.Float64bits(vi))
+		case bool:
+			if vi {
+				buf = append(buf, cursorBool, 1)
+			} else {
+				buf = append(buf, cursorBool, 0)
+			}
+		case string:
+			buf = binary.AppendUvarint(append(buf, cursorString), uint64(len(vi)))
+			buf = append(buf, vi...)
+		case []byte:
+			buf = binary.AppendUvarint(append(buf, cursorBytes), uint64(len(vi)))
+			buf = append(buf, vi...)
+		case time.Time:
+			b, _ := vi.MarshalBinary()
+			buf = binary.AppendUvarint(append(buf, cursorTime), uint64(len(b)))
+			buf = append(buf, b...)
+		default:
+			// the scanned values are converted by cursorValue, any other value is encoded as text
+			s := fmt.Sprint(vi)
+			buf = binary.AppendUvarint(append(buf, cursorString), uint64(len(s)))
+			buf = append(buf, s...)
+		}
+	}
+	buf = binary.AppendVarint(buf, c.id)
+
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+// cursorValue converts a sort value scanned from the index tables into one of the value types of a cursor,
+// as drivers may scan other types than those of driver.Value.
+func cursorValue(v interface{}) (interface{}, error) {
+	switch v.(type) {
+	case nil, int64, float64, bool, string, []byte, time.Time:
+		return v, nil
+	}
+
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int(), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if u := rv.Uint(); u <= math.MaxInt64 {
+			return int64(u), nil
+		}
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), nil
+	case reflect.Bool:
+		return rv.Bool(), nil
+	case reflect.String:
+		return rv.String(), nil
+	case reflect.Slice:
+		if rv.Type().Elem().Kind() == reflect.Uint8 {
+			return rv.Bytes(), nil
+		}
+	}
+
+	return nil, fmt.Errorf("schemalessql: unsupported sort value %T", v)
+}
+
+// DecodeCursor decodes a cursor from its String representation.
+func DecodeCursor(s string) (Cursor, error) {
+	if s == "" {
+		return Cursor{}, nil
+	}
+
+	buf, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return Cursor{}, fmt.Errorf("schemalessql: invalid cursor: %w", err)
+	}
+
+	invalid := fmt.Errorf("schemalessql: invalid cursor %q", s)
+
+	// length prefixed payload
+	next := func() ([]byte, bool) {
+		n, l := binary.Uvarint(buf)
+		if l <= 0 || uint64(len(buf)-l) < n {
+			return nil, false
+		}
+
+		b := buf[l : l+int(n)]
+		buf = buf[l+int(n):]
+		return b, true
+	}
+
+	n, l := binary.Uvarint(buf)
+	if l <= 0 || n > uint64(len(buf)) {
+		return Cursor{}, invalid
+	}
+	buf = buf[l:]
+
+	var c Cursor
+	for i := uint64(0); i < n; i++ {
+		if len(buf) == 0 {
+			return Cursor{}, invalid
+		}
+
+		t := buf[0]
+		buf = buf[1:]
+
+		switch t {
+		case cursorNil:
+			c.values = append(c.values, nil)
+		case cursorInt:
+			v, l := binary.Varint(buf)
+			if l <= 0 {
+				return Cursor{}, invalid
+			}
+			buf = buf[l:]
+			c.values = append(c.values, v)
+		case cursorFloat:
+			if len(buf) < 8 {
+				return Cursor{}, invalid
+			}
+			c.values = append(c.values, math.Float64frombits(binary.BigEndian.Uint64(buf)))
+			buf = buf[8:]
+		case cursorBool:
+			if len(buf) < 1 {
+				return Cursor{}, invalid
+			}
+			c.values = append(c.values, buf[0] == 1)
+			buf = buf[1:]
+		case cursorString:
+			b, ok := next()
+			if !ok {
+				return Cursor{}, invalid
+			}
+			c.values = append(c.values, string(b))
+		case cursorBytes:
+			b, ok := next()
+			if !ok {
+				return Cursor{}, invalid
+			}
+			c.values = append(c.values, append([]byte(nil), b...))
+		case cursorTime:
+			b, ok := next()
+			if !ok {
+				return Cursor{}, invalid
+			}
+
+			var v time.Time
+			if err := v.UnmarshalBinary(b); err != nil {
+				return Cursor{}, invalid
+			}
+			c.values = append(c.values, v)
+		default:
+			return Cursor{}, invalid
+		}
+	}
+
+	id, l := binary.Varint(buf)
+	if l <= 0 || l != len(buf) || id == 0 {
+		return Cursor{}, invalid
+	}
+	c.id = id
+
+	return c, nil
+}
+
+// condition returns the sql condition selecting all results after the cursor, or up to and including the cursor if end is true.
+// The columns contain the sort values of the query orders, which must match the values of the cursor.
+func (c *Cursor) condition(orders []order, columns []string, end bool) (string, []interface{}) {
+	var alternatives []string
+	var args []interface{}
+
+	// (o0 > v0) OR (o0 = v0 AND o1 > v1) OR ... OR (o0 = v0 AND ... AND id > cursor id)
+	for i := 0; i <= len(orders); i++ {
+		var conds []string
+		for j := 0; j < i; j++ {
+			conds = append(conds, columns[j]+`=?`)
+			args = append(args, c.values[j])
+		}
+
+		if i < len(orders) {
+			op := `>`
+			if orders[i].desc != end {
+				op = `<`
+			}
+
+			conds = append(conds, columns[i]+op+`?`)
+			args = append(args, c.values[i])
+		} else {
+			op := `>`
+			if end {
+				op = `<=`
+			}
+
+			conds = append(conds, `e.id`+op+`?`)
+			args = append(args, c.id)
+		}
+
+		alternatives = append(alternatives, `(`+strings.Join(conds, ` AND `)+`)`)
+	}
+
+	return `(` + strings.Join(alternatives, ` OR `) + `)`, args
+}
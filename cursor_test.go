@@ -0,0 +1,110 @@
+package schemalessql_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/der-antikeks/schemalessql"
+)
+
+func TestCursorPages(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(t, db)
+
+	_, keys := putEntities(t, db, 30)
+
+	queries := []struct {
+		query    *schemalessql.Query
+		expected []*schemalessql.Key
+	}{
+		{db.NewQuery("Entity").Filter("A <", 10), keys[:10]},
+		{db.NewQuery("Entity").Filter("A <", 10).Order("-F"), reverse(keys[:10])},
+		{db.NewQuery("Entity").Filter("A <", 10).Order("-C").Order("E"), append(everyOther(keys[0:10]), everyOther(keys[1:10])...)},
+	}
+
+	for i, test := range queries {
+		var result []*schemalessql.Key
+		var cursor schemalessql.Cursor
+
+		for {
+			// pass the cursor as string as it would be done in an url
+			c, err := schemalessql.DecodeCursor(cursor.String())
+			if err != nil {
+				t.Fatalf("error decoding cursor in query %v: %v", i, err)
+			}
+
+			page, next, err := db.FindPage(test.query.Start(c).Limit(3))
+			if err != nil {
+				t.Fatalf("error finding entities in query %v: %v", i, err)
+			}
+
+			if len(page) == 0 {
+				if next.String() != cursor.String() {
+					t.Fatalf("cursor of empty page differs from start cursor in query %v", i)
+				}
+				break
+			}
+
+			result = append(result, page...)
+			cursor = next
+		}
+
+		if !reflect.DeepEqual(result, test.expected) {
+			t.Fatalf("error paging entities in query %v, keys do not match: \n%v\n%v", i, test.expected, result)
+		}
+	}
+}
+
+func TestCursorEnd(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(t, db)
+
+	_, keys := putEntities(t, db, 10)
+
+	q := db.NewQuery("Entity").Order("-F")
+	_, start, err := db.FindPage(q.Limit(2))
+	if err != nil {
+		t.Fatalf("error finding entities: %v", err)
+	}
+
+	_, end, err := db.FindPage(q.Limit(5))
+	if err != nil {
+		t.Fatalf("error finding entities: %v", err)
+	}
+
+	result, err := db.FindAllKeys(q.Start(start).End(end))
+	if err != nil {
+		t.Fatalf("error finding entities: %v", err)
+	}
+
+	if expected := reverse(keys[5:8]); !reflect.DeepEqual(result, expected) {
+		t.Fatalf("error finding entities, keys do not match: \n%v\n%v", expected, result)
+	}
+
+	// cursors of other orders are rejected
+	if _, err := db.FindAllKeys(db.NewQuery("Entity").Start(start)); err == nil {
+		t.Fatalf("should receive error for cursor of another query")
+	}
+
+	if _, err := schemalessql.DecodeCursor("invalid!"); err == nil {
+		t.Fatalf("should receive error for invalid cursor")
+	}
+}
+
+func reverse(keys []*schemalessql.Key) []*schemalessql.Key {
+	r := make([]*schemalessql.Key, len(keys))
+	for i, k := range keys {
+		r[len(keys)-1-i] = k
+	}
+
+	return r
+}
+
+func everyOther(keys []*schemalessql.Key) []*schemalessql.Key {
+	var r []*schemalessql.Key
+	for i := 0; i < len(keys); i += 2 {
+		r = append(r, keys[i])
+	}
+
+	return r
+}
@@ -0,0 +1,556 @@
+package schemalessql
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Dialect generates the database specific parts of the SQL statements.
+// Statements are written with ? placeholders and unquoted lower case column names.
+type Dialect interface {
+	// Quote quotes a table or index name.
+	Quote(identifier string) string
+
+	// Rebind replaces the ? placeholders of the statement with the placeholders of the database.
+	Rebind(query string) string
+
+	// ColumnType returns the column type of the field types INTEGER, FLOAT, BOOL, TEXT, BLOB, DATETIME and JSON,
+	// or the column definition of an automatically incremented integer primary key for SERIAL.
+	ColumnType(sqltype string) string
+
+	// CreateTable returns the statements that create the table and its indexes unless they exist.
+	CreateTable(table Table) []string
+
+	// TransactionalDDL reports whether tables can be created within a transaction without committing it.
+	TransactionalDDL() bool
+
+	// Columns returns the query that selects the names of the columns of the table, its single placeholder.
+	// It selects no rows if the table does not exist.
+	Columns() string
+
+	// Returning returns the clause that makes an insert statement return the column,
+	// or an empty string if the id is reported by sql.Result.LastInsertId.
+	Returning(column string) string
+
+	// SyncSequence returns the statement that advances the automatic increment of the table
+	// after an explicit id (the single placeholder) has been inserted, or an empty string if it is not necessary.
+	SyncSequence(table, column string) string
+
+	// Upsert returns the statement that inserts the key and columns, or updates the columns if the key already exists.
+	Upsert(table, key string, columns ...string) string
+
+	// Limit returns the LIMIT and OFFSET clause and its arguments, a negative limit means unlimited.
+	Limit(limit, offset int) (string, []interface{})
+
+	// Isolation returns the isolation level of transactions started by RunInTransaction.
+	Isolation() sql.IsolationLevel
+
+	// IsRetryable reports whether a transaction failed because of concurrent transactions and can be retried.
+	IsRetryable(err error) bool
+
+	// JSONExtract returns the expression that extracts the value at the path of the JSON column,
+	// the names of the path consist of letters, digits and underscores.
+	JSONExtract(column string, path []string) string
+
+	// JSONValue returns the expression that converts the placeholder, a JSON encoded value,
+	// into a value comparable with the results of JSONExtract.
+	JSONValue() string
+}
+
+// Table describes a table and its indexes for Dialect.CreateTable.
+type Table struct {
+	Name       string
+	Columns    []Column
+	PrimaryKey []string
+	Indexes    []Index
+}
+
+// Column is a column of a Table.
+type Column struct {
+	Name string
+
+	// field type, see Dialect.ColumnType
+	Type string
+
+	// e.g. NOT NULL, UNIQUE or DEFAULT
+	Constraints string
+}
+
+// Index is an index of a Table.
+type Index struct {
+	Name    string
+	Unique  bool
+	Columns []string
+}
+
+// dialects maps the database driver names to their default dialects.
+var dialects = map[string]Dialect{
+	"sqlite3":  SQLite,
+	"sqlite":   SQLite,
+	"postgres": Postgres,
+	"pgx":      Postgres,
+	"mysql":    MySQL,
+}
+
+// SQLite is the Dialect of SQLite 3.24 and later.
+var SQLite Dialect = sqliteDialect{}
+
+type sqliteDialect struct{}
+
+func (sqliteDialect) Quote(identifier string) string {
+	return `"` + strings.Replace(identifier, `"`, `""`, -1) + `"`
+}
+
+func (sqliteDialect) Rebind(query string) string {
+	return query
+}
+
+func (sqliteDialect) ColumnType(sqltype string) string {
+	switch sqltype {
+	case "SERIAL":
+		return `INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL`
+	case "JSON":
+		// without the numeric affinity of unknown types
+		return `TEXT`
+	}
+
+	return sqltype
+}
+
+func (d sqliteDialect) CreateTable(table Table) []string {
+	return createTable(d, table)
+}
+
+func (sqliteDialect) TransactionalDDL() bool {
+	return true
+}
+
+func (sqliteDialect) Columns() string {
+	return `SELECT name FROM pragma_table_info(?)`
+}
+
+func (sqliteDialect) Returning(column string) string {
+	return ``
+}
+
+func (sqliteDialect) SyncSequence(table, column string) string {
+	// AUTOINCREMENT continues after the largest id
+	return ``
+}
+
+func (d sqliteDialect) Upsert(table, key string, columns ...string) string {
+	return upsert(d, table, key, columns)
+}
+
+func (sqliteDialect) Limit(limit, offset int) (string, []interface{}) {
+	return ` LIMIT ? OFFSET ?`, []interface{}{limit, offset}
+}
+
+func (sqliteDialect) Isolation() sql.IsolationLevel {
+	// transactions are always serializable
+	return sql.LevelDefault
+}
+
+func (sqliteDialect) IsRetryable(err error) bool {
+	// SQLITE_BUSY or SQLITE_LOCKED, of github.com/mattn/go-sqlite3 or modernc.org/sqlite with extended codes
+	var e interface{ Code() int }
+	if errors.As(err, &e) {
+		return e.Code()&0xff == 5 || e.Code()&0xff == 6
+	}
+
+	return driverError(err, "github.com/mattn/go-sqlite3", "Code", 5, 6)
+}
+
+func (sqliteDialect) JSONExtract(column string, path []string) string {
+	return `json_extract(` + column + `, '` + jsonPath(path) + `')`
+}
+
+func (sqliteDialect) JSONValue() string {
+	return `json_extract(?, '$')`
+}
+
+// Postgres is the Dialect of PostgreSQL 9.5 and later.
+var Postgres Dialect = postgresDialect{}
+
+type postgresDialect struct{}
+
+func (postgresDialect) Quote(identifier string) string {
+	return `"` + strings.Replace(identifier, `"`, `""`, -1) + `"`
+}
+
+func (postgresDialect) Rebind(query string) string {
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString(`$` + strconv.Itoa(n))
+			continue
+		}
+
+		b.WriteRune(r)
+	}
+
+	return b.String()
+}
+
+func (postgresDialect) ColumnType(sqltype string) string {
+	switch sqltype {
+	case "INTEGER":
+		return `BIGINT`
+	case "FLOAT":
+		return `DOUBLE PRECISION`
+	case "BOOL":
+		return `BOOLEAN`
+	case "TEXT":
+		// byte order, like SQLite
+		return `TEXT COLLATE "C"`
+	case "BLOB":
+		return `BYTEA`
+	case "DATETIME":
+		return `TIMESTAMP WITH TIME ZONE`
+	case "JSON":
+		return `JSONB`
+	case "SERIAL":
+		return `BIGSERIAL PRIMARY KEY`
+	}
+
+	return sqltype
+}
+
+func (d postgresDialect) CreateTable(table Table) []string {
+	return createTable(d, table)
+}
+
+func (postgresDialect) TransactionalDDL() bool {
+	return true
+}
+
+func (postgresDialect) Columns() string {
+	return `SELECT column_name FROM information_schema.columns WHERE table_schema=current_schema() AND table_name=?`
+}
+
+func (postgresDialect) Returning(column string) string {
+	return ` RETURNING ` + column
+}
+
+func (d postgresDialect) SyncSequence(table, column string) string {
+	sequence := `pg_get_serial_sequence('` + strings.Replace(d.Quote(table), `'`, `''`, -1) + `', '` + column + `')`
+	return `SELECT setval(` + sequence + `, GREATEST(nextval(` + sequence + `), ?))`
+}
+
+func (d postgresDialect) Upsert(table, key string, columns ...string) string {
+	return upsert(d, table, key, columns)
+}
+
+func (postgresDialect) Limit(limit, offset int) (string, []interface{}) {
+	if limit < 0 {
+		// LIMIT NULL is unlimited
+		return ` LIMIT ? OFFSET ?`, []interface{}{nil, offset}
+	}
+
+	return ` LIMIT ? OFFSET ?`, []interface{}{limit, offset}
+}
+
+func (postgresDialect) Isolation() sql.IsolationLevel {
+	return sql.LevelSerializable
+}
+
+func (postgresDialect) IsRetryable(err error) bool {
+	// serialization_failure or deadlock_detected, of github.com/lib/pq or github.com/jackc/pgx
+	var e interface{ SQLState() string }
+	return errors.As(err, &e) && (e.SQLState() == "40001" || e.SQLState() == "40P01")
+}
+
+func (postgresDialect) JSONExtract(column string, path []string) string {
+	return `(` + column + ` #> '{"` + strings.Join(path, `","`) + `"}')`
+}
+
+func (postgresDialect) JSONValue() string {
+	return `CAST(? AS JSONB)`
+}
+
+// MySQL is the Dialect of MySQL 5.7 and MariaDB 10.2 and later.
+// The data source name should set parseTime=true.
+// Kinds, field names and names of keys are limited to 384 characters, table and index names longer than 64 characters are shortened by a hash.
+var MySQL Dialect = mysqlDialect{}
+
+type mysqlDialect struct{}
+
+// mysqlPrefix is the length of the indexed prefix of TEXT and BLOB values.
+const mysqlPrefix = 255
+
+// mysqlKeyLength is the number of utf8mb4 characters that fit into the 3072 bytes of an InnoDB key,
+// the TEXT columns of primary keys and unique indexes share them as VARCHAR columns.
+const mysqlKeyLength = 768
+
+// mysqlIdentifier is the maximum length of table and index names.
+const mysqlIdentifier = 64
+
+func (mysqlDialect) Quote(identifier string) string {
+	if utf8.RuneCountInString(identifier) > mysqlIdentifier {
+		// the start of the name and a hash of the entire name
+		sum := sha256.Sum256([]byte(identifier))
+		hash := hex.EncodeToString(sum[:8])
+		identifier = string([]rune(identifier)[:mysqlIdentifier-len(hash)-1]) + `_` + hash
+	}
+
+	return "`" + strings.Replace(identifier, "`", "``", -1) + "`"
+}
+
+func (mysqlDialect) Rebind(query string) string {
+	return query
+}
+
+func (mysqlDialect) ColumnType(sqltype string) string {
+	switch sqltype {
+	case "INTEGER":
+		return `BIGINT`
+	case "FLOAT":
+		return `DOUBLE`
+	case "BOOL":
+		return `BOOLEAN`
+	case "TEXT":
+		// byte order, like SQLite
+		return `TEXT CHARACTER SET utf8mb4 COLLATE utf8mb4_bin`
+	case "BLOB":
+		return `LONGBLOB`
+	case "DATETIME":
+		return `DATETIME(6)`
+	case "JSON":
+		return `JSON`
+	case "SERIAL":
+		return `BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY`
+	}
+
+	return sqltype
+}
+
+func (d mysqlDialect) CreateTable(table Table) []string {
+	types := make(map[string]string)
+	for _, column := range table.Columns {
+		types[column.Name] = column.Type
+	}
+
+	// TEXT columns of primary keys and unique indexes are VARCHAR columns, which are indexed entirely
+	keys := [][]string{table.PrimaryKey}
+	for _, index := range table.Indexes {
+		if index.Unique {
+			keys = append(keys, index.Columns)
+		}
+	}
+
+	varchars := make(map[string]int)
+	for _, key := range keys {
+		var text []string
+		for _, column := range key {
+			if types[column] == "TEXT" {
+				text = append(text, column)
+			}
+		}
+
+		for _, column := range text {
+			if n, found := varchars[column]; !found || mysqlKeyLength/len(text) < n {
+				varchars[column] = mysqlKeyLength / len(text)
+			}
+		}
+	}
+
+	definitions := columnDefinitions(d, table)
+	for i, column := range table.Columns {
+		if n, found := varchars[column.Name]; found {
+			definitions[i] = column.Name + ` VARCHAR(` + strconv.Itoa(n) + `) CHARACTER SET utf8mb4 COLLATE utf8mb4_bin`
+			if column.Constraints != "" {
+				definitions[i] += ` ` + column.Constraints
+			}
+		}
+	}
+
+	// other TEXT and BLOB columns can only be indexed by a prefix
+	indexColumns := func(columns []string) string {
+		result := make([]string, len(columns))
+		for i, column := range columns {
+			result[i] = column
+			if _, found := varchars[column]; !found && (types[column] == "TEXT" || types[column] == "BLOB") {
+				result[i] += `(` + strconv.Itoa(mysqlPrefix) + `)`
+			}
+		}
+
+		return strings.Join(result, `, `)
+	}
+
+	// CREATE INDEX IF NOT EXISTS is not supported, the indexes are created with the table
+	if len(table.PrimaryKey) > 0 {
+		definitions = append(definitions, `PRIMARY KEY (`+indexColumns(table.PrimaryKey)+`)`)
+	}
+
+	for _, index := range table.Indexes {
+		definition := `INDEX `
+		if index.Unique {
+			definition = `UNIQUE INDEX `
+		}
+
+		definitions = append(definitions, definition+d.Quote(index.Name)+` (`+indexColumns(index.Columns)+`)`)
+	}
+
+	return []string{`CREATE TABLE IF NOT EXISTS ` + d.Quote(table.Name) + ` (` + strings.Join(definitions, `, `) + `) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`}
+}
+
+func (mysqlDialect) Columns() string {
+	return `SELECT column_name FROM information_schema.columns WHERE table_schema=DATABASE() AND table_name=?`
+}
+
+func (mysqlDialect) TransactionalDDL() bool {
+	// CREATE TABLE commits the transaction implicitly
+	return false
+}
+
+func (mysqlDialect) Returning(column string) string {
+	return ``
+}
+
+func (mysqlDialect) SyncSequence(table, column string) string {
+	// AUTO_INCREMENT continues after the largest id
+	return ``
+}
+
+func (d mysqlDialect) Upsert(table, key string, columns ...string) string {
+	placeholders := make([]string, len(columns)+1)
+	updates := make([]string, len(columns))
+	for i := range placeholders {
+		placeholders[i] = `?`
+	}
+
+	for i, column := range columns {
+		updates[i] = column + `=VALUES(` + column + `)`
+	}
+
+	return `INSERT INTO ` + d.Quote(table) + ` (` + key + `, ` + strings.Join(columns, `, `) + `) VALUES (` + strings.Join(placeholders, `, `) + `)` +
+		` ON DUPLICATE KEY UPDATE ` + strings.Join(updates, `, `)
+}
+
+func (mysqlDialect) Limit(limit, offset int) (string, []interface{}) {
+	if limit < 0 {
+		// there is no unlimited LIMIT, an OFFSET requires the largest possible one
+		return ` LIMIT 18446744073709551615 OFFSET ?`, []interface{}{offset}
+	}
+
+	return ` LIMIT ? OFFSET ?`, []interface{}{limit, offset}
+}
+
+func (mysqlDialect) Isolation() sql.IsolationLevel {
+	return sql.LevelSerializable
+}
+
+func (mysqlDialect) IsRetryable(err error) bool {
+	// ER_LOCK_DEADLOCK or ER_LOCK_WAIT_TIMEOUT
+	return driverError(err, "github.com/go-sql-driver/mysql", "Number", 1213, 1205)
+}
+
+func (mysqlDialect) JSONExtract(column string, path []string) string {
+	return `JSON_EXTRACT(` + column + `, '` + jsonPath(path) + `')`
+}
+
+func (mysqlDialect) JSONValue() string {
+	// MariaDB has no JSON type to cast to
+	return `JSON_EXTRACT(?, '$')`
+}
+
+// createTable returns a CREATE TABLE statement followed by a CREATE INDEX statement for every index.
+func createTable(d Dialect, table Table) []string {
+	definitions := columnDefinitions(d, table)
+	if len(table.PrimaryKey) > 0 {
+		definitions = append(definitions, `PRIMARY KEY (`+strings.Join(table.PrimaryKey, `, `)+`)`)
+	}
+
+	stmts := []string{`CREATE TABLE IF NOT EXISTS ` + d.Quote(table.Name) + ` (` + strings.Join(definitions, `, `) + `)`}
+	for _, index := range table.Indexes {
+		create := `CREATE INDEX IF NOT EXISTS `
+		if index.Unique {
+			create = `CREATE UNIQUE INDEX IF NOT EXISTS `
+		}
+
+		stmts = append(stmts, create+d.Quote(index.Name)+` ON `+d.Quote(table.Name)+` (`+strings.Join(index.Columns, `, `)+`)`)
+	}
+
+	return stmts
+}
+
+// columnDefinitions returns the definitions of the columns of the table.
+func columnDefinitions(d Dialect, table Table) []string {
+	definitions := make([]string, len(table.Columns))
+	for i, column := range table.Columns {
+		definitions[i] = column.Name + ` ` + d.ColumnType(column.Type)
+		if column.Constraints != "" {
+			definitions[i] += ` ` + column.Constraints
+		}
+	}
+
+	return definitions
+}
+
+// upsert returns an INSERT ... ON CONFLICT DO UPDATE statement.
+func upsert(d Dialect, table, key string, columns []string) string {
+	placeholders := make([]string, len(columns)+1)
+	updates := make([]string, len(columns))
+	for i := range placeholders {
+		placeholders[i] = `?`
+	}
+
+	for i, column := range columns {
+		updates[i] = column + `=excluded.` + column
+	}
+
+	return `INSERT INTO ` + d.Quote(table) + ` (` + key + `, ` + strings.Join(columns, `, `) + `) VALUES (` + strings.Join(placeholders, `, `) + `)` +
+		` ON CONFLICT (` + key + `) DO UPDATE SET ` + strings.Join(updates, `, `)
+}
+
+// jsonPath returns the JSON path expression of SQLite and MySQL, e.g. $."Address"."City".
+func jsonPath(path []string) string {
+	return `$."` + strings.Join(path, `"."`) + `"`
+}
+
+// driverError reports whether an error in the chain of err is a struct, or a pointer to a struct, of the package of a driver,
+// whose integer field is one of the codes. The drivers are not imported, so that only the used one is compiled in.
+func driverError(err error, pkgPath, field string, codes ...int64) bool {
+	for err != nil {
+		if v := reflect.Indirect(reflect.ValueOf(err)); v.Kind() == reflect.Struct && v.Type().PkgPath() == pkgPath {
+			var code int64
+			switch f := v.FieldByName(field); {
+			case f.CanInt():
+				code = f.Int()
+			case f.CanUint():
+				code = int64(f.Uint())
+			}
+
+			for _, c := range codes {
+				if code == c {
+					return true
+				}
+			}
+		}
+
+		switch e := err.(type) {
+		case interface{ Unwrap() []error }:
+			for _, err := range e.Unwrap() {
+				if driverError(err, pkgPath, field, codes...) {
+					return true
+				}
+			}
+
+			return false
+		case interface{ Unwrap() error }:
+			err = e.Unwrap()
+		default:
+			return false
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,400 @@
+package schemalessql_test
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/der-antikeks/schemalessql"
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+)
+
+// The tests run against SQLite, unless SCHEMALESSQL_TEST_DIALECT selects another database:
+//
+//	postgres: the server of SCHEMALESSQL_POSTGRES_DSN, or a temporary server started with initdb and pg_ctl
+//	mysql: the server of SCHEMALESSQL_MYSQL_DSN (e.g. user:password@tcp(host)/), or a temporary mysqld or mariadbd
+//
+// The tests fail if the selected database is not available, see the Makefile.
+var testDialect = os.Getenv("SCHEMALESSQL_TEST_DIALECT")
+
+// dialects maps the test drivers to their dialects.
+var dialects = map[string]schemalessql.Dialect{
+	"sqlite3":  schemalessql.SQLite,
+	"postgres": schemalessql.Postgres,
+	"mysql":    schemalessql.MySQL,
+}
+
+// testServer is the DSN of the database server and the number of databases created on it.
+var testServer struct {
+	dsn string
+	n   int
+}
+
+func TestMain(m *testing.M) {
+	code := func() int {
+		switch testDialect {
+		case "", "sqlite3":
+			testDialect = "sqlite3"
+		case "postgres":
+			stop, err := startPostgres()
+			defer stop()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "postgres is not available: %v\n", err)
+				return 1
+			}
+		case "mysql":
+			stop, err := startMySQL()
+			defer stop()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "mysql is not available: %v\n", err)
+				return 1
+			}
+		default:
+			fmt.Fprintf(os.Stderr, "unknown test dialect %v\n", testDialect)
+			return 2
+		}
+
+		return m.Run()
+	}()
+
+	os.Exit(code)
+}
+
+// testDSN returns the driver name and the DSN of a new, empty database.
+func testDSN(t *testing.T) (string, string) {
+	switch testDialect {
+	case "postgres":
+		admin, err := sql.Open("postgres", testServer.dsn)
+		if err != nil {
+			t.Fatalf("error connecting to database server: %v", err)
+		}
+		defer admin.Close()
+
+		testServer.n++
+		name := fmt.Sprintf("schemalessql_%v_%v", os.Getpid(), testServer.n)
+		if _, err := admin.Exec(`CREATE DATABASE ` + name); err != nil {
+			t.Fatalf("error creating database: %v", err)
+		}
+
+		t.Cleanup(func() {
+			if admin, err := sql.Open("postgres", testServer.dsn); err == nil {
+				admin.Exec(`DROP DATABASE IF EXISTS ` + name)
+				admin.Close()
+			}
+		})
+
+		return "postgres", testServer.dsn + " dbname=" + name
+	case "mysql":
+		admin, err := sql.Open("mysql", testServer.dsn)
+		if err != nil {
+			t.Fatalf("error connecting to database server: %v", err)
+		}
+		defer admin.Close()
+
+		testServer.n++
+		name := fmt.Sprintf("schemalessql_%v_%v", os.Getpid(), testServer.n)
+		if _, err := admin.Exec(`CREATE DATABASE ` + name); err != nil {
+			t.Fatalf("error creating database: %v", err)
+		}
+
+		t.Cleanup(func() {
+			if admin, err := sql.Open("mysql", testServer.dsn); err == nil {
+				admin.Exec(`DROP DATABASE IF EXISTS ` + name)
+				admin.Close()
+			}
+		})
+
+		return "mysql", testServer.dsn + name + "?parseTime=true"
+	}
+
+	return "sqlite3", filepath.Join(t.TempDir(), "test.db")
+}
+
+// startPostgres starts a temporary postgres server unless SCHEMALESSQL_POSTGRES_DSN is set.
+func startPostgres() (func(), error) {
+	if dsn := os.Getenv("SCHEMALESSQL_POSTGRES_DSN"); dsn != "" {
+		testServer.dsn = dsn
+		return func() {}, nil
+	}
+
+	bin, err := postgresBin()
+	if err != nil {
+		return func() {}, err
+	}
+
+	dir, err := os.MkdirTemp("", "pg")
+	if err != nil {
+		return func() {}, err
+	}
+	cleanup := func() { os.RemoveAll(dir) }
+
+	data := filepath.Join(dir, "data")
+	if out, err := exec.Command(filepath.Join(bin, "initdb"), "-D", data, "-U", "postgres", "--auth=trust", "--locale=C", "-E", "UTF8").CombinedOutput(); err != nil {
+		cleanup()
+		return func() {}, fmt.Errorf("initdb: %v: %s", err, out)
+	}
+
+	// listen on a unix socket in the temporary directory only
+	ctl := filepath.Join(bin, "pg_ctl")
+	if out, err := exec.Command(ctl, "-D", data, "-l", filepath.Join(dir, "log"), "-w", "-o", "-k "+dir+" -c listen_addresses=''", "start").CombinedOutput(); err != nil {
+		cleanup()
+		return func() {}, fmt.Errorf("pg_ctl: %v: %s", err, out)
+	}
+
+	testServer.dsn = "host=" + dir + " user=postgres sslmode=disable"
+	return func() {
+		exec.Command(ctl, "-D", data, "-m", "immediate", "-w", "stop").Run()
+		cleanup()
+	}, nil
+}
+
+// postgresBin returns the directory of the postgres server binaries.
+func postgresBin() (string, error) {
+	if path, err := exec.LookPath("initdb"); err == nil {
+		return filepath.Dir(path), nil
+	}
+
+	if out, err := exec.Command("pg_config", "--bindir").Output(); err == nil {
+		return strings.TrimSpace(string(out)), nil
+	}
+
+	if matches, _ := filepath.Glob("/usr/lib/postgresql/*/bin/initdb"); len(matches) > 0 {
+		return filepath.Dir(matches[len(matches)-1]), nil
+	}
+
+	return "", fmt.Errorf("initdb not found")
+}
+
+// startMySQL starts a temporary mysqld or mariadbd unless SCHEMALESSQL_MYSQL_DSN is set.
+func startMySQL() (func(), error) {
+	if dsn := os.Getenv("SCHEMALESSQL_MYSQL_DSN"); dsn != "" {
+		testServer.dsn = dsn
+		return func() {}, nil
+	}
+
+	var server string
+	for _, name := range []string{"mariadbd", "mysqld"} {
+		if path, err := exec.LookPath(name); err == nil {
+			server = path
+			break
+		}
+	}
+
+	if server == "" {
+		return func() {}, fmt.Errorf("mysqld not found")
+	}
+
+	dir, err := os.MkdirTemp("", "mysql")
+	if err != nil {
+		return func() {}, err
+	}
+	cleanup := func() { os.RemoveAll(dir) }
+
+	data := filepath.Join(dir, "data")
+	socket := filepath.Join(dir, "mysql.sock")
+	var user []string
+	if os.Geteuid() == 0 {
+		user = []string{"--user=root"}
+	}
+
+	args := append([]string{"--no-defaults", "--datadir=" + data, "--socket=" + socket, "--pid-file=" + filepath.Join(dir, "mysql.pid"), "--skip-networking"}, user...)
+
+	// mariadb is initialized by mysql_install_db, mysql by mysqld itself
+	var install *exec.Cmd
+	if path, err := exec.LookPath("mysql_install_db"); err == nil {
+		install = exec.Command(path, append([]string{"--no-defaults", "--datadir=" + data, "--auth-root-authentication-method=normal"}, user...)...)
+	} else {
+		install = exec.Command(server, append(args, "--initialize-insecure")...)
+	}
+
+	if out, err := install.CombinedOutput(); err != nil {
+		cleanup()
+		return func() {}, fmt.Errorf("%v: %v: %s", install.Path, err, out)
+	}
+
+	cmd := exec.Command(server, args...)
+	if err := cmd.Start(); err != nil {
+		cleanup()
+		return func() {}, err
+	}
+
+	stop := func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+		cleanup()
+	}
+
+	testServer.dsn = "root@unix(" + socket + ")/"
+
+	// wait until the server accepts connections
+	db, err := sql.Open("mysql", testServer.dsn)
+	if err != nil {
+		stop()
+		return func() {}, err
+	}
+	defer db.Close()
+
+	for i := 0; ; i++ {
+		if err = db.Ping(); err == nil {
+			return stop, nil
+		}
+
+		if i == 100 {
+			stop()
+			return func() {}, fmt.Errorf("mysqld did not start: %v", err)
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestDialect(t *testing.T) {
+	if _, err := schemalessql.Open("unknown", ""); err == nil {
+		t.Fatalf("should receive error for driver without dialect")
+	}
+
+	driver, dsn := testDSN(t)
+	db, err := schemalessql.Open(driver, dsn)
+	if err != nil {
+		t.Fatalf("error connecting to database: %v", err)
+	}
+	defer closeDB(t, db)
+
+	if db.Dialect() != dialects[driver] {
+		t.Fatalf("wrong dialect of driver %v: %v", driver, db.Dialect())
+	}
+
+	for table, expected := range map[string][]string{"schema": {"field", "kind", "options", "type"}, "missing": nil} {
+		rows, err := db.Query(db.Dialect().Rebind(db.Dialect().Columns()), table)
+		if err != nil {
+			t.Fatalf("error reading columns of %v: %v", table, err)
+		}
+
+		var columns []string
+		for rows.Next() {
+			var column string
+			if err := rows.Scan(&column); err != nil {
+				t.Fatalf("error reading columns of %v: %v", table, err)
+			}
+			columns = append(columns, column)
+		}
+		rows.Close()
+
+		sort.Strings(columns)
+		if !reflect.DeepEqual(columns, expected) {
+			t.Fatalf("wrong columns of %v: %v", table, columns)
+		}
+	}
+
+	// dialect of an unknown driver
+	if _, err := schemalessql.Open("unknown", "", schemalessql.WithDialect(schemalessql.SQLite)); err == nil || strings.Contains(err.Error(), "dialect") {
+		t.Fatalf("should receive error of the unknown driver but got: %v", err)
+	}
+}
+
+func TestDialectRebind(t *testing.T) {
+	if q := schemalessql.Postgres.Rebind(`SELECT a FROM t WHERE b=? AND c IN (?, ?)`); q != `SELECT a FROM t WHERE b=$1 AND c IN ($2, $3)` {
+		t.Fatalf("wrong placeholders: %v", q)
+	}
+
+	if q := schemalessql.SQLite.Rebind(`SELECT a FROM t WHERE b=?`); q != `SELECT a FROM t WHERE b=?` {
+		t.Fatalf("wrong placeholders: %v", q)
+	}
+}
+
+func TestDialectRetryable(t *testing.T) {
+	wrap := func(err error) error {
+		return fmt.Errorf("schemalessql: could not commit transaction: %w", err)
+	}
+
+	tests := []struct {
+		dialect   schemalessql.Dialect
+		err       error
+		retryable bool
+	}{
+		{schemalessql.SQLite, wrap(sqlite3.Error{Code: sqlite3.ErrBusy}), true},
+		{schemalessql.SQLite, wrap(sqlite3.Error{Code: sqlite3.ErrLocked}), true},
+		{schemalessql.SQLite, wrap(sqlite3.Error{Code: sqlite3.ErrConstraint}), false},
+		{schemalessql.SQLite, errors.New("database is busy"), false},
+		{schemalessql.Postgres, wrap(&pq.Error{Code: "40001"}), true},
+		{schemalessql.Postgres, wrap(&pq.Error{Code: "40P01"}), true},
+		{schemalessql.Postgres, wrap(&pq.Error{Code: "23505"}), false},
+		{schemalessql.Postgres, errors.New("could not serialize access"), false},
+		{schemalessql.MySQL, wrap(&mysql.MySQLError{Number: 1213}), true},
+		{schemalessql.MySQL, wrap(&mysql.MySQLError{Number: 1205}), true},
+		{schemalessql.MySQL, wrap(&mysql.MySQLError{Number: 1062}), false},
+		{schemalessql.MySQL, errors.New("Error 1213: Deadlock found"), false},
+		{schemalessql.MySQL, nil, false},
+	}
+
+	for _, test := range tests {
+		if retryable := test.dialect.IsRetryable(test.err); retryable != test.retryable {
+			t.Fatalf("wrong classification of error %v: %v", test.err, retryable)
+		}
+	}
+}
+
+func TestDialectMySQL(t *testing.T) {
+	stmts := schemalessql.MySQL.CreateTable(schemalessql.Table{
+		Name: "index_Entity_E",
+		Columns: []schemalessql.Column{
+			{Name: "entitiy_id", Type: "INTEGER", Constraints: "NOT NULL UNIQUE"},
+			{Name: "value", Type: "TEXT"},
+		},
+		Indexes: []schemalessql.Index{
+			{Name: "index_Entity_E_value_id_index", Columns: []string{"value", "entitiy_id"}},
+		},
+	})
+
+	expected := "CREATE TABLE IF NOT EXISTS `index_Entity_E` (entitiy_id BIGINT NOT NULL UNIQUE, value TEXT CHARACTER SET utf8mb4 COLLATE utf8mb4_bin, " +
+		"INDEX `index_Entity_E_value_id_index` (value(255), entitiy_id)) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4"
+	if len(stmts) != 1 || stmts[0] != expected {
+		t.Fatalf("wrong create table statements: %v", stmts)
+	}
+
+	if q := schemalessql.MySQL.Upsert("t", "a", "b"); q != "INSERT INTO `t` (a, b) VALUES (?, ?) ON DUPLICATE KEY UPDATE b=VALUES(b)" {
+		t.Fatalf("wrong upsert statement: %v", q)
+	}
+
+	// keys are not shortened to a prefix
+	stmts = schemalessql.MySQL.CreateTable(schemalessql.Table{
+		Name: "names",
+		Columns: []schemalessql.Column{
+			{Name: "kind", Type: "TEXT", Constraints: "NOT NULL"},
+			{Name: "name", Type: "TEXT", Constraints: "NOT NULL"},
+			{Name: "entity_id", Type: "INTEGER", Constraints: "NOT NULL"},
+		},
+		PrimaryKey: []string{"kind", "name"},
+		Indexes: []schemalessql.Index{
+			{Name: "name_index", Columns: []string{"name"}},
+		},
+	})
+
+	expected = "CREATE TABLE IF NOT EXISTS `names` (kind VARCHAR(384) CHARACTER SET utf8mb4 COLLATE utf8mb4_bin NOT NULL, " +
+		"name VARCHAR(384) CHARACTER SET utf8mb4 COLLATE utf8mb4_bin NOT NULL, entity_id BIGINT NOT NULL, " +
+		"PRIMARY KEY (kind, name), INDEX `name_index` (name)) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4"
+	if len(stmts) != 1 || stmts[0] != expected {
+		t.Fatalf("wrong create table statements: %v", stmts)
+	}
+
+	// names are limited to 64 characters
+	long := "index_" + strings.Repeat("Kind", 10) + "_" + strings.Repeat("Field", 10)
+	a, b := schemalessql.MySQL.Quote(long+"_id_value_index"), schemalessql.MySQL.Quote(long+"_value_id_index")
+	if len(a) != 64+2 || len(b) != 64+2 || a == b || !strings.HasPrefix(a, "`"+long[:40]) {
+		t.Fatalf("wrong long names: %v %v", a, b)
+	}
+
+	if q := schemalessql.MySQL.Quote(long[:64]); q != "`"+long[:64]+"`" {
+		t.Fatalf("wrong name: %v", q)
+	}
+}
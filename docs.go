@@ -6,6 +6,37 @@ Example:
 	db := schemalessql.Open("sqlite3", "./foo.db")
 	defer db.Close()
 
+	// the SQL dialect is chosen by the driver name, or set explicitly
+	db := schemalessql.Open("postgres", "dbname=foo sslmode=disable")
+	db := schemalessql.Open("mysql", "user:password@tcp(localhost)/foo?parseTime=true")
+	db := schemalessql.Open("pgx", dsn, schemalessql.WithDialect(schemalessql.Postgres))
+
+	// entities are encoded with gob unless another codec is set, for all or for single kinds
+	db := schemalessql.Open("sqlite3", "./foo.db", schemalessql.WithCodec(schemalessql.JSON), schemalessql.WithKindCodec("Entity", schemalessql.MsgPack))
+
+	// encoded entities of at least 1 KiB are compressed
+	db := schemalessql.Open("sqlite3", "./foo.db", schemalessql.WithCompression(1024))
+
+	// fields tagged with `datastore:",encrypt"` are encrypted with AES-GCM, their keyed hashes are indexed for equality filters
+	keys := schemalessql.NewKeyRing(hashKey)
+	keys.Add("2024", key)
+	db := schemalessql.Open("sqlite3", "./foo.db", schemalessql.WithKeyProvider(keys))
+
+	type Patient struct {
+		Name  string
+		SSN   string `datastore:",encrypt"`
+		Notes string `datastore:",encrypt,noindex"`
+	}
+
+	keys, err := db.FindKeys("Patient", map[string]interface{}{"SSN": "123-45-6789"})
+
+	// entire entities are encrypted with random data keys, which are encrypted with the current key of the provider
+	db := schemalessql.Open("sqlite3", "./foo.db", schemalessql.WithEncryption(keys))
+
+	// after adding a new key, existing entities are rewritten to use it
+	keys.Add("2025", newKey)
+	n, err := db.Reencrypt(ctx)
+
 	type Entity struct {
 		Value      string
 		Changed    time.Time
@@ -33,6 +64,32 @@ Example:
 	var r Entity
 	err := db.Get(key, &r)
 
+	// application-defined keys, created unless they exist and updated otherwise
+	key, err := db.Put(schemalessql.NewKey("User", "alice@example.com"), u)
+	key, err := db.Put(schemalessql.IDKey("Entity", id), e)
+
+	// keys are encoded for URLs, JSON and other SQL tables, and can be fields of entities
+	s := key.Encode()
+	key, err := schemalessql.DecodeKey(s)
+
+	type Task struct {
+		Title string
+		Owner *schemalessql.Key
+	}
+
+	keys, err := db.FindAllKeys(db.NewQuery("Task").Filter("Owner =", owner))
+
+	// hierarchies of entities, the parent must exist when a child is created
+	org, err := db.Put(schemalessql.NewKey("Organisation", "acme"), o)
+	project, err := db.Put(schemalessql.IDKey("Project", 0).WithParent(org), p)
+	task, err := db.Put(schemalessql.IDKey("Task", 0).WithParent(project), t)
+
+	// all tasks of all projects of the organisation
+	keys, err := db.FindAllKeys(db.NewQuery("Task").Ancestor(org))
+
+	// delete the project and all of its tasks
+	err := db.DeleteCascade(project)
+
 	// delete
 	err := db.Delete(key)
 
@@ -41,22 +98,83 @@ Example:
 		Entity{"A", time.Now()},
 		Entity{"B", time.Now()},
 	}
-	keys, err := db.PutMulti(nil, entities, true)
+	keys, err := db.PutMulti(nil, entities, schemalessql.Atomic)
 
 	results := make([]Entity, len(keys))
-	err := db.GetMulti(keys, results, true)
+	err := db.GetMulti(keys, results, schemalessql.Atomic)
 
-	err := db.DeleteMulti(keys, true)
+	err := db.DeleteMulti(keys, schemalessql.Atomic)
 
 	// query
 	query := map[string]interface{}{
 		"A": 123,
 		"C": true,
 	}
-	results, err := db.Find(query, Entity{})
+	var results []Entity
+	keys, err := db.Find(query, &results)
 
 	var r Entity
 	err := db.FindOne(query, &r)
 
+	// query builder
+	q := db.NewQuery("Entity").Filter("A >", 10).Filter("C =", true).Order("-F").Limit(20).Offset(40)
+	keys, err := db.FindAllKeys(q)
+
+	var results []*Entity
+	keys, err := db.FindAll(q, &results)
+
+	// entities encoded by the JSON codec are stored as documents, which can be filtered by paths without index tables
+	q := db.NewQuery("Person").Filter("Address.City =", "Berlin").Filter("$.Notes prefix", "likes")
+
+	// pagination
+	keys, cursor, err := db.FindPage(q)
+	next := cursor.String()
+
+	cursor, err := schemalessql.DecodeCursor(next)
+	keys, cursor, err := db.FindPage(q.Start(cursor))
+
+	// streaming
+	it := db.Run(q)
+	defer it.Close()
+	for {
+		var e Entity
+		key, err := it.Next(&e)
+		if err == schemalessql.Done {
+			break
+		}
+	}
+
+	// every operation has a variant using a context
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	key, err := db.PutContext(ctx, nil, e)
+
+	// transactions
+	err := db.RunInTransaction(ctx, func(tx *schemalessql.Tx) error {
+		var e Entity
+		if err := tx.Get(key, &e); err != nil {
+			return err
+		}
+		e.Data += "!"
+		_, err := tx.Put(key, &e)
+		return err
+	})
+
+	// optimistic concurrency
+	key, err := db.PutIfVersion(key, e, 1)
+	if errors.Is(err, schemalessql.ErrConflict) {
+		// modified concurrently
+	}
+
+	// in-memory store for tests, without cgo or a database
+	var store schemalessql.Store = schemalessql.NewMemoryStore()
+	key, err := store.Put(nil, e)
+
+	// typed collections
+	entities := schemalessql.NewCollection[Entity](db)
+	key, err := entities.Put(ctx, nil, &Entity{"data", time.Now()})
+	e, err := entities.Get(ctx, key)
+	results, keys, err := entities.FindAll(ctx, entities.NewQuery().Order("-Changed"))
+
 */
 package schemalessql
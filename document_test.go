@@ -0,0 +1,137 @@
+package schemalessql_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/der-antikeks/schemalessql"
+)
+
+type Address struct {
+	Street string
+	City   string
+	Zip    int
+}
+
+type Person struct {
+	Name    string
+	Age     int
+	Member  bool
+	Address Address  `datastore:"noindex"`
+	Tags    []string `datastore:"noindex"`
+	Notes   string   `datastore:"noindex"`
+}
+
+var people = []Person{
+	{"alice", 31, true, Address{"Main Street 1", "Berlin", 10115}, []string{"a"}, "likes tea"},
+	{"bob", 25, false, Address{"Side Street 2", "Hamburg", 20095}, nil, "likes coffee"},
+	{"carol", 42, true, Address{"Main Street 3", "Berlin", 10117}, []string{"b", "c"}, ""},
+	{"dave", 19, false, Address{"", "Munich", 80331}, nil, "likes tea and coffee"},
+}
+
+func TestDocumentFilters(t *testing.T) {
+	driver, dsn := testDSN(t)
+	db, err := schemalessql.Open(driver, dsn, schemalessql.WithKindCodec("Person", schemalessql.JSON))
+	if err != nil {
+		t.Fatalf("error connecting to database: %v", err)
+	}
+	defer closeDB(t, db)
+
+	for _, store := range []schemalessql.Store{db, schemalessql.NewMemoryStore(schemalessql.WithKindCodec("Person", schemalessql.JSON))} {
+		keys, err := store.PutMulti(nil, people, schemalessql.Atomic)
+		if err != nil {
+			t.Fatalf("error creating entities: %v", err)
+		}
+
+		tests := []struct {
+			q        *schemalessql.Query
+			expected []int
+		}{
+			{store.NewQuery("Person").Filter("Address.City =", "Berlin"), []int{0, 2}},
+			{store.NewQuery("Person").Filter("Address.City !=", "Berlin"), []int{1, 3}},
+			{store.NewQuery("Person").Filter("Address.Zip >=", 20095), []int{1, 3}},
+			{store.NewQuery("Person").Filter("Address.Zip between", []int{10000, 10116}), []int{0}},
+			{store.NewQuery("Person").Filter("Address.City in", []string{"Hamburg", "Munich"}).Filter("Age <", 20), []int{3}},
+			{store.NewQuery("Person").Filter("Address.Street prefix", "Main"), []int{0, 2}},
+			{store.NewQuery("Person").Filter("$.Notes prefix", "likes tea"), []int{0, 3}},
+			{store.NewQuery("Person").Filter("$.Member =", true).Order("-Age"), []int{2, 0}},
+			{store.NewQuery("Person").Filter("Address.Country =", "Germany"), nil},
+			{store.NewQuery("Person").Filter("Address.City =", "Berlin").Filter("Name =", "carol"), []int{2}},
+		}
+
+		for i, test := range tests {
+			var expected []*schemalessql.Key
+			for _, j := range test.expected {
+				expected = append(expected, keys[j])
+			}
+
+			var found []Person
+			fkeys, err := store.FindAll(test.q, &found)
+			if err != nil || !reflect.DeepEqual(fkeys, expected) {
+				t.Fatalf("query %v should find %v but found %v: %v", i, expected, fkeys, err)
+			}
+
+			for j, p := range found {
+				if !reflect.DeepEqual(p, people[test.expected[j]]) {
+					t.Fatalf("error decoding entity %v", p)
+				}
+			}
+		}
+
+		if _, err := store.FindAllKeys(store.NewQuery("Person").Filter("Address..City =", "Berlin")); err == nil {
+			t.Fatalf("should receive error for invalid path")
+		}
+
+		if _, err := store.FindAllKeys(store.NewQuery("Person").Order("Address.City")); err == nil {
+			t.Fatalf("should receive error for ordering by a path")
+		}
+	}
+}
+
+func TestDocumentCodecs(t *testing.T) {
+	driver, dsn := testDSN(t)
+	db, err := schemalessql.Open(driver, dsn)
+	if err != nil {
+		t.Fatalf("error connecting to database: %v", err)
+	}
+
+	if _, err := db.Put(nil, people[0]); err != nil {
+		t.Fatalf("error creating entity: %v", err)
+	}
+	closeDB(t, db)
+
+	db, err = schemalessql.Open(driver, dsn, schemalessql.WithCodec(schemalessql.JSON))
+	if err != nil {
+		t.Fatalf("error connecting to database: %v", err)
+	}
+	defer closeDB(t, db)
+
+	key, err := db.Put(nil, people[2])
+	if err != nil {
+		t.Fatalf("error creating entity: %v", err)
+	}
+
+	// only entities encoded by the JSON codec are documents
+	if found, err := db.FindAllKeys(db.NewQuery("Person").Filter("Address.City =", "Berlin")); err != nil || len(found) != 1 || *found[0] != *key {
+		t.Fatalf("should find only the document %v but found %v: %v", key, found, err)
+	}
+
+	var document string
+	if err := db.QueryRow(db.Dialect().Rebind(`SELECT document FROM entities WHERE codec=?`), "json").Scan(&document); err != nil || document == "" {
+		t.Fatalf("error reading document %q: %v", document, err)
+	}
+
+	var p Person
+	if err := db.Get(key, &p); err != nil || !reflect.DeepEqual(p, people[2]) {
+		t.Fatalf("error reading entity %v: %v", p, err)
+	}
+
+	p.Address.City = "Hamburg"
+	if _, err := db.Put(key, p); err != nil {
+		t.Fatalf("error updating entity: %v", err)
+	}
+
+	if found, err := db.FindAllKeys(db.NewQuery("Person").Filter("Address.City =", "Hamburg")); err != nil || len(found) != 1 {
+		t.Fatalf("should find the updated document but found %v: %v", found, err)
+	}
+}
@@ -0,0 +1,602 @@
+package schemalessql
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"sync"
+)
+
+// KeyProvider provides the AES keys of encrypted fields, tagged with `datastore:",encrypt"`.
+// Keys are rotated by providing a new current key, values encrypted with previous keys remain readable as long as Key returns them.
+type KeyProvider interface {
+	// CurrentKey returns the id and the key that values are encrypted with.
+	CurrentKey() (id string, key []byte, err error)
+
+	// Key returns the key with the id, which values have been encrypted with.
+	Key(id string) ([]byte, error)
+
+	// HashKey returns the key of the hashes that index encrypted fields for equality filters.
+	// It must not be rotated, the indices of previously saved entities would no longer match.
+	HashKey() ([]byte, error)
+}
+
+// WithKeyProvider sets the provider of the keys of encrypted fields.
+func WithKeyProvider(p KeyProvider) Option {
+	return func(o *options) {
+		o.keys = p
+	}
+}
+
+// KeyRing is a KeyProvider that keeps the keys in memory, the last added key is the current key.
+type KeyRing struct {
+	mu      sync.RWMutex
+	keys    map[string][]byte
+	current string
+	hashKey []byte
+}
+
+// NewKeyRing returns a KeyRing with the hash key and without any AES key.
+func NewKeyRing(hashKey []byte) *KeyRing {
+	return &KeyRing{keys: make(map[string][]byte), hashKey: hashKey}
+}
+
+// Add adds the AES key of 16, 24 or 32 bytes with the id, which must not be longer than 255 bytes, and makes it the current key.
+func (r *KeyRing) Add(id string, key []byte) error {
+	if len(id) > 255 {
+		return fmt.Errorf("schemalessql: key id %q is too long", id)
+	}
+
+	if _, err := aes.NewCipher(key); err != nil {
+		return fmt.Errorf("schemalessql: invalid key %v: %w", id, err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.keys[id] = key
+	r.current = id
+	return nil
+}
+
+func (r *KeyRing) CurrentKey() (string, []byte, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	key, found := r.keys[r.current]
+	if !found {
+		return "", nil, errors.New("schemalessql: no current key")
+	}
+
+	return r.current, key, nil
+}
+
+func (r *KeyRing) Key(id string) ([]byte, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	key, found := r.keys[id]
+	if !found {
+		return nil, fmt.Errorf("schemalessql: unknown key %v", id)
+	}
+
+	return key, nil
+}
+
+func (r *KeyRing) HashKey() ([]byte, error) {
+	if len(r.hashKey) == 0 {
+		return nil, errors.New("schemalessql: no hash key")
+	}
+
+	return r.hashKey, nil
+}
+
+// seal encrypts the plaintext with the current key, the result consists of
+// the length of the key id, the key id, the nonce and the sealed plaintext.
+func seal(keys KeyProvider, plaintext, additional []byte) ([]byte, error) {
+	id, key, err := keys.CurrentKey()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(id) > 255 {
+		return nil, fmt.Errorf("key id %q is too long", id)
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	ciphertext := make([]byte, 1+len(id)+aead.NonceSize(), 1+len(id)+aead.NonceSize()+len(plaintext)+aead.Overhead())
+	ciphertext[0] = byte(len(id))
+	copy(ciphertext[1:], id)
+
+	nonce := ciphertext[1+len(id):]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(ciphertext, nonce, plaintext, additional), nil
+}
+
+// unseal decrypts the ciphertext of seal with the key it has been encrypted with.
+func unseal(keys KeyProvider, ciphertext, additional []byte) ([]byte, error) {
+	if len(ciphertext) < 1 || len(ciphertext) < 1+int(ciphertext[0]) {
+		return nil, errors.New("invalid ciphertext")
+	}
+
+	id := string(ciphertext[1 : 1+ciphertext[0]])
+	key, err := keys.Key(id)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	ciphertext = ciphertext[1+len(id):]
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, errors.New("invalid ciphertext")
+	}
+
+	return aead.Open(nil, ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():], additional)
+}
+
+// newAEAD returns AES-GCM with the key.
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// fieldData returns the additional data that binds encrypted values and hashes to the field of the kind.
+func fieldData(kind, fieldname string) []byte {
+	return []byte(kind + "." + fieldname)
+}
+
+// plaintext returns the bytes of a string or []byte value.
+func plaintext(v reflect.Value) ([]byte, bool) {
+	switch {
+	case v.Kind() == reflect.String:
+		return []byte(v.String()), true
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8:
+		return v.Bytes(), true
+	}
+
+	return nil, false
+}
+
+// encryptable reports whether values of the type can be encrypted.
+func encryptable(t reflect.Type) bool {
+	_, ok := plaintext(reflect.Zero(t))
+	return ok
+}
+
+// hashValue returns the keyed hash of a string or []byte value of the field, which is stored in its index table instead of the value.
+func (d *datastore) hashValue(kind, fieldname string, value interface{}) ([]byte, error) {
+	p, ok := plaintext(reflect.ValueOf(value))
+	if !ok {
+		return nil, fmt.Errorf("schemalessql: value of encrypted field %v of kind %v must be a string or []byte, not %T", fieldname, kind, value)
+	}
+
+	key, err := d.keys.HashKey()
+	if err != nil {
+		return nil, fmt.Errorf("schemalessql: could not hash field %v of kind %v: %w", fieldname, kind, err)
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(fieldData(kind, fieldname))
+	mac.Write([]byte{0})
+	mac.Write(p)
+	return mac.Sum(nil), nil
+}
+
+// encryptFields returns a copy of the entity whose encrypted fields have been replaced by their ciphertexts,
+// or the entity itself if the kind has no encrypted fields. Strings are replaced by the base64 encoding of their ciphertexts.
+func (d *datastore) encryptFields(kind string, src interface{}) (interface{}, error) {
+	d.structure.RLock()
+	codec := d.structure.codec[kind]
+	d.structure.RUnlock()
+
+	v := reflect.ValueOf(src)
+	ptr := v.Kind() == reflect.Ptr
+	var c reflect.Value
+
+	for fieldname, field := range codec {
+		if !field.encrypt {
+			continue
+		}
+
+		if !c.IsValid() {
+			c = reflect.New(reflect.Indirect(v).Type()).Elem()
+			c.Set(reflect.Indirect(v))
+		}
+
+		f := c.FieldByName(fieldname)
+		if !f.IsValid() {
+			// field of another struct type of the same kind
+			continue
+		}
+
+		if f.Kind() == reflect.Slice && f.IsNil() {
+			continue
+		}
+
+		p, _ := plaintext(f)
+		ciphertext, err := seal(d.keys, p, fieldData(kind, fieldname))
+		if err != nil {
+			return nil, fmt.Errorf("schemalessql: could not encrypt field %v of kind %v: %w", fieldname, kind, err)
+		}
+
+		if f.Kind() == reflect.String {
+			f.SetString(base64.StdEncoding.EncodeToString(ciphertext))
+		} else {
+			f.SetBytes(ciphertext)
+		}
+	}
+
+	if !c.IsValid() {
+		return src, nil
+	}
+
+	if ptr {
+		return c.Addr().Interface(), nil
+	}
+
+	return c.Interface(), nil
+}
+
+// decryptFields replaces the ciphertexts of the encrypted fields of the decoded entity by their plaintexts.
+func (d *datastore) decryptFields(kind string, dst interface{}) error {
+	d.structure.RLock()
+	codec := d.structure.codec[kind]
+	d.structure.RUnlock()
+
+	v := reflect.Indirect(reflect.ValueOf(dst))
+	for fieldname, field := range codec {
+		if !field.encrypt {
+			continue
+		}
+
+		f := v.FieldByName(fieldname)
+		if !f.IsValid() || (f.Kind() == reflect.Slice && f.IsNil()) {
+			continue
+		}
+
+		ciphertext, _ := plaintext(f)
+		if f.Kind() == reflect.String {
+			var err error
+			if ciphertext, err = base64.StdEncoding.DecodeString(f.String()); err != nil {
+				return fmt.Errorf("schemalessql: could not decrypt field %v of kind %v: %w", fieldname, kind, err)
+			}
+		}
+
+		p, err := unseal(d.keys, ciphertext, fieldData(kind, fieldname))
+		if err != nil {
+			return fmt.Errorf("schemalessql: could not decrypt field %v of kind %v: %w", fieldname, kind, err)
+		}
+
+		if f.Kind() == reflect.String {
+			f.SetString(string(p))
+		} else {
+			f.SetBytes(p)
+		}
+	}
+
+	return nil
+}
+
+// hashFilters returns a copy of the validated query whose filters on encrypted fields compare the hashes of their values.
+func (d *datastore) hashFilters(q *Query, codec map[string]fieldCodec) (*Query, error) {
+	var hashed *Query
+	for i, f := range q.filters {
+		if f.path != nil || !codec[f.field].encrypt {
+			continue
+		}
+
+		if hashed == nil {
+			hashed = q.clone()
+		}
+
+		if values, ok := f.value.([]interface{}); ok {
+			hashes := make([]interface{}, len(values))
+			for j, value := range values {
+				hash, err := d.hashValue(q.kind, f.field, value)
+				if err != nil {
+					return nil, err
+				}
+				hashes[j] = hash
+			}
+			hashed.filters[i].value = hashes
+			continue
+		}
+
+		hash, err := d.hashValue(q.kind, f.field, f.value)
+		if err != nil {
+			return nil, err
+		}
+		hashed.filters[i].value = hash
+	}
+
+	if hashed == nil {
+		return q, nil
+	}
+
+	return hashed, nil
+}
+
+// WithEncryption encrypts the encoded entities with an envelope scheme: every entity is encrypted with a random data key,
+// which is encrypted with the current key of the provider. The id of this key is stored with the entity,
+// so that keys can be rotated gradually and entities remain readable as long as the provider returns their keys.
+// The encrypted data is bound to the kind and the id of its entity and can not be moved to another entity.
+// Entities encoded by the JSON codec are encrypted as well and are no longer stored as documents.
+func WithEncryption(p KeyProvider) Option {
+	return func(o *options) {
+		o.encryption = p
+	}
+}
+
+// size of the random data keys of the envelope encryption
+const dataKeySize = 32
+
+// entityData returns the additional data that binds the encrypted data to the entity of the kind with the id,
+// so that the data of entities cannot be swapped.
+func entityData(kind string, id int64) []byte {
+	return []byte(kind + "/" + strconv.FormatInt(id, 10))
+}
+
+// encrypt encrypts the data of the entity of the kind with the id with a new data key and returns the id of the key that encrypted the data key,
+// or the data itself and an empty key id if encryption is disabled.
+// The result consists of the length of the encrypted data key as 2 bytes, the encrypted data key, the nonce and the sealed data.
+func (d *datastore) encrypt(kind string, id int64, data []byte) ([]byte, string, error) {
+	if d.encryption == nil {
+		return data, "", nil
+	}
+
+	dataKey := make([]byte, dataKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, "", err
+	}
+
+	sealed, err := sealData(dataKey, kind, id, data)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return d.envelope(dataKey, sealed)
+}
+
+// sealData encrypts the data of the entity of the kind with the id with the data key and returns the nonce and the sealed data.
+func sealData(dataKey []byte, kind string, id int64, data []byte) ([]byte, error) {
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return append(nonce, aead.Seal(nil, nonce, data, entityData(kind, id))...), nil
+}
+
+// insert inserts the row with the data, which is encrypted for the id of the row.
+// Generated ids are only known after the insert, the row is inserted with the encrypted data key only
+// and its data is sealed and rewritten afterwards.
+func (d *datastore) insert(s *session, row entityRow, data []byte) (int64, error) {
+	if d.encryption == nil || row.id != 0 {
+		var err error
+		if row.data, row.keyID, err = d.encrypt(row.kind, row.id, data); err != nil {
+			return 0, fmt.Errorf("schemalessql: could not encrypt entity: %w", err)
+		}
+
+		id, err := s.insert(row)
+		if err != nil {
+			return 0, fmt.Errorf("schemalessql: could not insert data into db: %w", err)
+		}
+
+		return id, nil
+	}
+
+	dataKey := make([]byte, dataKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return 0, fmt.Errorf("schemalessql: could not encrypt entity: %w", err)
+	}
+
+	envelope, keyID, err := d.envelope(dataKey, nil)
+	if err != nil {
+		return 0, fmt.Errorf("schemalessql: could not encrypt entity: %w", err)
+	}
+
+	row.data, row.keyID = envelope, keyID
+	id, err := s.insert(row)
+	if err != nil {
+		return 0, fmt.Errorf("schemalessql: could not insert data into db: %w", err)
+	}
+
+	sealed, err := sealData(dataKey, row.kind, id, data)
+	if err != nil {
+		return 0, fmt.Errorf("schemalessql: could not encrypt entity: %w", err)
+	}
+
+	row.id, row.version, row.data = id, 1, append(envelope, sealed...)
+	if _, err := s.rewrite(row); err != nil {
+		return 0, fmt.Errorf("schemalessql: could not insert data into db: %w", err)
+	}
+
+	return id, nil
+}
+
+// envelope encrypts the data key with the current key and prepends it to the sealed data.
+func (d *datastore) envelope(dataKey, sealed []byte) ([]byte, string, error) {
+	encryptedKey, err := seal(d.encryption, dataKey, nil)
+	if err != nil {
+		return nil, "", err
+	}
+
+	result := make([]byte, 2, 2+len(encryptedKey)+len(sealed))
+	binary.BigEndian.PutUint16(result, uint16(len(encryptedKey)))
+	result = append(append(result, encryptedKey...), sealed...)
+	return result, string(encryptedKey[1 : 1+encryptedKey[0]]), nil
+}
+
+// openEnvelope decrypts the data key of the encrypted data and returns it with the sealed data.
+func (d *datastore) openEnvelope(data []byte) ([]byte, []byte, error) {
+	if d.encryption == nil {
+		return nil, nil, errors.New("entity is encrypted, but encryption is not enabled")
+	}
+
+	if len(data) < 2 || len(data) < 2+int(binary.BigEndian.Uint16(data)) {
+		return nil, nil, errors.New("invalid ciphertext")
+	}
+
+	n := 2 + int(binary.BigEndian.Uint16(data))
+	dataKey, err := unseal(d.encryption, data[2:n], nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return dataKey, data[n:], nil
+}
+
+// decrypt reverses the encryption of the data of the row.
+func (d *datastore) decrypt(row entityRow) ([]byte, error) {
+	if row.keyID == "" {
+		return row.data, nil
+	}
+
+	dataKey, sealed, err := d.openEnvelope(row.data)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("invalid ciphertext")
+	}
+
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], entityData(row.kind, row.id))
+}
+
+// reencrypt returns the data of the row with its data key encrypted by the current key, the data itself is not decrypted.
+// The data of unencrypted rows is encrypted.
+func (d *datastore) reencrypt(row entityRow) ([]byte, string, error) {
+	if row.keyID == "" {
+		return d.encrypt(row.kind, row.id, row.data)
+	}
+
+	dataKey, sealed, err := d.openEnvelope(row.data)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return d.envelope(dataKey, sealed)
+}
+
+// number of entities reencrypted within a single transaction
+const reencryptBatch = 100
+
+// Reencrypt rewrites all entities that are not encrypted with the current key of the provider set by WithEncryption,
+// including entities saved before encryption has been enabled, and returns their number.
+// Only the data keys of encrypted entities are encrypted again, their keys, versions and indices remain unchanged.
+// Entities that are saved concurrently are not rewritten, they are encrypted with the current key by the save.
+func (d *datastore) Reencrypt(ctx context.Context) (int, error) {
+	if d.encryption == nil {
+		return 0, errors.New("schemalessql: encryption is not enabled")
+	}
+
+	current, _, err := d.encryption.CurrentKey()
+	if err != nil {
+		return 0, fmt.Errorf("schemalessql: could not reencrypt entities: %w", err)
+	}
+
+	var n int
+	var after int64
+	for {
+		ids, err := d.backend.reader(ctx).stale(current, after, reencryptBatch)
+		if err != nil {
+			return n, fmt.Errorf("schemalessql: could not query data from db: %w", err)
+		}
+
+		if len(ids) == 0 {
+			return n, nil
+		}
+
+		var rewritten int
+		err = d.retry(ctx, func() (err error) {
+			rewritten, err = d.reencryptBatch(ctx, current, ids)
+			return err
+		})
+		if err != nil {
+			return n, err
+		}
+
+		n += rewritten
+		after = ids[len(ids)-1]
+	}
+}
+
+// reencryptBatch reencrypts the entities within a single transaction, unless they have been deleted, saved or reencrypted concurrently.
+func (d *datastore) reencryptBatch(ctx context.Context, current string, ids []int64) (int, error) {
+	s, err := d.begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("schemalessql: could not insert data into db: %w", err)
+	}
+	defer s.rollback()
+
+	var n int
+	for _, id := range ids {
+		row, err := s.entity(id, true)
+		if err == sql.ErrNoRows {
+			continue
+		}
+
+		if err != nil {
+			return 0, fmt.Errorf("schemalessql: could not query data from db: %w", err)
+		}
+
+		if row.keyID == current {
+			continue
+		}
+
+		if row.data, row.keyID, err = d.reencrypt(row); err != nil {
+			return 0, fmt.Errorf("schemalessql: could not reencrypt entity %v: %w", id, err)
+		}
+
+		rewritten, err := s.rewrite(row)
+		if err != nil {
+			return 0, fmt.Errorf("schemalessql: could not insert data into db: %w", err)
+		}
+
+		if rewritten {
+			n++
+		}
+	}
+
+	if err := s.commit(); err != nil {
+		return 0, fmt.Errorf("schemalessql: could not insert data into db: %w", err)
+	}
+
+	return n, nil
+}
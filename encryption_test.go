@@ -0,0 +1,367 @@
+package schemalessql_test
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/der-antikeks/schemalessql"
+)
+
+type Patient struct {
+	Name  string
+	SSN   string `datastore:",encrypt"`
+	Notes []byte `datastore:"noindex,encrypt"`
+}
+
+type EntityEncryptedInt struct {
+	Data int `datastore:",encrypt"`
+}
+
+type EntityUnknownOption struct {
+	Data string `datastore:",compress"`
+}
+
+// newKeyRing returns a key ring with a key of each id.
+func newKeyRing(t *testing.T, ids ...string) *schemalessql.KeyRing {
+	keys := schemalessql.NewKeyRing([]byte("hash key"))
+	for _, id := range ids {
+		if err := keys.Add(id, bytes.Repeat([]byte(id[:1]), 32)); err != nil {
+			t.Fatalf("error adding key: %v", err)
+		}
+	}
+
+	return keys
+}
+
+func TestEncryptedFields(t *testing.T) {
+	driver, dsn := testDSN(t)
+	dbKeys := newKeyRing(t, "1")
+	db, err := schemalessql.Open(driver, dsn, schemalessql.WithKeyProvider(dbKeys))
+	if err != nil {
+		t.Fatalf("error connecting to database: %v", err)
+	}
+	defer closeDB(t, db)
+
+	memoryKeys := newKeyRing(t, "1")
+	memory := schemalessql.NewMemoryStore(schemalessql.WithKeyProvider(memoryKeys))
+
+	alice := Patient{"alice", "123-45-6789", []byte("allergic to secrets")}
+	bob := Patient{"bob", "987-65-4321", nil}
+
+	for store, keys := range map[schemalessql.Store]*schemalessql.KeyRing{db: dbKeys, memory: memoryKeys} {
+		akey, err := store.Put(nil, alice)
+		if err != nil {
+			t.Fatalf("error creating entity: %v", err)
+		}
+
+		// entities encrypted with the previous key remain readable
+		if err := keys.Add("2", bytes.Repeat([]byte("2"), 32)); err != nil {
+			t.Fatalf("error adding key: %v", err)
+		}
+
+		bkey, err := store.Put(nil, &bob)
+		if err != nil || bob.SSN != "987-65-4321" {
+			t.Fatalf("error creating entity %v: %v", bob, err)
+		}
+
+		var r Patient
+		if err := store.Get(akey, &r); err != nil || !reflect.DeepEqual(r, alice) {
+			t.Fatalf("error reading entity %v: %v", r, err)
+		}
+
+		if found, err := store.FindKeys("Patient", map[string]interface{}{"SSN": "987-65-4321"}); err != nil || len(found) != 1 || *found[0] != *bkey {
+			t.Fatalf("should find entity by encrypted field but found %v: %v", found, err)
+		}
+
+		var found []Patient
+		if _, err := store.FindAll(store.NewQuery("Patient").Filter("SSN in", []string{"123-45-6789", "000-00-0000"}), &found); err != nil || len(found) != 1 || !reflect.DeepEqual(found[0], alice) {
+			t.Fatalf("should find entity by encrypted field but found %v: %v", found, err)
+		}
+
+		if _, err := store.FindAllKeys(store.NewQuery("Patient").Filter("SSN >", "1")); err == nil {
+			t.Fatalf("should receive error for range filter on encrypted field")
+		}
+
+		if _, err := store.FindAllKeys(store.NewQuery("Patient").Order("SSN")); err == nil {
+			t.Fatalf("should receive error for ordering by encrypted field")
+		}
+
+		if _, err := store.FindAllKeys(store.NewQuery("Patient").Filter("Notes =", []byte("allergic to secrets"))); err == nil {
+			t.Fatalf("should receive error for filtering by unindexed encrypted field")
+		}
+	}
+
+	// neither the data nor the index contain the plain text
+	rows, err := db.Query(`SELECT data FROM entities UNION ALL SELECT value FROM ` + db.Dialect().Quote("index_Patient_SSN"))
+	if err != nil {
+		t.Fatalf("error reading data: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var data []byte
+		if err := rows.Scan(&data); err != nil {
+			t.Fatalf("error reading data: %v", err)
+		}
+
+		for _, plain := range []string{"123-45-6789", "987-65-4321", "allergic"} {
+			if bytes.Contains(data, []byte(plain)) {
+				t.Fatalf("data contains plain text %v", plain)
+			}
+		}
+	}
+
+	// without the first key only the second entity can be decrypted
+	other, err := schemalessql.Open(driver, dsn, schemalessql.WithKeyProvider(newKeyRing(t, "2")))
+	if err != nil {
+		t.Fatalf("error connecting to database: %v", err)
+	}
+	defer closeDB(t, other)
+
+	it := other.Run(other.NewQuery("Patient").Order("Name"))
+	defer it.Close()
+
+	var r Patient
+	if _, err := it.Next(&r); err == nil {
+		t.Fatalf("should receive error for entity encrypted with unknown key")
+	}
+
+	var b Patient
+	if _, err := it.Next(&b); err != nil || !reflect.DeepEqual(b, bob) {
+		t.Fatalf("error reading entity %v: %v", b, err)
+	}
+}
+
+func TestEncryptedFieldsErrors(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(t, db)
+
+	if err := db.Register(Patient{}); err == nil {
+		t.Fatalf("should receive error for encrypted field without key provider")
+	}
+
+	store := schemalessql.NewMemoryStore(schemalessql.WithKeyProvider(newKeyRing(t, "1")))
+	if err := store.Register(EntityEncryptedInt{}); err == nil {
+		t.Fatalf("should receive error for encrypted integer field")
+	}
+
+	if err := store.Register(EntityUnknownOption{}); err == nil {
+		t.Fatalf("should receive error for unknown tag option")
+	}
+
+	if err := store.Register(Patient{}); err != nil {
+		t.Fatalf("error registering entity: %v", err)
+	}
+
+	if _, err := store.FindAllKeys(store.NewQuery("Patient").Filter("SSN =", 123)); err == nil {
+		t.Fatalf("should receive error for integer value of encrypted field")
+	}
+}
+
+func TestEncryption(t *testing.T) {
+	driver, dsn := testDSN(t)
+	db, err := schemalessql.Open(driver, dsn)
+	if err != nil {
+		t.Fatalf("error connecting to database: %v", err)
+	}
+
+	plain, err := db.Put(nil, people[0])
+	if err != nil {
+		t.Fatalf("error creating entity: %v", err)
+	}
+
+	if _, err := db.Reencrypt(context.Background()); err == nil {
+		t.Fatalf("should receive error for reencryption without encryption")
+	}
+	closeDB(t, db)
+
+	dbKeys := newKeyRing(t, "1")
+	db, err = schemalessql.Open(driver, dsn, schemalessql.WithEncryption(dbKeys), schemalessql.WithKindCodec("Person", schemalessql.JSON))
+	if err != nil {
+		t.Fatalf("error connecting to database: %v", err)
+	}
+	defer closeDB(t, db)
+
+	memoryKeys := newKeyRing(t, "1")
+	memory := schemalessql.NewMemoryStore(schemalessql.WithEncryption(memoryKeys))
+	if _, err := memory.Put(nil, people[0]); err != nil {
+		t.Fatalf("error creating entity: %v", err)
+	}
+
+	tests := []struct {
+		store       schemalessql.Store
+		keys        *schemalessql.KeyRing
+		unencrypted int
+	}{
+		{db, dbKeys, 1},
+		{memory, memoryKeys, 0},
+	}
+
+	for _, test := range tests {
+		store, keys := test.store, test.keys
+		encrypted, err := store.Put(nil, people[1])
+		if err != nil {
+			t.Fatalf("error creating entity: %v", err)
+		}
+
+		// only entities saved before encryption has been enabled are rewritten
+		if n, err := store.Reencrypt(context.Background()); err != nil || n != test.unencrypted {
+			t.Fatalf("should reencrypt %v entities but reencrypted %v: %v", test.unencrypted, n, err)
+		}
+
+		if err := keys.Add("2", bytes.Repeat([]byte("2"), 32)); err != nil {
+			t.Fatalf("error adding key: %v", err)
+		}
+
+		if n, err := store.Reencrypt(context.Background()); err != nil || n != 2 {
+			t.Fatalf("should reencrypt 2 entities but reencrypted %v: %v", n, err)
+		}
+
+		if n, err := store.Reencrypt(context.Background()); err != nil || n != 0 {
+			t.Fatalf("should reencrypt no entities but reencrypted %v: %v", n, err)
+		}
+
+		// keys, versions and indices remain unchanged
+		var found []Person
+		fkeys, err := store.FindAll(store.NewQuery("Person").Filter("Age <", 30), &found)
+		if err != nil || len(fkeys) != 1 || *fkeys[0] != *encrypted || !reflect.DeepEqual(found[0], people[1]) {
+			t.Fatalf("should find entity %v but found %v: %v", encrypted, fkeys, err)
+		}
+	}
+
+	// neither the data nor the documents contain the plain text
+	rows, err := db.Query(`SELECT data, document, key_id FROM entities`)
+	if err != nil {
+		t.Fatalf("error reading data: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var data, document []byte
+		var keyID string
+		if err := rows.Scan(&data, &document, &keyID); err != nil {
+			t.Fatalf("error reading data: %v", err)
+		}
+
+		if bytes.Contains(data, []byte("Street")) || document != nil || keyID != "2" {
+			t.Fatalf("entity is not encrypted with the current key: %q %q %v", data, document, keyID)
+		}
+	}
+
+	// the first key is no longer needed
+	other, err := schemalessql.Open(driver, dsn, schemalessql.WithEncryption(newKeyRing(t, "2")))
+	if err != nil {
+		t.Fatalf("error connecting to database: %v", err)
+	}
+	defer closeDB(t, other)
+
+	var p Person
+	if err := other.Get(plain, &p); err != nil || !reflect.DeepEqual(p, people[0]) {
+		t.Fatalf("error reading entity %v: %v", p, err)
+	}
+
+	// the data is bound to its entity and can not be swapped with the data of another entity of the same kind
+	swapped, err := db.Put(nil, people[2])
+	if err != nil {
+		t.Fatalf("error creating entity: %v", err)
+	}
+
+	if err := db.Get(swapped, &p); err != nil || !reflect.DeepEqual(p, people[2]) {
+		t.Fatalf("error reading entity %v: %v", p, err)
+	}
+
+	// plain is the first and swapped the last entity
+	var ids []int64
+	var data [][]byte
+	rows, err = db.Query(`SELECT id, data FROM entities ORDER BY id`)
+	if err != nil {
+		t.Fatalf("error reading data: %v", err)
+	}
+
+	for rows.Next() {
+		var id int64
+		var d []byte
+		if err := rows.Scan(&id, &d); err != nil {
+			t.Fatalf("error reading data: %v", err)
+		}
+		ids, data = append(ids, id), append(data, d)
+	}
+	rows.Close()
+
+	if _, err := db.Exec(db.Dialect().Rebind(`UPDATE entities SET data=? WHERE id=?`), data[0], ids[len(ids)-1]); err != nil {
+		t.Fatalf("error swapping data: %v", err)
+	}
+
+	if err := db.Get(swapped, &p); err == nil {
+		t.Fatalf("should receive error for data of another entity")
+	}
+
+	// without encryption the entities can not be decrypted
+	unencrypted, err := schemalessql.Open(driver, dsn)
+	if err != nil {
+		t.Fatalf("error connecting to database: %v", err)
+	}
+	defer closeDB(t, unencrypted)
+
+	if err := unencrypted.Get(plain, &p); err == nil {
+		t.Fatalf("should receive error for encrypted entity without encryption")
+	}
+}
+
+// interleavingKeys calls interleave once, the first time a key is requested to decrypt an entity.
+type interleavingKeys struct {
+	*schemalessql.KeyRing
+	interleave func()
+}
+
+func (k *interleavingKeys) Key(id string) ([]byte, error) {
+	if f := k.interleave; f != nil {
+		k.interleave = nil
+		f()
+	}
+
+	return k.KeyRing.Key(id)
+}
+
+func TestReencryptConcurrentPut(t *testing.T) {
+	driver, dsn := testDSN(t)
+	if driver == "sqlite3" {
+		// readers do not block the interleaved writer
+		dsn += "?_journal_mode=WAL"
+	}
+
+	keys := &interleavingKeys{KeyRing: newKeyRing(t, "1")}
+	db, err := schemalessql.Open(driver, dsn, schemalessql.WithEncryption(keys))
+	if err != nil {
+		t.Fatalf("error connecting to database: %v", err)
+	}
+	defer closeDB(t, db)
+
+	key, err := db.Put(nil, people[0])
+	if err != nil {
+		t.Fatalf("error creating entity: %v", err)
+	}
+
+	if err := keys.Add("2", bytes.Repeat([]byte("2"), 32)); err != nil {
+		t.Fatalf("error adding key: %v", err)
+	}
+
+	// the entity is saved after it has been read for reencryption,
+	// which either conflicts with the reencrypting transaction or changes the version the entity is rewritten at
+	keys.interleave = func() {
+		if _, err := db.Put(key, people[1]); err != nil {
+			t.Errorf("error updating entity: %v", err)
+		}
+	}
+
+	if n, err := db.Reencrypt(context.Background()); err != nil || n != 0 {
+		t.Fatalf("should reencrypt no entities but reencrypted %v: %v", n, err)
+	}
+
+	var p Person
+	if err := db.Get(key, &p); err != nil || !reflect.DeepEqual(p, people[1]) {
+		t.Fatalf("should read the saved entity %v but read %v: %v", people[1], p, err)
+	}
+}
@@ -0,0 +1,200 @@
+package schemalessql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+// Done is returned by Iterator.Next when no more results are available.
+var Done = errors.New("schemalessql: no more results")
+
+// Iterator is the result of running a query.
+// The results are streamed from the database and decoded when requested by Next.
+type Iterator struct {
+	ctx    context.Context
+	d      *datastore
+	s      *session
+	q      *Query
+	rows   rows
+	cursor Cursor
+	err    error
+}
+
+// Run runs the query and returns an iterator over its results.
+// The iterator should be closed if it is not read until Done.
+func (d *datastore) Run(q *Query) *Iterator {
+	return d.RunContext(context.Background(), q)
+}
+
+// RunContext is identical to Run, but uses the context for the database operations and hooks.
+// Once the context is done, Next returns its error.
+func (d *datastore) RunContext(ctx context.Context, q *Query) *Iterator {
+	return d.run(ctx, nil, q)
+}
+
+// run runs the query within the session, or without a transaction if it is nil.
+func (d *datastore) run(ctx context.Context, s *session, q *Query) *Iterator {
+	r := d.backend.reader(ctx)
+	if s != nil {
+		r = s
+	}
+
+	it := &Iterator{ctx: ctx, d: d, s: s, q: q}
+	if q.start != nil {
+		it.cursor = *q.start
+	}
+
+	d.structure.RLock()
+	codec := d.structure.codec[q.kind]
+	d.structure.RUnlock()
+
+	if err := q.validate(codec); err != nil {
+		it.err = err
+		return it
+	}
+
+	hashed, err := d.hashFilters(q, codec)
+	if err != nil {
+		it.err = err
+		return it
+	}
+
+	// the ancestor is matched by the id of its row, an ancestor that does not exist has no descendants
+	if hashed.ancestor != nil {
+		id, err := rowID(r, hashed.ancestor)
+		if err != nil && err != sql.ErrNoRows {
+			it.err = fmt.Errorf("schemalessql: could not query data from db: %w", err)
+			return it
+		}
+
+		if hashed == q {
+			hashed = q.clone()
+		}
+		hashed.ancestorID = id
+	}
+
+	rows, err := r.query(hashed)
+	if err != nil {
+		it.err = fmt.Errorf("schemalessql: could not query data from db: %w", err)
+		return it
+	}
+
+	it.rows = rows
+
+	return it
+}
+
+// Next returns the key of the next result and decodes the entity into dst unless it is nil.
+// When there are no more results, Done is returned.
+// If the kind of dst does not match the kind of the query, a *KindMismatchError is returned.
+func (it *Iterator) Next(dst interface{}) (*Key, error) {
+	if it.err != nil {
+		return nil, it.err
+	}
+
+	if err := it.ctx.Err(); err != nil {
+		it.err = err
+		it.rows.Close()
+		return nil, it.err
+	}
+
+	if !it.rows.Next() {
+		it.err = Done
+		if err := it.rows.Err(); err != nil {
+			it.err = fmt.Errorf("schemalessql: could not query data from db: %w", err)
+		}
+
+		it.rows.Close()
+		return nil, it.err
+	}
+
+	var parent string
+	row := entityRow{kind: it.q.kind}
+	c := Cursor{values: make([]interface{}, len(it.q.orders))}
+	dest := []interface{}{&c.id, &row.name, &parent}
+	for i := range c.values {
+		dest = append(dest, &c.values[i])
+	}
+	dest = append(dest, &row.data, &row.version, &row.codec, &row.compression, &row.keyID)
+
+	if err := it.rows.Scan(dest...); err != nil {
+		it.err = fmt.Errorf("schemalessql: could not query data from db: %w", err)
+		it.rows.Close()
+		return nil, it.err
+	}
+
+	for i, v := range c.values {
+		var err error
+		if c.values[i], err = cursorValue(v); err != nil {
+			it.err = fmt.Errorf("schemalessql: could not query data from db: %w", err)
+			it.rows.Close()
+			return nil, it.err
+		}
+	}
+
+	it.cursor = c
+	row.id = c.id
+	key := &Key{kind: it.q.kind, id: c.id}
+	if row.name != "" {
+		key = &Key{kind: it.q.kind, name: row.name}
+	}
+
+	if parent != "" {
+		var err error
+		if key.parent, err = DecodeKey(parent); err != nil {
+			it.err = fmt.Errorf("schemalessql: could not query data from db: %w", err)
+			it.rows.Close()
+			return nil, it.err
+		}
+	}
+
+	if dst == nil {
+		return key, nil
+	}
+
+	kind, err := kindOf(reflect.Indirect(reflect.ValueOf(dst)).Type())
+	if err != nil {
+		return key, err
+	}
+
+	if kind != it.q.kind {
+		return key, &KindMismatchError{key, it.q.kind, kind}
+	}
+
+	beforeLoad(it.ctx, dst)
+
+	if _, err := it.d.registerIn(it.ctx, it.s, dst); err != nil {
+		return key, err
+	}
+
+	if err := it.d.decode(row, dst); err != nil {
+		return key, err
+	}
+	setVersion(dst, row.version)
+
+	afterLoad(it.ctx, dst)
+
+	return key, nil
+}
+
+// Cursor returns a cursor positioned after the last result returned by Next.
+// Before the first result, the start cursor of the query is returned.
+func (it *Iterator) Cursor() Cursor {
+	return it.cursor
+}
+
+// Close stops the iteration and releases the database resources.
+func (it *Iterator) Close() error {
+	if it.err == nil {
+		it.err = Done
+	}
+
+	if it.rows != nil {
+		return it.rows.Close()
+	}
+
+	return nil
+}
@@ -0,0 +1,298 @@
+package schemalessql
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Key is the primary key of a saved Entity.
+// It consists of the kind of the entity and either a numeric id or an application-defined name.
+// Numeric ids are unique across all kinds, names are unique within their kind.
+// A key may have a parent key, which makes the entity a descendant of the parent entity and all of its ancestors.
+// Keys with parents should be compared with Equal.
+type Key struct {
+	kind   string
+	name   string
+	id     int64
+	parent *Key
+}
+
+// NewKey returns the key of the entity of the kind with the name, e.g. an email address or a pre-generated UUID.
+// Putting an entity with the key creates it if it does not exist yet, and replaces it otherwise.
+// Names are unique within the kind regardless of the parent, entities of the same kind and name cannot have different parents.
+// An empty name returns an incomplete key, for which Put generates a numeric id.
+func NewKey(kind, name string) *Key {
+	return &Key{kind: kind, name: name}
+}
+
+// IDKey returns the key of the entity of the kind with the numeric id, e.g. an id received in a URL.
+// Putting an entity with the key creates it if it does not exist yet, and replaces it otherwise.
+// A zero id returns an incomplete key, for which Put generates a numeric id.
+func IDKey(kind string, id int64) *Key {
+	return &Key{kind: kind, id: id}
+}
+
+// Kind returns the kind of the entity.
+func (k *Key) Kind() string {
+	return k.kind
+}
+
+// Name returns the name of the key, or an empty string if the key has a numeric id.
+func (k *Key) Name() string {
+	return k.name
+}
+
+// ID returns the numeric id of the key, or 0 if the key has a name.
+func (k *Key) ID() int64 {
+	return k.id
+}
+
+// Incomplete reports whether the key has neither a name nor a numeric id.
+func (k *Key) Incomplete() bool {
+	return k.name == "" && k.id == 0
+}
+
+// Parent returns the parent key, or nil if the entity has no parent.
+func (k *Key) Parent() *Key {
+	return k.parent
+}
+
+// WithParent returns a copy of the key with the parent key.
+// The parent entity must exist when the entity is created, its parent cannot be changed afterwards.
+func (k *Key) WithParent(parent *Key) *Key {
+	c := *k
+	c.parent = parent
+	return &c
+}
+
+// Equal reports whether both keys and their parents have the same kinds, names and ids.
+func (k *Key) Equal(other *Key) bool {
+	for k != nil && other != nil {
+		if k.kind != other.kind || k.name != other.name || k.id != other.id {
+			return false
+		}
+
+		k, other = k.parent, other.parent
+	}
+
+	return k == nil && other == nil
+}
+
+// String returns a human-readable representation of the key, the kind followed by the quoted name or the numeric id,
+// preceded by the representation of its parent, e.g. Organisation,"acme"/Project,7.
+func (k Key) String() string {
+	var s string
+	if k.parent != nil {
+		s = k.parent.String() + "/"
+	}
+
+	if k.name != "" {
+		return s + k.kind + "," + strconv.Quote(k.name)
+	}
+
+	return s + k.kind + "," + strconv.FormatInt(k.id, 10)
+}
+
+// Encode returns an opaque, URL-safe representation of the key, which is decoded by DecodeKey.
+func (k Key) Encode() string {
+	buf, _ := k.MarshalBinary()
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+// DecodeKey decodes a key from its Encode representation.
+func DecodeKey(s string) (*Key, error) {
+	buf, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return nil, fmt.Errorf("schemalessql: invalid key: %v", err)
+	}
+
+	var k Key
+	if err := k.UnmarshalBinary(buf); err != nil {
+		return nil, fmt.Errorf("schemalessql: invalid key %q", s)
+	}
+
+	return &k, nil
+}
+
+// MarshalBinary returns the compact binary representation of the key, which consists of
+// the length prefixed kind and name followed by the id of the root ancestor and of every descendant down to the key.
+func (k Key) MarshalBinary() ([]byte, error) {
+	var buf []byte
+	if k.parent != nil {
+		buf, _ = k.parent.MarshalBinary()
+	}
+
+	buf = binary.AppendUvarint(buf, uint64(len(k.kind)))
+	buf = append(buf, k.kind...)
+	buf = binary.AppendUvarint(buf, uint64(len(k.name)))
+	buf = append(buf, k.name...)
+	buf = binary.AppendVarint(buf, k.id)
+
+	return buf, nil
+}
+
+// UnmarshalBinary decodes the key from its MarshalBinary representation.
+func (k *Key) UnmarshalBinary(data []byte) error {
+	invalid := errors.New("schemalessql: invalid key")
+
+	// length prefixed strings
+	next := func() (string, bool) {
+		n, l := binary.Uvarint(data)
+		if l <= 0 || uint64(len(data)-l) < n {
+			return "", false
+		}
+
+		b := data[l : l+int(n)]
+		data = data[l+int(n):]
+		return string(b), true
+	}
+
+	var key *Key
+	for len(data) > 0 || key == nil {
+		kind, ok := next()
+		if !ok || kind == "" {
+			return invalid
+		}
+
+		name, ok := next()
+		if !ok {
+			return invalid
+		}
+
+		id, l := binary.Varint(data)
+		if l <= 0 || id != 0 && name != "" {
+			return invalid
+		}
+		data = data[l:]
+
+		// only the last key may be incomplete
+		if key != nil && key.Incomplete() {
+			return invalid
+		}
+
+		key = &Key{kind: kind, name: name, id: id, parent: key}
+	}
+
+	*k = *key
+	return nil
+}
+
+// MarshalText returns the Encode representation of the key.
+func (k Key) MarshalText() ([]byte, error) {
+	return []byte(k.Encode()), nil
+}
+
+// UnmarshalText decodes the key from its Encode representation.
+func (k *Key) UnmarshalText(text []byte) error {
+	key, err := DecodeKey(string(text))
+	if err != nil {
+		return err
+	}
+
+	*k = *key
+	return nil
+}
+
+// MarshalJSON returns the Encode representation of the key as JSON string.
+func (k Key) MarshalJSON() ([]byte, error) {
+	return json.Marshal(k.Encode())
+}
+
+// UnmarshalJSON decodes the key from a JSON string of its Encode representation, null is ignored.
+func (k *Key) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		return nil
+	}
+
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("schemalessql: invalid key: %v", err)
+	}
+
+	return k.UnmarshalText([]byte(s))
+}
+
+// Value stores the key as the string of its Encode representation in other SQL tables, a nil *Key as NULL.
+func (k Key) Value() (driver.Value, error) {
+	return k.Encode(), nil
+}
+
+// Scan reads a key stored by Value, NULL results in an incomplete key without kind.
+func (k *Key) Scan(src interface{}) error {
+	switch s := src.(type) {
+	case nil:
+		*k = Key{}
+		return nil
+	case string:
+		return k.UnmarshalText([]byte(s))
+	case []byte:
+		return k.UnmarshalText(s)
+	}
+
+	return fmt.Errorf("schemalessql: cannot scan %T into key", src)
+}
+
+var (
+	_ fmt.Stringer               = Key{}
+	_ encoding.BinaryMarshaler   = Key{}
+	_ encoding.BinaryUnmarshaler = (*Key)(nil)
+	_ encoding.TextMarshaler     = Key{}
+	_ encoding.TextUnmarshaler   = (*Key)(nil)
+	_ json.Marshaler             = Key{}
+	_ json.Unmarshaler           = (*Key)(nil)
+	_ driver.Valuer              = Key{}
+	_ sql.Scanner                = (*Key)(nil)
+)
+
+// ancestry returns the row ids of the parent entity and all of its ancestors.
+// The entities must exist with the kinds and parents of the keys.
+func ancestry(r reader, parent *Key) ([]int64, error) {
+	var ids []int64
+	for p := parent; p != nil; p = p.parent {
+		if p.Incomplete() {
+			return nil, fmt.Errorf("schemalessql: incomplete parent key %v", p)
+		}
+
+		var row entityRow
+		id, err := rowID(r, p)
+		if err == nil {
+			row, err = r.entity(id, false)
+		}
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("schemalessql: parent entity %v does not exist", p)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("schemalessql: could not query data from db: %w", err)
+		}
+
+		if row.kind != p.kind {
+			return nil, &KindMismatchError{p, row.kind, p.kind}
+		}
+
+		if !row.parent.Equal(p.parent) {
+			return nil, fmt.Errorf("schemalessql: entity %v has parent %v, not %v", p, row.parent, p.parent)
+		}
+
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
+
+// rowID returns the id of the row of the entity of the key.
+// If the key has a name that has not been saved, sql.ErrNoRows is returned.
+func rowID(r reader, key *Key) (int64, error) {
+	if key.name == "" {
+		return key.id, nil
+	}
+
+	return r.lookup(key.kind, key.name)
+}
@@ -0,0 +1,97 @@
+package schemalessql_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/der-antikeks/schemalessql"
+)
+
+type EntityTask struct {
+	Title   string
+	Owner   *schemalessql.Key
+	Project schemalessql.Key
+}
+
+func TestKeyEncoding(t *testing.T) {
+	keys := []*schemalessql.Key{
+		schemalessql.NewKey("User", "alice@example.com"),
+		schemalessql.NewKey("User", "123"),
+		schemalessql.IDKey("Entity", 42),
+		schemalessql.IDKey("Entity", -1),
+		schemalessql.IDKey("Entity", 0),
+		schemalessql.IDKey("Entity", 0).WithParent(schemalessql.IDKey("Entity", 42).WithParent(schemalessql.NewKey("User", "123"))),
+	}
+
+	for _, key := range keys {
+		decoded, err := schemalessql.DecodeKey(key.Encode())
+		if err != nil || !decoded.Equal(key) {
+			t.Fatalf("error decoding key %v: %v %v", key, decoded, err)
+		}
+
+		data, err := json.Marshal(struct{ Key *schemalessql.Key }{key})
+		if err != nil {
+			t.Fatalf("error marshalling key %v: %v", key, err)
+		}
+
+		var v struct{ Key schemalessql.Key }
+		if err := json.Unmarshal(data, &v); err != nil || !v.Key.Equal(key) {
+			t.Fatalf("error unmarshalling key %v from %s: %v %v", key, data, v.Key, err)
+		}
+
+		value, err := key.Value()
+		if err != nil {
+			t.Fatalf("error converting key %v: %v", key, err)
+		}
+
+		var scanned schemalessql.Key
+		if err := scanned.Scan([]byte(value.(string))); err != nil || !scanned.Equal(key) {
+			t.Fatalf("error scanning key %v: %v %v", key, scanned, err)
+		}
+	}
+
+	if s := keys[0].String(); s != `User,"alice@example.com"` {
+		t.Fatalf("wrong string of named key: %v", s)
+	}
+
+	if s := keys[2].String(); s != `Entity,42` {
+		t.Fatalf("wrong string of numeric key: %v", s)
+	}
+
+	if s := keys[5].String(); s != `User,"123"/Entity,42/Entity,0` {
+		t.Fatalf("wrong string of key with parents: %v", s)
+	}
+
+	for _, s := range []string{"", "!", "AA", keys[0].Encode() + "A"} {
+		if _, err := schemalessql.DecodeKey(s); err == nil {
+			t.Fatalf("should receive error for decoding invalid key %q", s)
+		}
+	}
+}
+
+func TestKeyFields(t *testing.T) {
+	for _, codec := range []schemalessql.Codec{schemalessql.Gob, schemalessql.JSON, schemalessql.MsgPack} {
+		db := schemalessql.NewMemoryStore(schemalessql.WithCodec(codec))
+
+		owner := schemalessql.NewKey("User", "alice@example.com")
+		project := schemalessql.IDKey("Project", 7)
+		key, err := db.Put(nil, EntityTask{"foo", owner, *project})
+		if err != nil {
+			t.Fatalf("error creating entity with %v: %v", codec.Name(), err)
+		}
+
+		if _, err := db.Put(nil, EntityTask{"bar", nil, *schemalessql.IDKey("Project", 8)}); err != nil {
+			t.Fatalf("error creating entity with %v: %v", codec.Name(), err)
+		}
+
+		var r EntityTask
+		if err := db.Get(key, &r); err != nil || r.Owner == nil || *r.Owner != *owner || r.Project != *project {
+			t.Fatalf("error reading keys with %v: %v %v", codec.Name(), r, err)
+		}
+
+		found, err := db.FindAllKeys(db.NewQuery("EntityTask").Filter("Owner =", owner).Filter("Project =", project))
+		if err != nil || len(found) != 1 || *found[0] != *key {
+			t.Fatalf("error filtering by keys with %v: %v %v", codec.Name(), found, err)
+		}
+	}
+}
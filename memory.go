@@ -0,0 +1,816 @@
+package schemalessql
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryStore is a Store that keeps the entities in memory instead of a database.
+// It behaves like a Datastore, but requires neither cgo nor a database server, which makes it suitable for tests.
+// Transactions are executed one after another, operations outside of a transaction wait until it is finished.
+type MemoryStore struct {
+	datastore
+	memory *memoryBackend
+}
+
+// NewMemoryStore returns an empty MemoryStore configured by the options, WithDialect is ignored.
+func NewMemoryStore(opts ...Option) *MemoryStore {
+	m := &MemoryStore{memory: &memoryBackend{
+		entities:  make(map[int64]entityRow),
+		names:     make(map[string]map[string]int64),
+		ancestors: make(map[int64]map[int64]bool),
+		indices:   make(map[string]map[int64]interface{}),
+		fields:    make(map[string]map[string]fieldCodec),
+	}}
+
+	// the empty schema cannot fail to load
+	m.init(context.Background(), m.memory, newOptions(opts))
+
+	return m
+}
+
+// Close releases the entities, subsequent operations fail.
+func (m *MemoryStore) Close() error {
+	m.memory.Lock()
+	defer m.memory.Unlock()
+
+	m.memory.closed = true
+	m.memory.entities = nil
+	m.memory.names = nil
+	m.memory.ancestors = nil
+	m.memory.indices = nil
+	return nil
+}
+
+// errClosed is returned by the operations of a closed MemoryStore.
+var errClosed = errors.New("memory store is closed")
+
+// memoryBackend stores the rows of the entity table, the name table, the ancestor table and the index tables in maps.
+// Transactions hold the write lock until they are finished.
+type memoryBackend struct {
+	sync.RWMutex
+	entities map[int64]entityRow
+	names    map[string]map[string]int64
+	indices  map[string]map[int64]interface{}
+	sequence int64
+	closed   bool
+
+	// ids of the descendants of every ancestor
+	ancestors map[int64]map[int64]bool
+
+	// the schema is locked separately, it is read while the structure of the datastore is locked
+	schemaMu sync.Mutex
+	fields   map[string]map[string]fieldCodec
+}
+
+func (b *memoryBackend) reader(ctx context.Context) reader {
+	return &memoryReader{b: b, ctx: ctx}
+}
+
+func (b *memoryBackend) begin(ctx context.Context, serializable bool) (txn, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	b.Lock()
+	if b.closed {
+		b.Unlock()
+		return nil, errClosed
+	}
+
+	return &memoryTxn{memoryReader: memoryReader{b: b, ctx: ctx, locked: true}}, nil
+}
+
+func (b *memoryBackend) transactionalDDL() bool {
+	return true
+}
+
+func (b *memoryBackend) retryable(err error) bool {
+	// transactions never run concurrently
+	return false
+}
+
+func (b *memoryBackend) schema(ctx context.Context) (map[string]map[string]fieldCodec, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	b.schemaMu.Lock()
+	defer b.schemaMu.Unlock()
+
+	schema := make(map[string]map[string]fieldCodec, len(b.fields))
+	for kind, fields := range b.fields {
+		codec := make(map[string]fieldCodec, len(fields))
+		for fieldname, field := range fields {
+			codec[fieldname] = field
+		}
+		schema[kind] = codec
+	}
+
+	return schema, nil
+}
+
+// memoryReader reads the committed rows, or the rows of the transaction that holds the write lock.
+type memoryReader struct {
+	b      *memoryBackend
+	ctx    context.Context
+	locked bool
+}
+
+// acquire read locks the backend unless the reader belongs to a transaction and returns the function that releases it.
+func (r *memoryReader) acquire() (func(), error) {
+	if err := r.ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if r.locked {
+		return func() {}, nil
+	}
+
+	r.b.RLock()
+	if r.b.closed {
+		r.b.RUnlock()
+		return nil, errClosed
+	}
+
+	return r.b.RUnlock, nil
+}
+
+func (r *memoryReader) entity(id int64, data bool) (entityRow, error) {
+	release, err := r.acquire()
+	if err != nil {
+		return entityRow{}, err
+	}
+	defer release()
+
+	row, found := r.b.entities[id]
+	if !found {
+		return entityRow{}, sql.ErrNoRows
+	}
+
+	if !data {
+		row.data = nil
+	}
+
+	return row, nil
+}
+
+func (r *memoryReader) lookup(kind, name string) (int64, error) {
+	release, err := r.acquire()
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+
+	id, found := r.b.names[kind][name]
+	if !found {
+		return 0, sql.ErrNoRows
+	}
+
+	return id, nil
+}
+
+func (r *memoryReader) descendants(id int64) ([]int64, error) {
+	release, err := r.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	var ids []int64
+	for descendant := range r.b.ancestors[id] {
+		ids = append(ids, descendant)
+	}
+
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+func (r *memoryReader) stale(keyID string, after int64, limit int) ([]int64, error) {
+	release, err := r.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	var ids []int64
+	for id, row := range r.b.entities {
+		if id > after && row.keyID != keyID {
+			ids = append(ids, id)
+		}
+	}
+
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	if limit >= 0 && limit < len(ids) {
+		ids = ids[:limit]
+	}
+
+	return ids, nil
+}
+
+// memoryResult is a row of the results of a query.
+type memoryResult struct {
+	row    entityRow
+	values []interface{}
+}
+
+func (r *memoryReader) query(q *Query) (rows, error) {
+	release, err := r.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	// the results are collected at once, so that the lock is not held during the iteration
+	var results []memoryResult
+	for _, row := range r.b.entities {
+		if row.kind != q.kind {
+			continue
+		}
+
+		if values, ok := r.match(q, row); ok {
+			results = append(results, memoryResult{row, values})
+		}
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		return comparePositions(q.orders, results[i].values, results[i].row.id, results[j].values, results[j].row.id) < 0
+	})
+
+	if q.offset >= len(results) {
+		results = nil
+	} else {
+		results = results[q.offset:]
+	}
+
+	if q.limit >= 0 && q.limit < len(results) {
+		results = results[:q.limit]
+	}
+
+	return &memoryRows{results: results}, nil
+}
+
+// match reports whether the entity matches the filters and cursors of the query and returns its sort values.
+// Like the joins of the index tables, the entity must have index values for all fields of the filters and orders.
+func (r *memoryReader) match(q *Query, row entityRow) ([]interface{}, bool) {
+	id := row.id
+	if q.ancestor != nil && !r.b.ancestors[q.ancestorID][id] {
+		return nil, false
+	}
+
+	var document interface{}
+	for _, f := range q.filters {
+		if f.path != nil {
+			if document == nil {
+				document = decodeDocument(row)
+			}
+
+			if !f.matches(extractValue(document, f.path)) {
+				return nil, false
+			}
+			continue
+		}
+
+		value, found := r.b.indices[indexTable(q.kind, f.field)][id]
+		if !found || !f.matches(value) {
+			return nil, false
+		}
+	}
+
+	values := make([]interface{}, len(q.orders))
+	for i, o := range q.orders {
+		value, found := r.b.indices[indexTable(q.kind, o.field)][id]
+		if !found {
+			return nil, false
+		}
+		values[i] = value
+	}
+
+	if c := q.start; c != nil && comparePositions(q.orders, values, id, normalizeValues(c.values), c.id) <= 0 {
+		return nil, false
+	}
+
+	if c := q.end; c != nil && comparePositions(q.orders, values, id, normalizeValues(c.values), c.id) > 0 {
+		return nil, false
+	}
+
+	return values, true
+}
+
+// memoryTxn modifies the rows while holding the write lock and records how to undo the modifications.
+type memoryTxn struct {
+	memoryReader
+	undo []func()
+	done bool
+}
+
+func (t *memoryTxn) insert(row entityRow) (int64, error) {
+	if err := t.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	sequence := t.b.sequence
+	if row.id == 0 {
+		row.id = sequence + 1
+	}
+
+	if _, found := t.b.entities[row.id]; found {
+		return 0, fmt.Errorf("duplicate id %v", row.id)
+	}
+
+	if _, found := t.b.names[row.kind][row.name]; found && row.name != "" {
+		return 0, fmt.Errorf("duplicate name %q of kind %v", row.name, row.kind)
+	}
+
+	// like AUTOINCREMENT, ids are not reused
+	if row.id > sequence {
+		t.b.sequence = row.id
+	}
+
+	row.version = 1
+	t.b.entities[row.id] = row
+	if row.name != "" {
+		if t.b.names[row.kind] == nil {
+			t.b.names[row.kind] = make(map[string]int64)
+		}
+		t.b.names[row.kind][row.name] = row.id
+	}
+
+	for _, ancestor := range row.ancestors {
+		if t.b.ancestors[ancestor] == nil {
+			t.b.ancestors[ancestor] = make(map[int64]bool)
+		}
+		t.b.ancestors[ancestor][row.id] = true
+	}
+
+	t.undo = append(t.undo, func() {
+		delete(t.b.entities, row.id)
+		delete(t.b.names[row.kind], row.name)
+		for _, ancestor := range row.ancestors {
+			delete(t.b.ancestors[ancestor], row.id)
+		}
+		t.b.sequence = sequence
+	})
+
+	return row.id, nil
+}
+
+func (t *memoryTxn) update(row entityRow) (bool, error) {
+	if err := t.ctx.Err(); err != nil {
+		return false, err
+	}
+
+	stored, found := t.b.entities[row.id]
+	if !found || row.version != anyVersion && stored.version != row.version {
+		return false, nil
+	}
+
+	row.kind, row.name, row.parent, row.ancestors = stored.kind, stored.name, stored.parent, stored.ancestors
+	row.version = stored.version + 1
+	t.b.entities[row.id] = row
+	t.undo = append(t.undo, func() {
+		t.b.entities[row.id] = stored
+	})
+
+	return true, nil
+}
+
+func (t *memoryTxn) rewrite(row entityRow) (bool, error) {
+	if err := t.ctx.Err(); err != nil {
+		return false, err
+	}
+
+	stored, found := t.b.entities[row.id]
+	if !found || stored.version != row.version {
+		return false, nil
+	}
+
+	updated := stored
+	updated.data, updated.keyID = row.data, row.keyID
+	t.b.entities[row.id] = updated
+	t.undo = append(t.undo, func() {
+		t.b.entities[row.id] = stored
+	})
+
+	return true, nil
+}
+
+func (t *memoryTxn) remove(id int64) error {
+	if err := t.ctx.Err(); err != nil {
+		return err
+	}
+
+	stored, found := t.b.entities[id]
+	if !found {
+		return nil
+	}
+
+	delete(t.b.entities, id)
+	delete(t.b.names[stored.kind], stored.name)
+	for _, ancestor := range stored.ancestors {
+		delete(t.b.ancestors[ancestor], id)
+	}
+
+	t.undo = append(t.undo, func() {
+		t.b.entities[id] = stored
+		if stored.name != "" {
+			t.b.names[stored.kind][stored.name] = id
+		}
+		for _, ancestor := range stored.ancestors {
+			t.b.ancestors[ancestor][id] = true
+		}
+	})
+
+	return nil
+}
+
+func (t *memoryTxn) index(kind, fieldname string, id int64, value interface{}) error {
+	if err := t.ctx.Err(); err != nil {
+		return err
+	}
+
+	table := indexTable(kind, fieldname)
+	values, found := t.b.indices[table]
+	if !found {
+		return fmt.Errorf("no such table: %v", table)
+	}
+
+	previous, found := values[id]
+	values[id] = normalizeValue(value)
+	t.undo = append(t.undo, func() {
+		if found {
+			values[id] = previous
+		} else {
+			delete(values, id)
+		}
+	})
+
+	return nil
+}
+
+func (t *memoryTxn) unindex(kind, fieldname string, id int64) error {
+	if err := t.ctx.Err(); err != nil {
+		return err
+	}
+
+	table := indexTable(kind, fieldname)
+	values, found := t.b.indices[table]
+	if !found {
+		return fmt.Errorf("no such table: %v", table)
+	}
+
+	previous, found := values[id]
+	if !found {
+		return nil
+	}
+
+	delete(values, id)
+	t.undo = append(t.undo, func() {
+		values[id] = previous
+	})
+
+	return nil
+}
+
+func (t *memoryTxn) define(kind, fieldname string, field fieldCodec) error {
+	if err := t.ctx.Err(); err != nil {
+		return err
+	}
+
+	t.b.schemaMu.Lock()
+	defer t.b.schemaMu.Unlock()
+
+	if _, found := t.b.fields[kind][fieldname]; found {
+		return fmt.Errorf("field %v of kind %v is already defined", fieldname, kind)
+	}
+
+	if t.b.fields[kind] == nil {
+		t.b.fields[kind] = make(map[string]fieldCodec)
+	}
+	t.b.fields[kind][fieldname] = field
+
+	table := indexTable(kind, fieldname)
+	_, exists := t.b.indices[table]
+	if !field.noindex && !exists {
+		t.b.indices[table] = make(map[int64]interface{})
+	}
+
+	t.undo = append(t.undo, func() {
+		t.b.schemaMu.Lock()
+		delete(t.b.fields[kind], fieldname)
+		t.b.schemaMu.Unlock()
+
+		if !exists {
+			delete(t.b.indices, table)
+		}
+	})
+
+	return nil
+}
+
+func (t *memoryTxn) commit() error {
+	if t.done {
+		return sql.ErrTxDone
+	}
+
+	// like a database, a transaction of a done context is rolled back
+	if err := t.ctx.Err(); err != nil {
+		t.rollback()
+		return err
+	}
+
+	t.done = true
+	t.undo = nil
+	t.b.Unlock()
+	return nil
+}
+
+func (t *memoryTxn) rollback() error {
+	if t.done {
+		return sql.ErrTxDone
+	}
+
+	for i := len(t.undo) - 1; i >= 0; i-- {
+		t.undo[i]()
+	}
+
+	t.done = true
+	t.undo = nil
+	t.b.Unlock()
+	return nil
+}
+
+// memoryRows iterates over the results of a query like *sql.Rows.
+type memoryRows struct {
+	results []memoryResult
+	next    int
+}
+
+func (r *memoryRows) Next() bool {
+	if r.next >= len(r.results) {
+		return false
+	}
+
+	r.next++
+	return true
+}
+
+// Scan copies the id, the name, the encoded parent, the sort values, the data, the version, the codec, the compression and the key id of the current result into the destinations.
+func (r *memoryRows) Scan(dest ...interface{}) error {
+	if r.next == 0 {
+		return fmt.Errorf("Scan called without calling Next")
+	}
+
+	result := r.results[r.next-1]
+	var parent string
+	if result.row.parent != nil {
+		parent = result.row.parent.Encode()
+	}
+
+	columns := append(append([]interface{}{result.row.id, result.row.name, parent}, result.values...), result.row.data, result.row.version, result.row.codec, result.row.compression, result.row.keyID)
+	if len(dest) != len(columns) {
+		return fmt.Errorf("expected %d destination arguments in Scan, not %d", len(columns), len(dest))
+	}
+
+	for i, column := range columns {
+		switch d := dest[i].(type) {
+		case *interface{}:
+			*d = column
+		case *int64:
+			*d = column.(int64)
+		case *[]byte:
+			*d = column.([]byte)
+		case *string:
+			*d = column.(string)
+		default:
+			return fmt.Errorf("unsupported Scan destination %T", d)
+		}
+	}
+
+	return nil
+}
+
+func (r *memoryRows) Err() error {
+	return nil
+}
+
+func (r *memoryRows) Close() error {
+	r.next = len(r.results)
+	return nil
+}
+
+// decodeDocument decodes the data of unencrypted entities encoded by the JSON codec, other entities have an empty document.
+func decodeDocument(row entityRow) interface{} {
+	var document interface{}
+	if row.codec == JSON.Name() && row.keyID == "" {
+		dec := json.NewDecoder(bytes.NewReader(row.data))
+		dec.UseNumber()
+		dec.Decode(&document)
+	}
+
+	if document == nil {
+		return map[string]interface{}{}
+	}
+
+	return document
+}
+
+// extractValue returns the normalized value at the path of the document like json_extract of SQLite,
+// missing values are NULL and objects or arrays are their JSON text.
+func extractValue(document interface{}, path []string) interface{} {
+	for _, name := range path {
+		object, ok := document.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		document = object[name]
+	}
+
+	switch v := document.(type) {
+	case map[string]interface{}, []interface{}:
+		return jsonText(v)
+	}
+
+	return normalizeValue(document)
+}
+
+// normalizeValue converts an index value into one of the types nil, int64, float64, string, []byte or time.Time,
+// booleans are stored as integers like in SQLite.
+func normalizeValue(v interface{}) interface{} {
+	switch vi := v.(type) {
+	case nil:
+		return nil
+	case json.Number:
+		if i, err := vi.Int64(); err == nil {
+			return i
+		}
+		f, _ := vi.Float64()
+		return f
+	case time.Time:
+		return vi.UTC()
+	case Key, *Key:
+		return indexValue(vi)
+	case []byte:
+		if vi == nil {
+			return nil
+		}
+		return append([]byte(nil), vi...)
+	}
+
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int64(rv.Uint())
+	case reflect.Float32, reflect.Float64:
+		return rv.Float()
+	case reflect.Bool:
+		if rv.Bool() {
+			return int64(1)
+		}
+		return int64(0)
+	case reflect.String:
+		return rv.String()
+	case reflect.Slice:
+		if rv.Type().Elem().Kind() == reflect.Uint8 {
+			return normalizeValue(rv.Bytes())
+		}
+	}
+
+	return v
+}
+
+// normalizeValues normalizes the values of a cursor.
+func normalizeValues(values []interface{}) []interface{} {
+	result := make([]interface{}, len(values))
+	for i, v := range values {
+		result[i] = normalizeValue(v)
+	}
+
+	return result
+}
+
+// matches reports whether the normalized index value matches the filter, NULL values never match.
+func (f filter) matches(v interface{}) bool {
+	if v == nil {
+		return false
+	}
+
+	switch f.op {
+	case "in":
+		for _, value := range f.value.([]interface{}) {
+			if value = normalizeValue(value); value != nil && compareValues(v, value) == 0 {
+				return true
+			}
+		}
+
+		return false
+	case "between":
+		values := normalizeValues(f.value.([]interface{}))
+		return values[0] != nil && values[1] != nil && compareValues(v, values[0]) >= 0 && compareValues(v, values[1]) <= 0
+	case "prefix":
+		s, ok := v.(string)
+		return ok && strings.HasPrefix(s, f.value.(string))
+	}
+
+	value := normalizeValue(f.value)
+	if value == nil {
+		return false
+	}
+
+	c := compareValues(v, value)
+	switch f.op {
+	case "=":
+		return c == 0
+	case "!=":
+		return c != 0
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	case ">=":
+		return c >= 0
+	}
+
+	return false
+}
+
+// compareValues compares two normalized values in the order of SQLite: NULL, numbers, text, blobs.
+func compareValues(a, b interface{}) int {
+	rank := func(v interface{}) int {
+		switch v.(type) {
+		case nil:
+			return 0
+		case int64, float64:
+			return 1
+		case string, time.Time:
+			return 2
+		default:
+			return 3
+		}
+	}
+
+	if ra, rb := rank(a), rank(b); ra != rb {
+		return ra - rb
+	}
+
+	switch va := a.(type) {
+	case nil:
+		return 0
+	case int64:
+		if vb, ok := b.(int64); ok {
+			return cmp.Compare(va, vb)
+		}
+		return cmp.Compare(float64(va), b.(float64))
+	case float64:
+		if vb, ok := b.(int64); ok {
+			return cmp.Compare(va, float64(vb))
+		}
+		return cmp.Compare(va, b.(float64))
+	case time.Time:
+		if vb, ok := b.(time.Time); ok {
+			return va.Compare(vb)
+		}
+		return strings.Compare(va.Format(sqliteTimestamp), b.(string))
+	case string:
+		if vb, ok := b.(time.Time); ok {
+			return strings.Compare(va, vb.Format(sqliteTimestamp))
+		}
+		return strings.Compare(va, b.(string))
+	case []byte:
+		vb, _ := b.([]byte)
+		return bytes.Compare(va, vb)
+	}
+
+	return 0
+}
+
+// sqliteTimestamp is the format of times stored as text by SQLite.
+const sqliteTimestamp = "2006-01-02 15:04:05.999999999-07:00"
+
+// comparePositions compares the positions of two entities within the results of a query by their sort values and ids.
+func comparePositions(orders []order, a []interface{}, aid int64, b []interface{}, bid int64) int {
+	for i, o := range orders {
+		if c := compareValues(a[i], b[i]); c != 0 {
+			if o.desc {
+				return -c
+			}
+			return c
+		}
+	}
+
+	return cmp.Compare(aid, bid)
+}
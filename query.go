@@ -0,0 +1,609 @@
+package schemalessql
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Query describes a search for entities of a kind by their indexed fields.
+// Queries are immutable, every method returns a derivative query.
+type Query struct {
+	kind    string
+	filters []filter
+	orders  []order
+	limit   int
+	offset  int
+	start   *Cursor
+	end     *Cursor
+	err     error
+
+	// key of the ancestor and the id of its row, which is resolved when the query is run
+	ancestor   *Key
+	ancestorID int64
+}
+
+// filter is a condition on an indexed field, or on a value of the JSON document.
+type filter struct {
+	field string
+	op    string
+	value interface{}
+
+	// path into the JSON document, nil for indexed fields
+	path []string
+}
+
+// order is a sort criterion on an indexed field.
+type order struct {
+	field string
+	desc  bool
+}
+
+// comparison operators of Filter, longer ones first
+var operators = []string{"<=", ">=", "!=", "<", ">", "="}
+
+// word operators of Filter, separated from the field name by space
+var wordOperators = []string{"in", "between", "prefix"}
+
+// selectivity estimates how many index entries an operator matches, lower values are more selective.
+var selectivity = map[string]int{
+	"=":       0,
+	"in":      1,
+	"between": 2,
+	"prefix":  2,
+	"<":       3,
+	"<=":      3,
+	">":       3,
+	">=":      3,
+	"!=":      4,
+}
+
+// NewQuery creates a new Query for entities of the kind.
+func (d *datastore) NewQuery(kind string) *Query {
+	return &Query{kind: kind, limit: -1}
+}
+
+// clone returns a copy of the query that can be modified without affecting the original.
+func (q *Query) clone() *Query {
+	c := *q
+	c.filters = append([]filter(nil), q.filters...)
+	c.orders = append([]order(nil), q.orders...)
+	return &c
+}
+
+// Filter returns a derivative query with a field-based filter.
+// The filterStr argument must be a field name followed by optional space, followed by an operator, one of "=", "!=", "<", "<=", ">" or ">=".
+// Fields are compared with the value as stored in the index tables.
+//
+// Additionally the following operators, separated from the field name by space, are supported:
+//
+//	"in"       value must be a slice, matches fields equal to one of its elements
+//	"between"  value must be a slice of two elements, matches fields within the inclusive range
+//	"prefix"   value must be a string, matches text fields starting with it
+//
+// A field name containing dots is a path into the entities encoded by the JSON codec (e.g. "Address.City ="), which requires no index tables.
+// A leading "$." addresses the document itself, so that fields that are not indexed can be filtered too (e.g. "$.Notes prefix").
+// Such values are compared as JSON values, times as their JSON text, and entities encoded by other codecs never match.
+func (q *Query) Filter(filterStr string, value interface{}) *Query {
+	q = q.clone()
+
+	field, op := parseFilter(filterStr)
+	if field == "" {
+		q.err = fmt.Errorf("schemalessql: invalid filter %q", filterStr)
+		return q
+	}
+
+	switch op {
+	case "in", "between":
+		v := reflect.ValueOf(value)
+		if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+			q.err = fmt.Errorf("schemalessql: value of filter %q must be a slice", filterStr)
+			return q
+		}
+
+		values := make([]interface{}, v.Len())
+		for i := range values {
+			values[i] = v.Index(i).Interface()
+		}
+
+		if op == "between" && len(values) != 2 {
+			q.err = fmt.Errorf("schemalessql: value of filter %q must contain two elements", filterStr)
+			return q
+		}
+
+		value = values
+	case "prefix":
+		if _, ok := value.(string); !ok {
+			q.err = fmt.Errorf("schemalessql: value of filter %q must be a string", filterStr)
+			return q
+		}
+	}
+
+	if !strings.Contains(field, ".") {
+		q.filters = append(q.filters, filter{field: field, op: op, value: value})
+		return q
+	}
+
+	path := parsePath(field)
+	if path == nil {
+		q.err = fmt.Errorf("schemalessql: invalid path %q", field)
+		return q
+	}
+
+	var err error
+	if values, ok := value.([]interface{}); ok {
+		for i := range values {
+			if values[i], err = documentValue(values[i]); err != nil {
+				break
+			}
+		}
+	} else if op != "prefix" {
+		value, err = documentValue(value)
+	}
+
+	if err != nil {
+		q.err = fmt.Errorf("schemalessql: value of filter %q cannot be encoded as JSON: %w", filterStr, err)
+		return q
+	}
+
+	q.filters = append(q.filters, filter{field, op, value, path})
+	return q
+}
+
+// parsePath splits a field name into the names of a path into the JSON document,
+// nil is returned unless the names consist of letters, digits and underscores.
+func parsePath(field string) []string {
+	path := strings.Split(strings.TrimPrefix(field, "$."), ".")
+	for _, name := range path {
+		if name == "" || strings.IndexFunc(name, func(r rune) bool {
+			return r != '_' && !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		}) >= 0 {
+			return nil
+		}
+	}
+
+	return path
+}
+
+// documentValue converts a value into its representation within JSON documents,
+// one of nil, bool, json.Number, string, []interface{} or map[string]interface{}.
+func documentValue(v interface{}) (interface{}, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	var value interface{}
+	err = dec.Decode(&value)
+	return value, err
+}
+
+// parseFilter splits a filter string into field name and operator.
+func parseFilter(filterStr string) (string, string) {
+	filterStr = strings.TrimSpace(filterStr)
+
+	if parts := strings.Fields(filterStr); len(parts) > 1 {
+		last := strings.ToLower(parts[len(parts)-1])
+		for _, op := range wordOperators {
+			if last == op {
+				return strings.Join(parts[:len(parts)-1], " "), op
+			}
+		}
+	}
+
+	for _, op := range operators {
+		if strings.HasSuffix(filterStr, op) {
+			return strings.TrimSpace(strings.TrimSuffix(filterStr, op)), op
+		}
+	}
+
+	return "", ""
+}
+
+// prefixEnd returns the smallest string that is greater than all strings starting with the prefix.
+func prefixEnd(prefix string) (string, bool) {
+	runes := []rune(prefix)
+	for i := len(runes) - 1; i >= 0; i-- {
+		if runes[i] < utf8.MaxRune {
+			runes[i]++
+			if utf16.IsSurrogate(runes[i]) {
+				runes[i] = 0xe000
+			}
+
+			return string(runes[:i+1]), true
+		}
+	}
+
+	return "", false
+}
+
+// Order returns a derivative query with a field-based sort order.
+// Orders are applied in the order they are added. The default order is ascending, prefixing the field name with "-" sorts in descending order.
+// Entities with equal sort values are ordered by their keys.
+func (q *Query) Order(fieldName string) *Query {
+	q = q.clone()
+
+	fieldName = strings.TrimSpace(fieldName)
+	o := order{field: fieldName}
+	if strings.HasPrefix(fieldName, "-") {
+		o = order{strings.TrimSpace(fieldName[1:]), true}
+	}
+
+	if o.field == "" {
+		q.err = fmt.Errorf("schemalessql: invalid order %q", fieldName)
+		return q
+	}
+
+	q.orders = append(q.orders, o)
+	return q
+}
+
+// Limit returns a derivative query that returns at most limit results.
+// A negative value means unlimited.
+func (q *Query) Limit(limit int) *Query {
+	q = q.clone()
+	q.limit = limit
+	return q
+}
+
+// Offset returns a derivative query that skips the first offset results.
+func (q *Query) Offset(offset int) *Query {
+	q = q.clone()
+	if offset < 0 {
+		q.err = fmt.Errorf("schemalessql: negative offset %v", offset)
+		return q
+	}
+
+	q.offset = offset
+	return q
+}
+
+// Start returns a derivative query that begins after the position of the cursor.
+// The cursor must originate from a query with the same filters and orders.
+func (q *Query) Start(c Cursor) *Query {
+	q = q.clone()
+	q.start = &c
+	if c.id == 0 {
+		q.start = nil
+	}
+
+	return q
+}
+
+// End returns a derivative query that ends with the position of the cursor.
+// The cursor must originate from a query with the same filters and orders.
+func (q *Query) End(c Cursor) *Query {
+	q = q.clone()
+	q.end = &c
+	if c.id == 0 {
+		q.end = nil
+	}
+
+	return q
+}
+
+// Ancestor returns a derivative query that only matches descendants of the entity of the key,
+// i.e. its children, their children and so on, but not the entity itself.
+func (q *Query) Ancestor(key *Key) *Query {
+	q = q.clone()
+	if key == nil || key.Incomplete() {
+		q.err = fmt.Errorf("schemalessql: incomplete ancestor key %v", key)
+		return q
+	}
+
+	q.ancestor = key
+	return q
+}
+
+// indexValue converts a value into the representation stored in the index tables.
+func indexValue(v interface{}) interface{} {
+	switch vi := v.(type) {
+	case time.Time:
+		return vi.UTC()
+	case Key:
+		return vi.Encode()
+	case *Key:
+		if vi == nil {
+			return nil
+		}
+		return vi.Encode()
+	default:
+		return v
+	}
+}
+
+// jsonText encodes a value of a JSON document as an argument of Dialect.JSONValue.
+func jsonText(v interface{}) interface{} {
+	data, _ := json.Marshal(v)
+	return string(data)
+}
+
+// validate checks that the fields of the filters and orders are indexed fields of the kind and that the cursors match the orders.
+func (q *Query) validate(codec map[string]fieldCodec) error {
+	if q.err != nil {
+		return q.err
+	}
+
+	for _, f := range q.filters {
+		if f.path != nil {
+			continue
+		}
+
+		field, found := codec[f.field]
+		if !found || field.noindex {
+			return fmt.Errorf("schemalessql: field %v of kind %v is not indexed", f.field, q.kind)
+		}
+
+		if field.encrypt && f.op != "=" && f.op != "in" {
+			return fmt.Errorf("schemalessql: encrypted field %v of kind %v can only be filtered by equality", f.field, q.kind)
+		}
+
+		if f.op == "prefix" && field.sqltype != "TEXT" {
+			return fmt.Errorf("schemalessql: prefix filter on non-text field %v of kind %v", f.field, q.kind)
+		}
+	}
+
+	for _, o := range q.orders {
+		field, found := codec[o.field]
+		if !found || field.noindex {
+			return fmt.Errorf("schemalessql: field %v of kind %v is not indexed", o.field, q.kind)
+		}
+
+		if field.encrypt {
+			return fmt.Errorf("schemalessql: encrypted field %v of kind %v cannot be ordered", o.field, q.kind)
+		}
+	}
+
+	for _, c := range []*Cursor{q.start, q.end} {
+		if c != nil && len(c.values) != len(q.orders) {
+			return fmt.Errorf("schemalessql: cursor does not match the query orders")
+		}
+	}
+
+	return nil
+}
+
+// compile translates the validated query into a statement selecting the ids, names, parents, sort values and optionally the data of the matching entities and its arguments.
+func (b *sqlBackend) compile(q *Query, data bool) (string, []interface{}) {
+	// the database orders the joins by its statistics of the index tables,
+	// without statistics the filter with the most selective operator drives the query
+	filters := append([]filter(nil), q.filters...)
+	sort.SliceStable(filters, func(i, j int) bool {
+		return selectivity[filters[i].op] < selectivity[filters[j].op]
+	})
+
+	// every used field is joined once
+	aliases := make(map[string]string)
+	from := b.dialect.Quote(EntityTable) + ` AS e`
+	var joins []string
+	join := func(fieldname string) string {
+		if alias, found := aliases[fieldname]; found {
+			return alias
+		}
+
+		alias := "f" + strconv.Itoa(len(aliases))
+		table := b.dialect.Quote(indexTable(q.kind, fieldname)) + ` AS ` + alias
+
+		if len(aliases) == 0 {
+			joins = append(joins, ` INNER JOIN `+from+` ON e.id=`+alias+`.entitiy_id`)
+			from = table
+		} else {
+			joins = append(joins, ` INNER JOIN `+table+` ON `+alias+`.entitiy_id=f0.entitiy_id`)
+		}
+
+		aliases[fieldname] = alias
+		return alias
+	}
+
+	var where []string
+	var args []interface{}
+
+	for _, f := range filters {
+		// values of the document are compared with JSON encoded values instead of index values
+		column, placeholder, value := ``, `?`, indexValue
+		if f.path != nil {
+			column, placeholder, value = b.dialect.JSONExtract(`e.document`, f.path), b.dialect.JSONValue(), jsonText
+		} else {
+			column = join(f.field) + `.value`
+		}
+
+		switch f.op {
+		case "in":
+			values := f.value.([]interface{})
+			if len(values) == 0 {
+				where = append(where, `1=0`)
+				continue
+			}
+
+			placeholders := make([]string, len(values))
+			for i, v := range values {
+				placeholders[i] = placeholder
+				args = append(args, value(v))
+			}
+
+			where = append(where, column+` IN (`+strings.Join(placeholders, `, `)+`)`)
+		case "between":
+			values := f.value.([]interface{})
+			where = append(where, column+` BETWEEN `+placeholder+` AND `+placeholder)
+			args = append(args, value(values[0]), value(values[1]))
+		case "prefix":
+			prefix := f.value.(string)
+			where = append(where, column+`>=`+placeholder)
+			args = append(args, value(prefix))
+
+			if end, ok := prefixEnd(prefix); ok {
+				where = append(where, column+`<`+placeholder)
+				args = append(args, value(end))
+			}
+		default:
+			where = append(where, column+f.op+placeholder)
+			args = append(args, value(f.value))
+		}
+	}
+
+	var orderBy []string
+	columns := make([]string, len(q.orders))
+	for i, o := range q.orders {
+		columns[i] = join(o.field) + `.value`
+		if o.desc {
+			orderBy = append(orderBy, columns[i]+` DESC`)
+		} else {
+			orderBy = append(orderBy, columns[i]+` ASC`)
+		}
+	}
+	orderBy = append(orderBy, `e.id ASC`)
+
+	for _, c := range []*Cursor{q.start, q.end} {
+		if c == nil {
+			continue
+		}
+
+		cond, cargs := c.condition(q.orders, columns, c == q.end)
+		where = append(where, cond)
+		args = append(args, cargs...)
+	}
+
+	where = append(where, `e.kind=?`)
+	args = append(args, q.kind)
+
+	if q.ancestor != nil {
+		joins = append(joins, ` INNER JOIN `+b.dialect.Quote(AncestorTable)+` AS a ON a.entity_id=e.id`)
+		where = append(where, `a.ancestor_id=?`)
+		args = append(args, q.ancestorID)
+	}
+
+	// numeric keys have no name
+	joins = append(joins, ` LEFT JOIN `+b.dialect.Quote(NameTable)+` AS n ON n.entity_id=e.id`)
+
+	selected := append([]string{`e.id`, `COALESCE(n.name, '')`, `COALESCE(e.parent, '')`}, columns...)
+	if data {
+		selected = append(selected, `e.data`, `e.version`, `e.codec`, `e.compression`, `e.key_id`, `e.document`)
+	}
+
+	stmt := `SELECT ` + strings.Join(selected, `, `) + ` FROM ` + from + strings.Join(joins, "") +
+		` WHERE ` + strings.Join(where, ` AND `) +
+		` ORDER BY ` + strings.Join(orderBy, `, `)
+
+	if q.limit >= 0 || q.offset > 0 {
+		limit, largs := b.dialect.Limit(q.limit, q.offset)
+		stmt += limit
+		args = append(args, largs...)
+	}
+
+	return b.dialect.Rebind(stmt), args
+}
+
+// FindAllKeys returns the keys of all entities that match the query.
+func (d *datastore) FindAllKeys(q *Query) ([]*Key, error) {
+	return d.FindAllKeysContext(context.Background(), q)
+}
+
+// FindAllKeysContext is identical to FindAllKeys, but uses the context for the database operations.
+func (d *datastore) FindAllKeysContext(ctx context.Context, q *Query) ([]*Key, error) {
+	keys, _, err := d.FindPageContext(ctx, q)
+	return keys, err
+}
+
+// FindPage is identical to FindAllKeys, but additionally returns a Cursor positioned after the last key.
+// Passing the cursor to Start of the same query continues with the next page of results.
+// If nothing is found, the start cursor of the query is returned.
+func (d *datastore) FindPage(q *Query) ([]*Key, Cursor, error) {
+	return d.FindPageContext(context.Background(), q)
+}
+
+// FindPageContext is identical to FindPage, but uses the context for the database operations.
+func (d *datastore) FindPageContext(ctx context.Context, q *Query) ([]*Key, Cursor, error) {
+	return findPage(d.RunContext(ctx, q))
+}
+
+// findPage reads all keys of the iterator and closes it.
+func findPage(it *Iterator) ([]*Key, Cursor, error) {
+	defer it.Close()
+
+	var result []*Key
+	for {
+		key, err := it.Next(nil)
+		if err == Done {
+			return result, it.Cursor(), nil
+		}
+
+		if err != nil {
+			return nil, it.Cursor(), err
+		}
+
+		result = append(result, key)
+	}
+}
+
+// FindAll appends all entities that match the query to the slice dst points to and returns their keys.
+// The slice may contain structs or pointers to structs. If an error occurs, the entities up to the error have been appended.
+func (d *datastore) FindAll(q *Query, dst interface{}) ([]*Key, error) {
+	return d.FindAllContext(context.Background(), q, dst)
+}
+
+// FindAllContext is identical to FindAll, but uses the context for the database operations and hooks.
+func (d *datastore) FindAllContext(ctx context.Context, q *Query, dst interface{}) ([]*Key, error) {
+	return findAll(d.RunContext(ctx, q), dst)
+}
+
+// findAll appends all entities of the iterator to the slice dst points to and closes the iterator.
+func findAll(it *Iterator, dst interface{}) ([]*Key, error) {
+	defer it.Close()
+
+	slice, t, ptr, err := sliceOf(dst)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []*Key
+	for {
+		e := reflect.New(t)
+		key, err := it.Next(e.Interface())
+		if err == Done {
+			return keys, nil
+		}
+
+		if err != nil {
+			return keys, err
+		}
+
+		if !ptr {
+			e = e.Elem()
+		}
+
+		slice.Set(reflect.Append(slice, e))
+		keys = append(keys, key)
+	}
+}
+
+// sliceOf returns the slice dst points to, the struct type of its elements and whether the elements are pointers.
+func sliceOf(dst interface{}) (reflect.Value, reflect.Type, bool, error) {
+	v := reflect.ValueOf(dst)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Slice {
+		return reflect.Value{}, nil, false, fmt.Errorf("schemalessql: destination must be a pointer to a slice")
+	}
+
+	t := v.Elem().Type().Elem()
+	ptr := t.Kind() == reflect.Ptr
+	if ptr {
+		t = t.Elem()
+	}
+
+	if t.Kind() != reflect.Struct {
+		return reflect.Value{}, nil, false, fmt.Errorf("schemalessql: destination must be a slice of structs or pointers to structs")
+	}
+
+	return v.Elem(), t, ptr, nil
+}
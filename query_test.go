@@ -0,0 +1,178 @@
+package schemalessql_test
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/der-antikeks/schemalessql"
+)
+
+func putEntities(t *testing.T, db schemalessql.Store, n int) ([]Entity, []*schemalessql.Key) {
+	base := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+
+	entities := make([]Entity, n)
+	for i := range entities {
+		entities[i] = Entity{
+			A: int64(i),
+			B: float64(i) / 2,
+			C: i%2 == 0,
+			D: []byte{byte(i)},
+			E: string(rune('a' + i%26)),
+			F: base.Add(time.Duration(i) * time.Minute),
+		}
+	}
+
+	keys, err := db.PutMulti(nil, entities, schemalessql.Atomic)
+	if err != nil {
+		t.Fatalf("error creating entities: %v", err)
+	}
+
+	return entities, keys
+}
+
+func TestQueryFilter(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(t, db)
+
+	_, keys := putEntities(t, db, 10)
+
+	result, err := db.FindAllKeys(db.NewQuery("Entity").Filter("A >", 3).Filter("A <=", 6).Filter("C =", true))
+	if err != nil {
+		t.Fatalf("error finding entities: %v", err)
+	}
+
+	if expected := []*schemalessql.Key{keys[4], keys[6]}; !reflect.DeepEqual(result, expected) {
+		t.Fatalf("error finding entities, keys do not match: \n%v\n%v", expected, result)
+	}
+}
+
+func TestQueryOrder(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(t, db)
+
+	entities, _ := putEntities(t, db, 10)
+
+	var results []Entity
+	if _, err := db.FindAll(db.NewQuery("Entity").Order("-F").Limit(3).Offset(2), &results); err != nil {
+		t.Fatalf("error finding entities: %v", err)
+	}
+
+	if n := len(results); n != 3 {
+		t.Fatalf("error finding entities, number of results: %v", n)
+	}
+
+	for i, r := range results {
+		if e := entities[7-i]; !reflect.DeepEqual(e, r) {
+			t.Fatalf("error finding entities, result does not match: \n%v\n%v", e, r)
+		}
+	}
+}
+
+func TestQueryInvalid(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(t, db)
+
+	putEntities(t, db, 1)
+
+	if _, err := db.FindAllKeys(db.NewQuery("Entity").Filter("A ~", 3)); err == nil {
+		t.Fatalf("should receive error for invalid operator")
+	}
+
+	if _, err := db.FindAllKeys(db.NewQuery("Entity").Filter("IgnoreMe =", 3)); err == nil {
+		t.Fatalf("should receive error for unindexed field")
+	}
+
+	if _, err := db.FindAllKeys(db.NewQuery("Entity").Order("Unknown")); err == nil {
+		t.Fatalf("should receive error for unknown field")
+	}
+}
+
+func TestQueryRange(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(t, db)
+
+	entities, keys := putEntities(t, db, 30)
+	last := entities[29].F
+
+	tests := []struct {
+		query    *schemalessql.Query
+		expected []*schemalessql.Key
+	}{
+		{db.NewQuery("Entity").Filter("A !=", 0).Filter("A <", 3), keys[1:3]},
+		{db.NewQuery("Entity").Filter("B between", []float64{1, 2}), keys[2:5]},
+		{db.NewQuery("Entity").Filter("A in", []int{3, 5, 99}), []*schemalessql.Key{keys[3], keys[5]}},
+		{db.NewQuery("Entity").Filter("A in", []int{}), nil},
+		{db.NewQuery("Entity").Filter("E prefix", "b"), []*schemalessql.Key{keys[1], keys[27]}},
+		{db.NewQuery("Entity").Filter("E prefix", ""), keys},
+		{db.NewQuery("Entity").Filter("F >", last.Add(-time.Hour).In(time.Local)).Filter("F <=", last).Filter("A >=", 27), keys[27:]},
+		{db.NewQuery("Entity").Filter("F between", []time.Time{last.Add(-2 * time.Minute), last}), keys[27:]},
+	}
+
+	for i, test := range tests {
+		result, err := db.FindAllKeys(test.query)
+		if err != nil {
+			t.Fatalf("error finding entities in query %v: %v", i, err)
+		}
+
+		if !reflect.DeepEqual(result, test.expected) {
+			t.Fatalf("error finding entities in query %v, keys do not match: \n%v\n%v", i, test.expected, result)
+		}
+	}
+
+	if _, err := db.FindAllKeys(db.NewQuery("Entity").Filter("A prefix", "1")); err == nil {
+		t.Fatalf("should receive error for prefix filter on non-text field")
+	}
+
+	if _, err := db.FindAllKeys(db.NewQuery("Entity").Filter("A between", []int{1})); err == nil {
+		t.Fatalf("should receive error for between filter with one value")
+	}
+}
+
+func TestIterator(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(t, db)
+
+	entities, keys := putEntities(t, db, 10)
+
+	it := db.Run(db.NewQuery("Entity").Filter("C =", true).Order("-A"))
+	for i := 8; i >= 0; i -= 2 {
+		var r Entity
+		key, err := it.Next(&r)
+		if err != nil {
+			t.Fatalf("error iterating entities: %v", err)
+		}
+
+		if *key != *keys[i] || !reflect.DeepEqual(r, entities[i]) {
+			t.Fatalf("error iterating entities, result does not match: \n%v %v\n%v %v", keys[i], entities[i], key, r)
+		}
+	}
+
+	if _, err := it.Next(nil); err != schemalessql.Done {
+		t.Fatalf("should receive Done after last result but got: %v", err)
+	}
+
+	// close early, keys only
+	it = db.Run(db.NewQuery("Entity"))
+	if key, err := it.Next(nil); err != nil || *key != *keys[0] {
+		t.Fatalf("error iterating keys: %v %v", err, key)
+	}
+
+	var a EntityA
+	if _, err := it.Next(&a); err == nil {
+		t.Fatalf("should receive error for destination of another kind")
+	}
+
+	var h EntityReadHook
+	if _, err := it.Next(&h); err == nil || h.Test {
+		t.Fatalf("should receive error without calling hooks of destination of another kind: %v %v", err, h)
+	}
+
+	if err := it.Close(); err != nil {
+		t.Fatalf("error closing iterator: %v", err)
+	}
+
+	if _, err := it.Next(nil); err != schemalessql.Done {
+		t.Fatalf("should receive Done after closing but got: %v", err)
+	}
+}
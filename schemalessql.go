@@ -1,47 +1,361 @@
 package schemalessql
 
 import (
-	"bytes"
+	"context"
 	"database/sql"
 	"encoding/gob"
+	"errors"
 	"fmt"
 	"reflect"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 )
 
-// Table in which the gob encoded data is stored.
+// Table in which the encoded data is stored.
 var EntityTable = "entities"
 
+// Table in which the fields of all registered kinds are stored.
+var SchemaTable = "schema"
+
+// Table in which the names of application-defined keys are stored.
+var NameTable = "names"
+
+// Table in which the ancestors of all entities with parent keys are stored.
+var AncestorTable = "ancestors"
+
 // Prefix for tables in which the indices are stored.
-// ("IndexPrefix"_fieldname)
+// ("IndexPrefix"_kind_fieldname)
 var IndexPrefix = "index"
 
 // Datatstore contains the database handle and controls the creation of necessary tables.
 type Datastore struct {
 	*sql.DB
+	dialect Dialect
+	datastore
+}
+
+// datastore implements the operations of a Store on top of its backend.
+type datastore struct {
+	backend   backend
 	structure struct {
 		sync.RWMutex
-		created map[reflect.Type]bool
-		codec   map[string]string
+		created map[reflect.Type]string
+		codec   map[string]map[string]fieldCodec
+	}
+	codecs struct {
+		standard Codec
+		kinds    map[string]Codec
+		names    map[string]Codec
+	}
+	compression struct {
+		enabled   bool
+		threshold int
+	}
+	keys       KeyProvider
+	encryption KeyProvider
+}
+
+// init prepares the datastore for the backend and loads its schema.
+func (d *datastore) init(ctx context.Context, b backend, o *options) error {
+	d.backend = b
+	d.structure.created = make(map[reflect.Type]string)
+	d.structure.codec = make(map[string]map[string]fieldCodec)
+
+	d.codecs.standard = o.codec
+	d.codecs.kinds = o.kindCodecs
+	d.codecs.names = make(map[string]Codec)
+	for _, c := range builtinCodecs {
+		d.codecs.names[c.Name()] = c
+	}
+	d.codecs.names[o.codec.Name()] = o.codec
+	for _, c := range o.kindCodecs {
+		d.codecs.names[c.Name()] = c
+	}
+
+	d.compression.enabled = o.compress
+	d.compression.threshold = o.threshold
+	d.keys = o.keys
+	d.encryption = o.encryption
+
+	return d.loadSchema(ctx)
+}
+
+// codecOf returns the codec that encodes entities of the kind.
+func (d *datastore) codecOf(kind string) Codec {
+	if c, found := d.codecs.kinds[kind]; found {
+		return c
+	}
+
+	return d.codecs.standard
+}
+
+// The Kind() method of an entity that satisfies schemalessql.Kinder overrides the name of the struct type as the entity kind.
+type Kinder interface {
+	Kind() string
+}
+
+// KindMismatchError is returned when the kind of a stored entity does not match the kind of the provided struct.
+type KindMismatchError struct {
+	Key       *Key
+	Kind      string
+	Requested string
+}
+
+func (e *KindMismatchError) Error() string {
+	return fmt.Sprintf("schemalessql: entity %v is of kind %v, not %v", e.Key, e.Kind, e.Requested)
+}
+
+// ConflictError is returned when a conditional put expects another version than the stored entity has.
+// It matches ErrConflict with errors.Is.
+type ConflictError struct {
+	Key     *Key
+	Version int64
+	Stored  int64
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("schemalessql: entity %v is at version %v, not %v", e.Key, e.Stored, e.Version)
+}
+
+// Is reports whether the target is ErrConflict.
+func (e *ConflictError) Is(target error) bool {
+	return target == ErrConflict
+}
+
+// ErrConflict is matched by every *ConflictError.
+var ErrConflict = errors.New("schemalessql: entity has been modified concurrently")
+
+// Option configures a Datastore in Open or a MemoryStore in NewMemoryStore.
+type Option func(o *options)
+
+// options are set by the Options, the dialect is ignored by a MemoryStore.
+type options struct {
+	dialect    Dialect
+	codec      Codec
+	kindCodecs map[string]Codec
+	compress   bool
+	threshold  int
+	keys       KeyProvider
+	encryption KeyProvider
+}
+
+// newOptions applies the Options to the defaults.
+func newOptions(opts []Option) *options {
+	o := &options{codec: Gob, kindCodecs: make(map[string]Codec)}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	return o
+}
+
+// WithDialect sets the SQL dialect of the database, overriding the default dialect of the driver.
+func WithDialect(dialect Dialect) Option {
+	return func(o *options) {
+		o.dialect = dialect
+	}
+}
+
+// WithCodec sets the codec that encodes the entities, Gob by default.
+// Previously saved entities are still decoded with the codec they have been encoded with,
+// as long as it is one of the built-in codecs or configured by WithCodec or WithKindCodec.
+func WithCodec(c Codec) Option {
+	return func(o *options) {
+		o.codec = c
+	}
+}
+
+// WithKindCodec sets the codec that encodes the entities of the kind, overriding the codec set by WithCodec.
+func WithKindCodec(kind string, c Codec) Option {
+	return func(o *options) {
+		o.kindCodecs[kind] = c
 	}
 }
 
 // Open opens a database specified by its database driver name and a driver-specific data source name, usually consisting of at least a database name and connection information.
-func Open(driverName, dataSourceName string) (*Datastore, error) {
+// The SQL dialect is chosen by the driver name unless it is set by WithDialect.
+// The entity and schema tables are created if necessary and all previously registered kinds are loaded.
+// Entity tables created by earlier versions are migrated, entities stored before kinds were recorded have an empty kind.
+func Open(driverName, dataSourceName string, opts ...Option) (*Datastore, error) {
+	o := newOptions(opts)
+	d := Datastore{dialect: o.dialect}
+	if d.dialect == nil {
+		d.dialect = dialects[driverName]
+	}
+
+	if d.dialect == nil {
+		return nil, fmt.Errorf("schemalessql: no dialect for driver %v", driverName)
+	}
+
 	db, err := sql.Open(driverName, dataSourceName)
 	if err != nil {
 		return nil, err
 	}
 
-	d := Datastore{DB: db}
-	d.structure.created = make(map[reflect.Type]bool)
-	d.structure.codec = make(map[string]string)
+	d.DB = db
+	b := &sqlBackend{db: db, dialect: d.dialect}
+
+	ctx := context.Background()
+
+	if err := b.setup(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	if err := d.init(ctx, b, o); err != nil {
+		db.Close()
+		return nil, err
+	}
+
 	return &d, nil
 }
 
-// Register creates entitiy and index tables with suitable types.
-func (d *Datastore) Register(src interface{}) error {
+// Dialect returns the SQL dialect of the database.
+func (d *Datastore) Dialect() Dialect {
+	return d.dialect
+}
+
+// loadSchema reads the fields of all registered kinds from the schema table.
+func (d *datastore) loadSchema(ctx context.Context) error {
+	d.structure.Lock()
+	defer d.structure.Unlock()
+
+	schema, err := d.backend.schema(ctx)
+	if err != nil {
+		return fmt.Errorf("schemalessql: could not load schema: %w", err)
+	}
+
+	d.structure.codec = schema
+	return nil
+}
+
+// forget removes the types registered within a rolled back session and reloads the schema.
+func (d *datastore) forget(ctx context.Context, types []reflect.Type) error {
+	if len(types) == 0 {
+		return nil
+	}
+
+	d.structure.Lock()
+	for _, t := range types {
+		delete(d.structure.created, t)
+	}
+	d.structure.Unlock()
+
+	return d.loadSchema(ctx)
+}
+
+// fieldCodec describes how a struct field of a kind is stored.
+type fieldCodec struct {
+	sqltype string
+	noindex bool
+	encrypt bool
+}
+
+// newFieldCodec parses the sql type and the comma separated options of a field.
+func newFieldCodec(sqltype, options string) fieldCodec {
+	f := fieldCodec{sqltype: sqltype}
+	for _, option := range strings.Split(options, ",") {
+		switch option {
+		case "noindex":
+			f.noindex = true
+		case "encrypt":
+			f.encrypt = true
+		}
+	}
+
+	return f
+}
+
+// parseTag parses the comma separated options of a datastore struct tag, e.g. ",encrypt,noindex".
+// The part before the first comma is reserved for the name of the field, it may only be empty or the option "noindex".
+func parseTag(tag string) (fieldCodec, error) {
+	var f fieldCodec
+	parts := strings.Split(tag, ",")
+	if parts[0] != "" && parts[0] != "noindex" {
+		return f, fmt.Errorf("unsupported field name %q", parts[0])
+	}
+
+	for _, option := range parts {
+		switch option {
+		case "":
+		case "noindex":
+			f.noindex = true
+		case "encrypt":
+			f.encrypt = true
+		default:
+			return f, fmt.Errorf("unsupported option %q", option)
+		}
+	}
+
+	return f, nil
+}
+
+// options returns the comma separated options of the field as stored in the schema table.
+func (f fieldCodec) options() string {
+	var options []string
+	if f.noindex {
+		options = append(options, "noindex")
+	}
+
+	if f.encrypt {
+		options = append(options, "encrypt")
+	}
+
+	return strings.Join(options, ",")
+}
+
+// indexTable returns the name of the index table of a field of the kind.
+func indexTable(kind, fieldname string) string {
+	return IndexPrefix + `_` + kind + `_` + fieldname
+}
+
+// kindOf returns the entity kind of a struct type, either its type name or the result of its Kind() method.
+func kindOf(t reflect.Type) (string, error) {
+	if t.Kind() != reflect.Struct {
+		return "", fmt.Errorf("schemalessql: entity must be a struct, not %v", t)
+	}
+
+	kind := t.Name()
+	if k, ok := reflect.New(t).Interface().(Kinder); ok {
+		kind = k.Kind()
+	}
+
+	if kind == "" {
+		return "", fmt.Errorf("schemalessql: could not determine kind of entity %v", t)
+	}
+
+	for _, r := range kind {
+		if !(r == '_' || 'a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9') {
+			return "", fmt.Errorf("schemalessql: invalid kind %q of entity %v", kind, t)
+		}
+	}
+
+	return kind, nil
+}
+
+// Register creates index tables with suitable types and records the fields of the entity in the schema table.
+// An error is returned if the entity is incompatible with the already registered fields of its kind.
+func (d *datastore) Register(src interface{}) error {
+	return d.RegisterContext(context.Background(), src)
+}
+
+// RegisterContext is identical to Register, but uses the context for the database operations.
+func (d *datastore) RegisterContext(ctx context.Context, src interface{}) error {
+	_, err := d.register(ctx, src)
+	return err
+}
+
+// register creates the necessary tables for the type of src and returns its kind.
+func (d *datastore) register(ctx context.Context, src interface{}) (string, error) {
+	return d.registerIn(ctx, nil, src)
+}
+
+// registerIn registers the type of the entity within the session, or within a transaction of its own
+// if the session is nil or the backend cannot create tables within a transaction.
+// Types registered within a session are forgotten if it is rolled back.
+func (d *datastore) registerIn(ctx context.Context, s *session, src interface{}) (string, error) {
 	v := reflect.ValueOf(src)
 	if v.Kind() == reflect.Ptr {
 		v = v.Elem()
@@ -50,98 +364,155 @@ func (d *Datastore) Register(src interface{}) error {
 
 	// check if already registered
 	d.structure.RLock()
-	if d.structure.created[t] {
+	if kind, found := d.structure.created[t]; found {
 		d.structure.RUnlock()
 		// existing type
-		return nil
+		return kind, nil
 	}
 
 	d.structure.RUnlock()
-	d.structure.Lock()
-	defer d.structure.Unlock()
 
-	// new type, create entity table
-	tx, err := d.Begin()
+	kind, err := kindOf(t)
 	if err != nil {
-		return fmt.Errorf("schemalessql: required tables/indices could not be created: %v", err)
+		return "", err
 	}
-	defer tx.Rollback()
 
-	if _, err := tx.Exec(`CREATE TABLE IF NOT EXISTS '` + EntityTable + `' ('id' INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL, 'data' BLOB NOT NULL)`); err != nil {
-		return fmt.Errorf("schemalessql: required tables/indices could not be created: %v", err)
+	// new type, create index tables, within a transaction of its own if tables cannot be created within the session.
+	// The transaction is started before locking the structure, which is locked within transactions as well.
+	own := s == nil || !d.backend.transactionalDDL()
+	if own {
+		if s, err = d.begin(ctx); err != nil {
+			return "", fmt.Errorf("schemalessql: required tables/indices could not be created: %w", err)
+		}
+		defer s.rollback()
 	}
 
-	if _, err := tx.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS 'id_index' ON '` + EntityTable + `' ('id' ASC)`); err != nil {
-		return fmt.Errorf("schemalessql: required tables/indices could not be created: %v", err)
+	d.structure.Lock()
+	defer d.structure.Unlock()
+
+	// registered while waiting for the lock
+	if _, found := d.structure.created[t]; found {
+		return kind, nil
 	}
 
+	registered := d.structure.codec[kind]
+
 	// create index tables for registered reflect.Type
+	fields := make(map[string]fieldCodec)
 	n := t.NumField()
 	for i := 0; i < n; i++ {
 		vt := t.Field(i)
 		vf := v.Field(i)
 
-		// register type for gob
-		if vf.CanInterface() && vf.Interface() != nil {
+		// unexported fields are not encoded
+		if vt.PkgPath != "" {
+			continue
+		}
+
+		// register type for gob, keys are encoded as text and registering both Key and *Key would conflict
+		if vf.CanInterface() && vf.Interface() != nil && vt.Type != keyType && vt.Type != reflect.PtrTo(keyType) {
 			gob.Register(vf.Interface())
 		}
 
-		if vt.Tag.Get("datastore") == "noindex" {
-			continue
+		field, err := parseTag(vt.Tag.Get("datastore"))
+		if err != nil {
+			return "", fmt.Errorf("schemalessql: could not register entity %v, field %v: %w", t, vt.Name, err)
 		}
 
-		var fieldtype string
+		if field.encrypt {
+			if d.keys == nil {
+				return "", fmt.Errorf("schemalessql: could not register entity %v, encrypted field %v requires a key provider", t, vt.Name)
+			}
 
-		switch vf.Interface().(type) {
-		case time.Time:
-			fieldtype = "DATETIME"
-		case []byte:
-			fieldtype = "BLOB"
-		default:
-			switch vf.Kind() {
-			case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-				fieldtype = "INTEGER"
-			case reflect.Float32, reflect.Float64:
-				fieldtype = "FLOAT"
-			case reflect.Bool:
-				fieldtype = "BOOL"
-			case reflect.String:
-				fieldtype = "TEXT"
+			if !encryptable(vt.Type) {
+				return "", fmt.Errorf("schemalessql: could not register entity %v, encrypted field %v must be a string or []byte", t, vt.Name)
+			}
+
+			// the keyed hashes of the values are indexed
+			if !field.noindex {
+				field.sqltype = "BLOB"
+			}
+		} else if !field.noindex {
+			switch vf.Interface().(type) {
+			case time.Time:
+				field.sqltype = "DATETIME"
+			case Key, *Key:
+				// keys are indexed by their encoded representation
+				field.sqltype = "TEXT"
+			case []byte:
+				field.sqltype = "BLOB"
 			default:
-				return fmt.Errorf("schemalessql: unsupported struct field type: %v", vf.Kind())
+				switch vf.Kind() {
+				case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+					field.sqltype = "INTEGER"
+				case reflect.Float32, reflect.Float64:
+					field.sqltype = "FLOAT"
+				case reflect.Bool:
+					field.sqltype = "BOOL"
+				case reflect.String:
+					field.sqltype = "TEXT"
+				default:
+					return "", fmt.Errorf("schemalessql: unsupported struct field type: %v", vf.Kind())
+				}
 			}
 		}
 
 		fieldname := vt.Name
-		tmptype, found := d.structure.codec[fieldname]
+		existing, found := registered[fieldname]
 
-		if found && tmptype != fieldtype {
-			// fieldname already used, with wrong type
-			return fmt.Errorf("schemalessql: could not register entity %v, field %v already registered as %v instead of %v", t, fieldname, tmptype, fieldtype)
+		if found && existing != field {
+			// fieldname already used by this kind, with wrong type or options
+			return "", fmt.Errorf("schemalessql: could not register entity %v, field %v of kind %v already registered as %v (%v) instead of %v (%v)", t, fieldname, kind, existing.sqltype, existing.options(), field.sqltype, field.options())
+		}
+
+		if found {
+			continue
 		}
 
 		// new field
-		if !found {
-			d.structure.codec[fieldname] = fieldtype
+		if err := s.define(kind, fieldname, field); err != nil {
+			return "", fmt.Errorf("schemalessql: could not register entity %v: %w", t, err)
+		}
 
-			if _, err := tx.Exec(`CREATE TABLE IF NOT EXISTS '` + IndexPrefix + `_` + fieldname + `' ('entitiy_id' INTEGER NOT NULL UNIQUE, 'value' ` + fieldtype + `)`); err != nil {
-				return fmt.Errorf("schemalessql: required tables/indices could not be created: %v", err)
-			}
+		fields[fieldname] = field
+	}
 
-			if _, err := tx.Exec(`CREATE INDEX IF NOT EXISTS 'id_value_index' ON '` + IndexPrefix + `_` + fieldname + `' ('entitiy_id' ASC, 'value' ASC)`); err != nil {
-				return fmt.Errorf("schemalessql: required tables/indices could not be created: %v", err)
-			}
+	if own {
+		if err := s.commit(); err != nil {
+			return "", fmt.Errorf("schemalessql: required tables/indices could not be created: %w", err)
 		}
+	} else {
+		s.registered = append(s.registered, t)
 	}
 
-	tx.Commit()
-	d.structure.created[t] = true
-	return nil
+	// replace instead of modify the codec, it might be in use without lock
+	codec := make(map[string]fieldCodec, len(registered)+len(fields))
+	for fieldname, field := range registered {
+		codec[fieldname] = field
+	}
+
+	for fieldname, field := range fields {
+		codec[fieldname] = field
+	}
+
+	d.structure.codec[kind] = codec
+	d.structure.created[t] = kind
+	return kind, nil
 }
 
-// Key is the primary key of a saved Entity
-type Key struct {
-	int64
+// Versioned is satisfied by entities that keep track of their stored version, which is incremented by every put.
+// The version is set by Get, queries and Put. Put replaces the stored entity regardless of its version,
+// PutIfVersion(key, e, e.Version()) fails with a *ConflictError if the stored entity has been modified since e was read.
+type Versioned interface {
+	Version() int64
+	SetVersion(version int64)
+}
+
+// setVersion sets the version of a Versioned entity.
+func setVersion(e interface{}, version int64) {
+	if v, ok := e.(Versioned); ok {
+		v.SetVersion(version)
+	}
 }
 
 // The BeforeSave() method of an entity that satisfies schemalessql.BeforeSaver is called before saving to database.
@@ -154,82 +525,242 @@ type AfterSaver interface {
 	AfterSave()
 }
 
-// Put saves the provided entity gob-encoded into the database and updates the corresponding index tables.
-// An existing entity and its indices will be updated if a non-nil Key is passed.
-// The Key of the updated or created database entry is returned.
-func (d *Datastore) Put(key *Key, src interface{}) (*Key, error) {
-	if bs, ok := src.(BeforeSaver); ok {
+// The BeforeSaveContext() method of an entity that satisfies schemalessql.BeforeSaverContext is called with the context of the operation instead of BeforeSave().
+type BeforeSaverContext interface {
+	BeforeSaveContext(ctx context.Context)
+}
+
+// The AfterSaveContext() method of an entity that satisfies schemalessql.AfterSaverContext is called with the context of the operation instead of AfterSave().
+type AfterSaverContext interface {
+	AfterSaveContext(ctx context.Context)
+}
+
+// beforeSave calls the BeforeSaverContext or BeforeSaver hook of the entity.
+func beforeSave(ctx context.Context, src interface{}) {
+	if bs, ok := src.(BeforeSaverContext); ok {
+		bs.BeforeSaveContext(ctx)
+	} else if bs, ok := src.(BeforeSaver); ok {
 		bs.BeforeSave()
 	}
+}
+
+// afterSave calls the AfterSaverContext or AfterSaver hook of the entity.
+func afterSave(ctx context.Context, src interface{}) {
+	if as, ok := src.(AfterSaverContext); ok {
+		as.AfterSaveContext(ctx)
+	} else if as, ok := src.(AfterSaver); ok {
+		as.AfterSave()
+	}
+}
+
+// MultiMode controls how the *Multi methods handle errors.
+type MultiMode int
+
+const (
+	// StopOnError returns as soon as an error occurs, preceding operations are not undone.
+	StopOnError MultiMode = iota
+
+	// ContinueOnError continues after errors and returns the last one.
+	ContinueOnError
+
+	// Atomic executes all operations within a single transaction and returns as soon as an error occurs.
+	// Either all or none of the operations are applied.
+	Atomic
+)
+
+// Put saves the provided entity encoded by the codec of its kind into the database and updates the corresponding index tables.
+// If a complete Key is passed, the entity is created with this key unless it exists, otherwise it and its indices are updated.
+// The Key must be of the kind of the entity, otherwise a *KindMismatchError is returned.
+// The parent of the Key must exist when the entity is created and must equal the parent of the stored entity when it is updated.
+// The stored entity is replaced regardless of its version, also if the entity is Versioned, see PutIfVersion for conditional puts.
+// The Key of the updated or created database entry is returned.
+func (d *datastore) Put(key *Key, src interface{}) (*Key, error) {
+	return d.PutContext(context.Background(), key, src)
+}
+
+// PutContext is identical to Put, but uses the context for the database operations and hooks.
+func (d *datastore) PutContext(ctx context.Context, key *Key, src interface{}) (*Key, error) {
+	return d.putContext(ctx, key, src, anyVersion)
+}
+
+// putContext saves the entity within a transaction of its own.
+func (d *datastore) putContext(ctx context.Context, key *Key, src interface{}, version int64) (*Key, error) {
+	beforeSave(ctx, src)
+
+	kind, err := d.register(ctx, src)
+	if err != nil {
+		return key, err
+	}
+
+	// begin transaction
+	s, err := d.begin(ctx)
+	if err != nil {
+		return key, fmt.Errorf("schemalessql: could not insert data into db: %w", err)
+	}
+	defer s.rollback()
 
-	if err := d.Register(src); err != nil {
+	nkey, err := d.put(s, kind, key, src, version)
+	if err != nil {
 		return key, err
 	}
 
+	if err := s.commit(); err != nil {
+		return key, fmt.Errorf("schemalessql: could not insert data into db: %w", err)
+	}
+
+	afterSave(ctx, src)
+
+	return nkey, nil
+}
+
+// anyVersion makes put replace the stored entity regardless of its version.
+const anyVersion = -1
+
+// put saves the registered entity and its indices within the session.
+// Unless version is anyVersion, the stored entity must be at this version, 0 meaning it must not exist yet.
+func (d *datastore) put(s *session, kind string, key *Key, src interface{}, version int64) (*Key, error) {
 	// encode data
-	var buffer bytes.Buffer
-	enc := gob.NewEncoder(&buffer)
-	if err := enc.Encode(src); err != nil {
-		return key, fmt.Errorf("schemalessql: could not encode entity: %v", err)
+	encrypted, err := d.encryptFields(kind, src)
+	if err != nil {
+		return key, err
 	}
 
-	// begin transaction
-	tx, err := d.Begin()
+	codec := d.codecOf(kind)
+	data, err := codec.Marshal(encrypted)
 	if err != nil {
-		return key, fmt.Errorf("schemalessql: could not insert data into db: %v", err)
+		return key, fmt.Errorf("schemalessql: could not encode entity: %w", err)
 	}
-	defer tx.Rollback()
 
-	if key == nil {
-		// insert data
-		stmt, err := tx.Prepare(`INSERT INTO '` + EntityTable + `' ('data') VALUES (?)`)
-		if err != nil {
-			return key, fmt.Errorf("schemalessql: could not insert data into db: %v", err)
+	data, compression, err := d.compress(codec, data)
+	if err != nil {
+		return key, fmt.Errorf("schemalessql: could not compress entity: %w", err)
+	}
+
+	if key != nil && key.kind != kind {
+		return key, &KindMismatchError{key, key.kind, kind}
+	}
+
+	var id, stored int64
+	if key == nil || key.Incomplete() {
+		if version > 0 {
+			return key, &ConflictError{key, version, 0}
 		}
-		defer stmt.Close()
 
-		result, err := stmt.Exec(buffer.Bytes())
-		if err != nil {
-			return key, fmt.Errorf("schemalessql: could not insert data into db: %v", err)
+		var parent *Key
+		if key != nil {
+			parent = key.parent
 		}
 
-		id, err := result.LastInsertId()
+		ancestors, err := ancestry(s, parent)
 		if err != nil {
-			return key, fmt.Errorf("schemalessql: could not insert data into db: %v", err)
+			return key, err
+		}
+
+		// insert data
+		if id, err = d.insert(s, entityRow{kind: kind, codec: codec.Name(), compression: compression, parent: parent, ancestors: ancestors}, data); err != nil {
+			return key, err
 		}
 
-		nkey := Key{id}
-		key = &nkey
+		key = &Key{kind: kind, id: id, parent: parent}
 	} else {
-		// update data
-		stmt, err := tx.Prepare(`REPLACE INTO '` + EntityTable + `' ('data', 'id') VALUES (?, ?)`)
-		if err != nil {
-			return key, fmt.Errorf("schemalessql: could not insert data into db: %v", err)
+		// existing entities may only be replaced by entities of the same kind
+		var row entityRow
+		if id, err = rowID(s, key); err == nil {
+			row, err = s.entity(id, false)
+		}
+		if err != nil && err != sql.ErrNoRows {
+			return key, fmt.Errorf("schemalessql: could not insert data into db: %w", err)
+		}
+		stored = row.version
+
+		if err == nil && row.kind != kind {
+			return key, &KindMismatchError{key, row.kind, kind}
+		}
+
+		if err == nil && !row.parent.Equal(key.parent) {
+			return key, fmt.Errorf("schemalessql: entity %v has parent %v, not %v", key, row.parent, key.parent)
 		}
-		defer stmt.Close()
 
-		if _, err := stmt.Exec(buffer.Bytes(), key.int64); err != nil {
-			return key, fmt.Errorf("schemalessql: could not insert data into db: %v", err)
+		if version != anyVersion && version != stored {
+			return key, &ConflictError{key, version, stored}
+		}
+
+		if err == sql.ErrNoRows {
+			ancestors, err := ancestry(s, key.parent)
+			if err != nil {
+				return key, err
+			}
+
+			// insert data with the provided id or name
+			if id, err = d.insert(s, entityRow{id: key.id, name: key.name, kind: kind, codec: codec.Name(), compression: compression, parent: key.parent, ancestors: ancestors}, data); err != nil {
+				return key, err
+			}
+		} else {
+			// update data, by a conditional put only if it has not been modified concurrently
+			encrypted, keyID, err := d.encrypt(kind, id, data)
+			if err != nil {
+				return key, fmt.Errorf("schemalessql: could not encrypt entity: %w", err)
+			}
+
+			row := entityRow{id: id, kind: kind, data: encrypted, codec: codec.Name(), compression: compression, keyID: keyID, version: stored}
+			if version == anyVersion {
+				row.version = anyVersion
+			}
+
+			if updated, err := s.update(row); err != nil {
+				return key, fmt.Errorf("schemalessql: could not insert data into db: %w", err)
+			} else if !updated {
+				current := stored
+				if row, err := s.entity(id, false); err == nil {
+					current = row.version
+				}
+				return key, &ConflictError{key, stored, current}
+			}
+
+			// the version of the row may have been incremented by a concurrent put
+			if _, ok := src.(Versioned); ok && version == anyVersion {
+				if row, err := s.entity(id, false); err == nil {
+					stored = row.version - 1
+				}
+			}
 		}
 	}
 
 	// insert/update indices
-	if err := d.createIndices(key, src, tx); err != nil {
+	if err := d.createIndices(s, id, src); err != nil {
 		return key, err
 	}
 
-	tx.Commit()
+	setVersion(src, stored+1)
 
-	if as, ok := src.(AfterSaver); ok {
-		as.AfterSave()
+	return key, nil
+}
+
+// PutIfVersion is identical to Put, but only saves the entity if the stored entity is at the provided version.
+// A version of 0 requires that no entity is stored for the key yet.
+// Otherwise a *ConflictError is returned, which matches ErrConflict.
+func (d *datastore) PutIfVersion(key *Key, src interface{}, version int64) (*Key, error) {
+	return d.PutIfVersionContext(context.Background(), key, src, version)
+}
+
+// PutIfVersionContext is identical to PutIfVersion, but uses the context for the database operations and hooks.
+func (d *datastore) PutIfVersionContext(ctx context.Context, key *Key, src interface{}, version int64) (*Key, error) {
+	if version < 0 {
+		return key, fmt.Errorf("schemalessql: invalid version %v", version)
 	}
 
-	return key, nil
+	return d.putContext(ctx, key, src, version)
 }
 
 // PutMulti is identical to Put, except that it takes multiple entities and keys.
-// If breakOnError is true the method will return as soon as an error occurs.
-func (d *Datastore) PutMulti(keys []*Key, srcs interface{}, breakOnError bool) ([]*Key, error) {
+// The mode controls whether the entities are saved atomically and how errors are handled.
+// In Atomic mode the provided keys are returned if an error occurs.
+func (d *datastore) PutMulti(keys []*Key, srcs interface{}, mode MultiMode) ([]*Key, error) {
+	return d.PutMultiContext(context.Background(), keys, srcs, mode)
+}
+
+// PutMultiContext is identical to PutMulti, but uses the context for the database operations and hooks.
+func (d *datastore) PutMultiContext(ctx context.Context, keys []*Key, srcs interface{}, mode MultiMode) ([]*Key, error) {
 	vsrcs := reflect.ValueOf(srcs)
 	if vsrcs.Kind() != reflect.Slice {
 		return keys, fmt.Errorf("schemalessql: source must be a slice")
@@ -241,14 +772,18 @@ func (d *Datastore) PutMulti(keys []*Key, srcs interface{}, breakOnError bool) (
 		return keys, fmt.Errorf("schemalessql: keys and source slices must have equal length")
 	}
 
+	if mode == Atomic {
+		return d.putAtomic(ctx, keys, vsrcs)
+	}
+
 	var e error
 	var err error
 	nkeys := make([]*Key, vsrcs.Len())
 
 	for i, key := range keys {
-		nkeys[i], err = d.Put(key, vsrcs.Index(i).Interface())
+		nkeys[i], err = d.PutContext(ctx, key, vsrcs.Index(i).Interface())
 		if err != nil {
-			if breakOnError {
+			if mode == StopOnError {
 				return nkeys, err
 			}
 			e = err
@@ -258,54 +793,93 @@ func (d *Datastore) PutMulti(keys []*Key, srcs interface{}, breakOnError bool) (
 	return nkeys, e
 }
 
-// createIndices inserts new data into the index tables.
-func (d *Datastore) createIndices(key *Key, e interface{}, tx *sql.Tx) error {
+// putAtomic saves all entities within a single transaction.
+func (d *datastore) putAtomic(ctx context.Context, keys []*Key, vsrcs reflect.Value) ([]*Key, error) {
+	kinds := make([]string, vsrcs.Len())
+	for i := range kinds {
+		src := vsrcs.Index(i).Interface()
+		beforeSave(ctx, src)
+
+		var err error
+		if kinds[i], err = d.register(ctx, src); err != nil {
+			return keys, err
+		}
+	}
+
+	s, err := d.begin(ctx)
+	if err != nil {
+		return keys, fmt.Errorf("schemalessql: could not insert data into db: %w", err)
+	}
+	defer s.rollback()
+
+	nkeys := make([]*Key, len(keys))
+	for i, key := range keys {
+		if nkeys[i], err = d.put(s, kinds[i], key, vsrcs.Index(i).Interface(), anyVersion); err != nil {
+			return keys, err
+		}
+	}
+
+	if err := s.commit(); err != nil {
+		return keys, fmt.Errorf("schemalessql: could not insert data into db: %w", err)
+	}
+
+	for i := range nkeys {
+		afterSave(ctx, vsrcs.Index(i).Interface())
+	}
+
+	return nkeys, nil
+}
+
+// createIndices inserts new data of the entity with the row id into the index tables.
+func (d *datastore) createIndices(s *session, id int64, e interface{}) error {
 	v := reflect.ValueOf(e)
 	if v.Kind() == reflect.Ptr {
 		v = v.Elem()
 	}
 
-	codec, err := d.getStructCodec(v)
+	kind, codec, err := d.getStructCodec(v)
 	if err != nil {
 		return err
 	}
 
-	for fieldname, _ := range codec {
-		fieldvalue := v.FieldByName(fieldname)
+	for fieldname, field := range codec {
+		if field.noindex {
+			continue
+		}
 
-		stmt, err := tx.Prepare(`REPLACE INTO '` + IndexPrefix + `_` + fieldname + `' ('entitiy_id', 'value') VALUES (?, ?)`)
-		if err != nil {
-			return fmt.Errorf("schemalessql: could not insert data into db: %v", err)
+		fieldvalue := v.FieldByName(fieldname)
+		if !fieldvalue.IsValid() {
+			// field of another struct type of the same kind
+			continue
 		}
 
-		// TODO: is this necessary?
-		switch vi := fieldvalue.Interface().(type) {
-		default:
-			if _, err := stmt.Exec(key.int64, vi); err != nil {
-				stmt.Close()
-				return fmt.Errorf("schemalessql: could not insert data into db: %v", err)
+		value := indexValue(fieldvalue.Interface())
+		if field.encrypt {
+			if value, err = d.hashValue(kind, fieldname, value); err != nil {
+				return err
 			}
 		}
 
-		stmt.Close()
+		if err := s.index(kind, fieldname, id, value); err != nil {
+			return fmt.Errorf("schemalessql: could not insert data into db: %w", err)
+		}
 	}
 
 	return nil
 }
 
-// getStructCodec returns the structure of the provided value if it has been registered before.
-func (d *Datastore) getStructCodec(v reflect.Value) (map[string]string, error) {
+// getStructCodec returns the kind and structure of the provided value if it has been registered before.
+func (d *datastore) getStructCodec(v reflect.Value) (string, map[string]fieldCodec, error) {
 	t := v.Type()
 
 	d.structure.RLock()
 	defer d.structure.RUnlock()
 
-	// TODO: return only codec of type
-	if d.structure.created[t] {
-		return d.structure.codec, nil
+	if kind, found := d.structure.created[t]; found {
+		return kind, d.structure.codec[kind], nil
 	}
 
-	return nil, fmt.Errorf("schemalessql: unknown entity type %v", t)
+	return "", nil, fmt.Errorf("schemalessql: unknown entity type %v", t)
 }
 
 // The BeforeLoad() method of an entity that satisfies schemalessql.BeforeLoader is called before it will be filled with data.
@@ -318,53 +892,135 @@ type AfterLoader interface {
 	AfterLoad()
 }
 
-// Get fetches an entity with the Key and gob-decodes it into the provided interface.
+// The BeforeLoadContext() method of an entity that satisfies schemalessql.BeforeLoaderContext is called with the context of the operation instead of BeforeLoad().
+type BeforeLoaderContext interface {
+	BeforeLoadContext(ctx context.Context)
+}
+
+// The AfterLoadContext() method of an entity that satisfies schemalessql.AfterLoaderContext is called with the context of the operation instead of AfterLoad().
+type AfterLoaderContext interface {
+	AfterLoadContext(ctx context.Context)
+}
+
+// beforeLoad calls the BeforeLoaderContext or BeforeLoader hook of the entity.
+func beforeLoad(ctx context.Context, dst interface{}) {
+	if bl, ok := dst.(BeforeLoaderContext); ok {
+		bl.BeforeLoadContext(ctx)
+	} else if bl, ok := dst.(BeforeLoader); ok {
+		bl.BeforeLoad()
+	}
+}
+
+// afterLoad calls the AfterLoaderContext or AfterLoader hook of the entity.
+func afterLoad(ctx context.Context, dst interface{}) {
+	if al, ok := dst.(AfterLoaderContext); ok {
+		al.AfterLoadContext(ctx)
+	} else if al, ok := dst.(AfterLoader); ok {
+		al.AfterLoad()
+	}
+}
+
+// Get fetches an entity with the Key and decodes it into the provided interface.
 // If no entry is found for this Key, sql.ErrNoRows is returned.
-func (d *Datastore) Get(key *Key, dst interface{}) error {
+// If the entity is of another kind than the provided interface, a *KindMismatchError is returned.
+func (d *datastore) Get(key *Key, dst interface{}) error {
+	return d.GetContext(context.Background(), key, dst)
+}
+
+// GetContext is identical to Get, but uses the context for the database operations and hooks.
+func (d *datastore) GetContext(ctx context.Context, key *Key, dst interface{}) error {
 	if key == nil {
 		return sql.ErrNoRows
 	}
 
-	if bl, ok := dst.(BeforeLoader); ok {
-		bl.BeforeLoad()
+	beforeLoad(ctx, dst)
+
+	kind, err := d.register(ctx, dst)
+	if err != nil {
+		return err
 	}
 
-	if err := d.Register(dst); err != nil {
+	if err := d.get(d.backend.reader(ctx), kind, key, dst); err != nil {
 		return err
 	}
 
-	// fetch gob encoded data
-	stmt, err := d.Prepare(`SELECT data FROM '` + EntityTable + `' WHERE id=?`)
-	if err != nil {
-		return fmt.Errorf("schemalessql: could not query data from db: %v", err)
+	afterLoad(ctx, dst)
+
+	return nil
+}
+
+// get fetches and decodes the entity of the registered kind.
+func (d *datastore) get(r reader, kind string, key *Key, dst interface{}) error {
+	if key.kind != kind {
+		return &KindMismatchError{key, key.kind, kind}
 	}
-	defer stmt.Close()
 
-	var data string
-	if err := stmt.QueryRow(key.int64).Scan(&data); err != nil {
+	// fetch encoded data
+	var row entityRow
+	id, err := rowID(r, key)
+	if err == nil {
+		row, err = r.entity(id, true)
+	}
+	if err != nil {
 		if err == sql.ErrNoRows {
 			return err
 		}
 
-		return fmt.Errorf("schemalessql: could not query data from db: %v", err)
+		return fmt.Errorf("schemalessql: could not query data from db: %w", err)
 	}
 
-	// decode data
-	dec := gob.NewDecoder(bytes.NewBufferString(data))
-	if err := dec.Decode(dst); err != nil {
-		return fmt.Errorf("schemalessql: could not decode entity: %v", err)
+	if row.kind != kind {
+		return &KindMismatchError{key, row.kind, kind}
 	}
 
-	if al, ok := dst.(AfterLoader); ok {
-		al.AfterLoad()
+	// names are unique within the kind, the entity of the name may have another parent
+	if !row.parent.Equal(key.parent) {
+		return sql.ErrNoRows
+	}
+
+	if err := d.decode(row, dst); err != nil {
+		return err
+	}
+
+	setVersion(dst, row.version)
+	return nil
+}
+
+// decode fills the provided interface with the data of the row, which is decrypted, decompressed and decoded by the codec of the row.
+func (d *datastore) decode(row entityRow, dst interface{}) error {
+	c, found := d.codecs.names[row.codec]
+	if !found {
+		return fmt.Errorf("schemalessql: unknown codec %v", row.codec)
+	}
+
+	data, err := d.decrypt(row)
+	if err != nil {
+		return fmt.Errorf("schemalessql: could not decrypt entity: %w", err)
+	}
+
+	if data, err = decompress(row.compression, data); err != nil {
+		return fmt.Errorf("schemalessql: could not decompress entity: %w", err)
+	}
+
+	if err := c.Unmarshal(data, dst); err != nil {
+		return fmt.Errorf("schemalessql: could not decode entity: %w", err)
+	}
+
+	if err := d.decryptFields(row.kind, dst); err != nil {
+		return err
 	}
 
 	return nil
 }
 
 // GetMulti is identical to Get, except that it takes multiple keys.
-// If breakOnError is true the method will return as soon as an error occurs.
-func (d *Datastore) GetMulti(keys []*Key, dsts interface{}, breakOnError bool) error {
+// The mode controls whether the entities are read within a single transaction and how errors are handled.
+func (d *datastore) GetMulti(keys []*Key, dsts interface{}, mode MultiMode) error {
+	return d.GetMultiContext(context.Background(), keys, dsts, mode)
+}
+
+// GetMultiContext is identical to GetMulti, but uses the context for the database operations and hooks.
+func (d *datastore) GetMultiContext(ctx context.Context, keys []*Key, dsts interface{}, mode MultiMode) error {
 	vdsts := reflect.ValueOf(dsts)
 	if vdsts.Kind() != reflect.Slice {
 		return fmt.Errorf("schemalessql: destination must be a slice")
@@ -374,80 +1030,213 @@ func (d *Datastore) GetMulti(keys []*Key, dsts interface{}, breakOnError bool) e
 		return fmt.Errorf("schemalessql: keys and destination slices must have equal length")
 	}
 
+	if mode == Atomic {
+		return d.getAtomic(ctx, keys, vdsts)
+	}
+
 	var e error
 	for i, key := range keys {
-
-		// TODO: wtf am i doing here?
-		switch vi := vdsts.Index(i).Addr().Interface().(type) {
-		default:
-			err := d.Get(key, vi)
-			if err != nil {
-				if breakOnError {
-					return err
-				}
-				e = err
+		err := d.GetContext(ctx, key, vdsts.Index(i).Addr().Interface())
+		if err != nil {
+			if mode == StopOnError {
+				return err
 			}
+			e = err
 		}
-
 	}
 
 	return e
 }
 
-// Delete removes the entity of the provided Key and its indices from the database.
+// getAtomic reads all entities within a single transaction.
+func (d *datastore) getAtomic(ctx context.Context, keys []*Key, vdsts reflect.Value) error {
+	kinds := make([]string, len(keys))
+	for i := range kinds {
+		var err error
+		if kinds[i], err = d.register(ctx, vdsts.Index(i).Addr().Interface()); err != nil {
+			return err
+		}
+	}
+
+	s, err := d.begin(ctx)
+	if err != nil {
+		return fmt.Errorf("schemalessql: could not query data from db: %w", err)
+	}
+	defer s.rollback()
+
+	for i, key := range keys {
+		if key == nil {
+			return sql.ErrNoRows
+		}
+
+		dst := vdsts.Index(i).Addr().Interface()
+		beforeLoad(ctx, dst)
+
+		if err := d.get(s, kinds[i], key, dst); err != nil {
+			return err
+		}
+
+		afterLoad(ctx, dst)
+	}
+
+	return s.commit()
+}
+
+// Delete removes the entity of the provided Key and its indices of the same kind from the database.
+// Descendants of the entity are kept, see DeleteCascade.
 // If no entry is found for this Key, sql.ErrNoRows is returned.
-func (d *Datastore) Delete(key *Key) error {
+// If the stored entity is of another kind than the Key, a *KindMismatchError is returned.
+func (d *datastore) Delete(key *Key) error {
+	return d.DeleteContext(context.Background(), key)
+}
+
+// DeleteContext is identical to Delete, but uses the context for the database operations.
+func (d *datastore) DeleteContext(ctx context.Context, key *Key) error {
+	return d.deleteContext(ctx, key, false)
+}
+
+// DeleteCascade is identical to Delete, but additionally removes all descendants of the entity within the same transaction.
+func (d *datastore) DeleteCascade(key *Key) error {
+	return d.DeleteCascadeContext(context.Background(), key)
+}
+
+// DeleteCascadeContext is identical to DeleteCascade, but uses the context for the database operations.
+func (d *datastore) DeleteCascadeContext(ctx context.Context, key *Key) error {
+	return d.deleteContext(ctx, key, true)
+}
+
+// deleteContext removes the entity within a transaction of its own.
+func (d *datastore) deleteContext(ctx context.Context, key *Key, cascade bool) error {
 	if key == nil {
 		return sql.ErrNoRows
 	}
 
-	tx, err := d.Begin()
+	s, err := d.begin(ctx)
 	if err != nil {
-		return fmt.Errorf("schemalessql: could not delete data from db: %v", err)
+		return fmt.Errorf("schemalessql: could not delete data from db: %w", err)
 	}
-	defer tx.Rollback()
+	defer s.rollback()
 
-	stmt, err := tx.Prepare(`DELETE FROM '` + EntityTable + `' WHERE id=?`)
-	if err != nil {
-		return fmt.Errorf("schemalessql: could not delete data from db: %v", err)
+	if err := d.delete(s, key, cascade); err != nil {
+		return err
 	}
-	defer stmt.Close()
 
-	if _, err := stmt.Exec(key.int64); err != nil {
-		return fmt.Errorf("schemalessql: could not delete data from db: %v", err)
+	if err := s.commit(); err != nil {
+		return fmt.Errorf("schemalessql: could not delete data from db: %w", err)
 	}
 
-	d.structure.RLock()
-	defer d.structure.RUnlock()
+	return nil
+}
 
-	// structure.codec = map[string]string
-	for fieldname, _ := range d.structure.codec {
+// delete removes the entity and its indices within the session, and all of its descendants if cascade is set.
+func (d *datastore) delete(s *session, key *Key, cascade bool) error {
+	if key == nil {
+		return sql.ErrNoRows
+	}
 
-		stmt, err := tx.Prepare(`DELETE FROM '` + IndexPrefix + `_` + fieldname + `' WHERE entitiy_id=?`)
+	var row entityRow
+	id, err := rowID(s, key)
+	if err == nil {
+		row, err = s.entity(id, false)
+	}
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return err
+		}
+
+		return fmt.Errorf("schemalessql: could not delete data from db: %w", err)
+	}
+
+	if row.kind != key.kind {
+		return &KindMismatchError{key, row.kind, key.kind}
+	}
+
+	if !row.parent.Equal(key.parent) {
+		return sql.ErrNoRows
+	}
+
+	rows := []entityRow{row}
+	if cascade {
+		descendants, err := s.descendants(id)
 		if err != nil {
-			return fmt.Errorf("schemalessql: could not delete data from db: %v", err)
+			return fmt.Errorf("schemalessql: could not delete data from db: %w", err)
 		}
-		defer stmt.Close()
 
-		if _, err := stmt.Exec(key.int64); err != nil {
-			return fmt.Errorf("schemalessql: could not delete data from db: %v", err)
+		for _, descendant := range descendants {
+			row, err := s.entity(descendant, false)
+			if err != nil {
+				return fmt.Errorf("schemalessql: could not delete data from db: %w", err)
+			}
+			rows = append(rows, row)
 		}
+	}
 
+	for _, row := range rows {
+		if err := d.deleteRow(s, row); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// deleteRow removes the row of the entity and its indices within the session.
+func (d *datastore) deleteRow(s *session, row entityRow) error {
+	if err := s.remove(row.id); err != nil {
+		return fmt.Errorf("schemalessql: could not delete data from db: %w", err)
+	}
+
+	d.structure.RLock()
+	codec := d.structure.codec[row.kind]
+	d.structure.RUnlock()
+
+	for fieldname, field := range codec {
+		if field.noindex {
+			continue
+		}
+
+		if err := s.unindex(row.kind, fieldname, row.id); err != nil {
+			return fmt.Errorf("schemalessql: could not delete data from db: %w", err)
+		}
 	}
 
-	tx.Commit()
 	return nil
 }
 
 // DeleteMulti is identical to Delete, except that it takes multiple keys.
-// If breakOnError is true the method will return as soon as an error occurs.
-func (d *Datastore) DeleteMulti(keys []*Key, breakOnError bool) error {
+// The mode controls whether the entities are deleted atomically and how errors are handled.
+func (d *datastore) DeleteMulti(keys []*Key, mode MultiMode) error {
+	return d.DeleteMultiContext(context.Background(), keys, mode)
+}
+
+// DeleteMultiContext is identical to DeleteMulti, but uses the context for the database operations.
+func (d *datastore) DeleteMultiContext(ctx context.Context, keys []*Key, mode MultiMode) error {
+	if mode == Atomic {
+		s, err := d.begin(ctx)
+		if err != nil {
+			return fmt.Errorf("schemalessql: could not delete data from db: %w", err)
+		}
+		defer s.rollback()
+
+		for _, key := range keys {
+			if err := d.delete(s, key, false); err != nil {
+				return err
+			}
+		}
+
+		if err := s.commit(); err != nil {
+			return fmt.Errorf("schemalessql: could not delete data from db: %w", err)
+		}
+
+		return nil
+	}
+
 	var e error
 
 	for _, key := range keys {
-		err := d.Delete(key)
+		err := d.DeleteContext(ctx, key)
 		if err != nil {
-			if breakOnError {
+			if mode == StopOnError {
 				return err
 			}
 			e = err
@@ -457,96 +1246,102 @@ func (d *Datastore) DeleteMulti(keys []*Key, breakOnError bool) error {
 	return e
 }
 
-// FindKeys searches indexed fields for all entries that match the filter criteria and returns its keys.
-// If no entry is found, sql.ErrNoRows is returned.
-func (d *Datastore) FindKeys(query map[string]interface{}) ([]*Key, error) {
-	tmp := make(map[int64]int)
+// FindKeys searches indexed fields for all entries of the kind that match the filter criteria and returns its keys.
+// The criteria are combined within the database, which evaluates the most selective fields first if it has statistics of the index tables,
+// e.g. gathered by ANALYZE on SQLite.
+// If a field is not indexed, sql.ErrNoRows is returned.
+func (d *datastore) FindKeys(kind string, query map[string]interface{}) ([]*Key, error) {
+	return d.FindKeysContext(context.Background(), kind, query)
+}
 
-	for fieldname, value := range query {
-		// TODO: is this safe for concurrent use? I bet not
-		if _, found := d.structure.codec[fieldname]; !found {
-			//continue
-			return nil, sql.ErrNoRows
-		}
+// FindKeysContext is identical to FindKeys, but uses the context for the database operations.
+func (d *datastore) FindKeysContext(ctx context.Context, kind string, query map[string]interface{}) ([]*Key, error) {
+	q, err := d.mapQuery(kind, query)
+	if err != nil {
+		return nil, err
+	}
 
-		stmt, err := d.Prepare(`SELECT entitiy_id FROM '` + IndexPrefix + `_` + fieldname + `' WHERE value=?`)
-		if err != nil {
-			return nil, fmt.Errorf("schemalessql: could not query data from db: %v", err)
-		}
-		defer stmt.Close()
+	return d.FindAllKeysContext(ctx, q)
+}
 
-		rows, err := stmt.Query(value)
-		if err != nil {
-			if err == sql.ErrNoRows {
-				return nil, err
-			}
+// mapQuery converts the filter criteria into a Query of equality filters.
+func (d *datastore) mapQuery(kind string, query map[string]interface{}) (*Query, error) {
+	q := d.NewQuery(kind)
 
-			return nil, fmt.Errorf("schemalessql: could not query data from db: %v", err)
-		}
+	d.structure.RLock()
+	defer d.structure.RUnlock()
 
-		for rows.Next() {
-			var id int64
-			rows.Scan(&id)
-			tmp[id]++
-		}
+	// in the same order for the same criteria
+	fieldnames := make([]string, 0, len(query))
+	for fieldname := range query {
+		fieldnames = append(fieldnames, fieldname)
 	}
+	sort.Strings(fieldnames)
 
-	l := len(query)
-	var result []*Key
-
-	for i, n := range tmp {
-		if n == l {
-			result = append(result, &Key{i})
+	for _, fieldname := range fieldnames {
+		if field, found := d.structure.codec[kind][fieldname]; !found || field.noindex {
+			return nil, sql.ErrNoRows
 		}
+
+		q = q.Filter(fieldname+" =", query[fieldname])
 	}
 
-	return result, nil
+	return q, nil
 }
 
-// Find searches indexed fields for all entries that match the filter criteria and returns these as a slice of the provided interface.
-// If no entry is found, sql.ErrNoRows is returned.
-func (d *Datastore) Find(query map[string]interface{}, destype interface{}) ([]interface{}, error) {
-	vdestype := reflect.ValueOf(destype)
-	if vdestype.Kind() != reflect.Struct {
-		return nil, fmt.Errorf("schemalessql: destination type must be a struct")
-	}
+// Find searches indexed fields for all entries that match the filter criteria and appends these to the slice dst points to.
+// The slice may contain structs or pointers to structs, whose kind is searched. The keys of the appended entities are returned.
+// If a field is not indexed, sql.ErrNoRows is returned.
+func (d *datastore) Find(query map[string]interface{}, dst interface{}) ([]*Key, error) {
+	return d.FindContext(context.Background(), query, dst)
+}
 
-	keys, err := d.FindKeys(query)
+// FindContext is identical to Find, but uses the context for the database operations and hooks.
+func (d *datastore) FindContext(ctx context.Context, query map[string]interface{}, dst interface{}) ([]*Key, error) {
+	_, t, _, err := sliceOf(dst)
 	if err != nil {
 		return nil, err
 	}
 
-	var dsts []interface{}
-	for _, key := range keys {
-
-		// I must admit that I have no idea why I can not directly pass the value instead of the pointer
-		// TODO: panic: reflect: NumField of non-struct type @ Register() :84
-		//e := reflect.Zero(vdestype.Type()).Interface()
-		e := reflect.New(vdestype.Type()).Interface()
-		err := d.Get(key, e /* & */)
-		if err != nil {
-			return nil, err
-		}
+	kind, err := kindOf(t)
+	if err != nil {
+		return nil, err
+	}
 
-		//dsts = append(dsts, e)
-		dsts = append(dsts, reflect.ValueOf(e).Elem().Interface())
+	q, err := d.mapQuery(kind, query)
+	if err != nil {
+		return nil, err
 	}
 
-	return dsts, nil
+	return d.FindAllContext(ctx, q, dst)
+}
+
+// FindOne is identical to Find, except that it fills only one entity into the struct dst points to.
+// If no entry is found, sql.ErrNoRows is returned.
+func (d *datastore) FindOne(query map[string]interface{}, dst interface{}) error {
+	return d.FindOneContext(context.Background(), query, dst)
 }
 
-// FindOne is identical to Find, except that it returns only one entity.
-func (d *Datastore) FindOne(query map[string]interface{}, dst interface{}) error {
-	keys, err := d.FindKeys(query)
+// FindOneContext is identical to FindOne, but uses the context for the database operations and hooks.
+func (d *datastore) FindOneContext(ctx context.Context, query map[string]interface{}, dst interface{}) error {
+	kind, err := kindOf(reflect.Indirect(reflect.ValueOf(dst)).Type())
 	if err != nil {
 		return err
 	}
 
-	if len(keys) < 1 {
-		return sql.ErrNoRows
+	q, err := d.mapQuery(kind, query)
+	if err != nil {
+		return err
 	}
 
-	if err := d.Get(keys[0], dst); err != nil {
+	it := d.RunContext(ctx, q.Limit(1))
+	defer it.Close()
+
+	if _, err := it.Next(dst); err != nil {
+		if err == Done {
+			return sql.ErrNoRows
+		}
+
 		return err
 	}
 
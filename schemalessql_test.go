@@ -22,7 +22,12 @@ type Entity struct {
 }
 
 func newDB(t *testing.T) *schemalessql.Datastore {
-	db, err := schemalessql.Open("sqlite3", ":memory:")
+	driver, dsn := "sqlite3", ":memory:"
+	if testDialect != "sqlite3" {
+		driver, dsn = testDSN(t)
+	}
+
+	db, err := schemalessql.Open(driver, dsn)
 	if err != nil {
 		t.Fatalf("error connecting to database: %v", err)
 	}
@@ -40,7 +45,7 @@ func TestRegisterStruct(t *testing.T) {
 	db := newDB(t)
 	defer closeDB(t, db)
 
-	a := Entity{123, 123.456, true, []byte{12, 34, 56}, "foo", time.Now(), time.Duration(3) * time.Minute}
+	a := Entity{123, 123.456, true, []byte{12, 34, 56}, "foo", time.Now().Round(0), time.Duration(3) * time.Minute}
 	if err := db.Register(a); err != nil {
 		t.Fatalf("error registering entity: %v", err)
 	}
@@ -64,6 +69,14 @@ type EntityB struct {
 	Data string
 }
 
+type EntityRenamedB struct {
+	Data string
+}
+
+func (e EntityRenamedB) Kind() string {
+	return "EntityA"
+}
+
 func TestRegisterDuplicate(t *testing.T) {
 	db := newDB(t)
 	defer closeDB(t, db)
@@ -74,8 +87,44 @@ func TestRegisterDuplicate(t *testing.T) {
 	}
 
 	var b EntityB
-	if err := db.Register(&b); err == nil {
-		t.Fatalf("should receive error while registering entity b but got: %v", err)
+	if err := db.Register(&b); err != nil {
+		t.Fatalf("error registering entity b: %v", err)
+	}
+
+	var c EntityRenamedB
+	if err := db.Register(&c); err == nil {
+		t.Fatalf("should receive error while registering entity c but got: %v", err)
+	}
+}
+
+func TestQueryDuplicate(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(t, db)
+
+	akey, err := db.Put(nil, EntityA{1.5})
+	if err != nil {
+		t.Fatalf("error creating entity: %v", err)
+	}
+
+	if _, err := db.Put(nil, EntityB{"foo"}); err != nil {
+		t.Fatalf("error creating entity: %v", err)
+	}
+
+	var r EntityB
+	if err := db.FindOne(map[string]interface{}{"Data": "foo"}, &r); err != nil || r.Data != "foo" {
+		t.Fatalf("error finding entity: %v %v", err, r)
+	}
+
+	if err := db.Delete(akey); err != nil {
+		t.Fatalf("error deleting entity: %v", err)
+	}
+
+	if err := db.FindOne(map[string]interface{}{"Data": "foo"}, &r); err != nil {
+		t.Fatalf("error finding entity after deleting entity of another kind: %v", err)
+	}
+
+	if keys, err := db.FindKeys("EntityA", map[string]interface{}{"Data": 1.5}); err != nil || len(keys) != 0 {
+		t.Fatalf("error finding deleted entity: %v %v", err, keys)
 	}
 }
 
@@ -83,7 +132,7 @@ func TestCreate(t *testing.T) {
 	db := newDB(t)
 	defer closeDB(t, db)
 
-	e := Entity{123, 123.456, true, []byte{12, 34, 56}, "foo", time.Now(), time.Duration(3) * time.Minute}
+	e := Entity{123, 123.456, true, []byte{12, 34, 56}, "foo", time.Now().Round(0), time.Duration(3) * time.Minute}
 	if _, err := db.Put(nil, e); err != nil {
 		t.Fatalf("error creating entity: %v", err)
 	}
@@ -93,7 +142,7 @@ func TestRead(t *testing.T) {
 	db := newDB(t)
 	defer closeDB(t, db)
 
-	e := Entity{123, 123.456, true, []byte{12, 34, 56}, "foo", time.Now(), time.Duration(3) * time.Minute}
+	e := Entity{123, 123.456, true, []byte{12, 34, 56}, "foo", time.Now().Round(0), time.Duration(3) * time.Minute}
 	key, err := db.Put(nil, e)
 	if err != nil {
 		t.Fatalf("error creating entity: %v", err)
@@ -113,7 +162,7 @@ func TestUpdate(t *testing.T) {
 	db := newDB(t)
 	defer closeDB(t, db)
 
-	e := Entity{123, 123.456, true, []byte{12, 34, 56}, "foo", time.Now(), time.Duration(3) * time.Minute}
+	e := Entity{123, 123.456, true, []byte{12, 34, 56}, "foo", time.Now().Round(0), time.Duration(3) * time.Minute}
 	key, err := db.Put(nil, e)
 	if err != nil {
 		t.Fatalf("error creating entity: %v", err)
@@ -121,7 +170,7 @@ func TestUpdate(t *testing.T) {
 
 	u := e
 	u.E = "updated data"
-	u.F = time.Now().Add(e.IgnoreMe.(time.Duration))
+	u.F = time.Now().Round(0).Add(e.IgnoreMe.(time.Duration))
 	if _, err := db.Put(key, u); err != nil {
 		t.Fatalf("error updating entity: %v", err)
 	}
@@ -140,7 +189,7 @@ func TestDelete(t *testing.T) {
 	db := newDB(t)
 	defer closeDB(t, db)
 
-	e := Entity{123, 123.456, true, []byte{12, 34, 56}, "foo", time.Now(), time.Duration(3) * time.Minute}
+	e := Entity{123, 123.456, true, []byte{12, 34, 56}, "foo", time.Now().Round(0), time.Duration(3) * time.Minute}
 	key, err := db.Put(nil, e)
 	if err != nil {
 		t.Fatalf("error creating entity: %v", err)
@@ -161,11 +210,11 @@ func TestCreateMulti(t *testing.T) {
 	defer closeDB(t, db)
 
 	entities := []interface{}{
-		Entity{123, 123.456, true, []byte{12, 34, 56}, "foo", time.Now(), time.Duration(3) * time.Minute},
+		Entity{123, 123.456, true, []byte{12, 34, 56}, "foo", time.Now().Round(0), time.Duration(3) * time.Minute},
 		Entity{456, 456.789, false, []byte{21, 43, 65}, "bar", time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC), time.Duration(10) * time.Second},
 	}
 
-	if _, err := db.PutMulti(nil, entities, true); err != nil {
+	if _, err := db.PutMulti(nil, entities, schemalessql.StopOnError); err != nil {
 		t.Fatalf("error creating entities: %v", err)
 	}
 }
@@ -175,17 +224,17 @@ func TestReadMulti(t *testing.T) {
 	defer closeDB(t, db)
 
 	entities := []Entity{
-		Entity{123, 123.456, true, []byte{12, 34, 56}, "foo", time.Now(), time.Duration(3) * time.Minute},
+		Entity{123, 123.456, true, []byte{12, 34, 56}, "foo", time.Now().Round(0), time.Duration(3) * time.Minute},
 		Entity{456, 456.789, false, []byte{21, 43, 65}, "bar", time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC), time.Duration(10) * time.Second},
 	}
 
-	keys, err := db.PutMulti(nil, entities, true)
+	keys, err := db.PutMulti(nil, entities, schemalessql.StopOnError)
 	if err != nil {
 		t.Fatalf("error creating entities: %v", err)
 	}
 
 	results := make([]Entity, len(keys))
-	if err := db.GetMulti(keys, results, true); err != nil {
+	if err := db.GetMulti(keys, results, schemalessql.StopOnError); err != nil {
 		t.Fatalf("error reading entities: %v", err)
 	}
 
@@ -201,11 +250,11 @@ func TestUpdateMulti(t *testing.T) {
 	defer closeDB(t, db)
 
 	entities := []Entity{
-		Entity{123, 123.456, true, []byte{12, 34, 56}, "foo", time.Now(), time.Duration(3) * time.Minute},
+		Entity{123, 123.456, true, []byte{12, 34, 56}, "foo", time.Now().Round(0), time.Duration(3) * time.Minute},
 		Entity{456, 456.789, false, []byte{21, 43, 65}, "bar", time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC), time.Duration(10) * time.Second},
 	}
 
-	keys, err := db.PutMulti(nil, entities, true)
+	keys, err := db.PutMulti(nil, entities, schemalessql.StopOnError)
 	if err != nil {
 		t.Fatalf("error creating entities: %v", err)
 	}
@@ -214,15 +263,15 @@ func TestUpdateMulti(t *testing.T) {
 	copy(updated, entities)
 
 	updated[0].E = "updated data"
-	updated[0].F = time.Now().Add(updated[0].IgnoreMe.(time.Duration))
+	updated[0].F = time.Now().Round(0).Add(updated[0].IgnoreMe.(time.Duration))
 	updated[1].E = "updated data2"
-	updated[1].F = time.Now().Add(updated[1].IgnoreMe.(time.Duration))
-	if _, err := db.PutMulti(keys, updated, true); err != nil {
+	updated[1].F = time.Now().Round(0).Add(updated[1].IgnoreMe.(time.Duration))
+	if _, err := db.PutMulti(keys, updated, schemalessql.StopOnError); err != nil {
 		t.Fatalf("error updating entity: %v", err)
 	}
 
 	results := make([]Entity, len(keys))
-	if err := db.GetMulti(keys, results, true); err != nil {
+	if err := db.GetMulti(keys, results, schemalessql.StopOnError); err != nil {
 		t.Fatalf("error reading entities: %v", err)
 	}
 
@@ -239,25 +288,84 @@ func TestDeleteMulti(t *testing.T) {
 	defer closeDB(t, db)
 
 	entities := []Entity{
-		Entity{123, 123.456, true, []byte{12, 34, 56}, "foo", time.Now(), time.Duration(3) * time.Minute},
+		Entity{123, 123.456, true, []byte{12, 34, 56}, "foo", time.Now().Round(0), time.Duration(3) * time.Minute},
 		Entity{456, 456.789, false, []byte{21, 43, 65}, "bar", time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC), time.Duration(10) * time.Second},
 	}
 
-	keys, err := db.PutMulti(nil, entities, true)
+	keys, err := db.PutMulti(nil, entities, schemalessql.StopOnError)
 	if err != nil {
 		t.Fatalf("error creating entities: %v", err)
 	}
 
-	if err := db.DeleteMulti(keys, true); err != nil {
+	if err := db.DeleteMulti(keys, schemalessql.StopOnError); err != nil {
 		t.Fatalf("error deleting entities: %v", err)
 	}
 
 	results := make([]Entity, len(keys))
-	if err := db.GetMulti(keys, results, true); err != sql.ErrNoRows {
+	if err := db.GetMulti(keys, results, schemalessql.StopOnError); err != sql.ErrNoRows {
 		t.Fatalf("failed to delete entities: %v", err)
 	}
 }
 
+func TestPutMultiAtomic(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(t, db)
+
+	other, err := db.Put(nil, EntityC{1.5})
+	if err != nil {
+		t.Fatalf("error creating entity: %v", err)
+	}
+
+	// the second entity may not replace an entity of another kind
+	entities := []EntityA{EntityA{1.5}, EntityA{2.5}}
+	keys := []*schemalessql.Key{nil, other}
+
+	nkeys, err := db.PutMulti(keys, entities, schemalessql.Atomic)
+	if _, ok := err.(*schemalessql.KindMismatchError); !ok {
+		t.Fatalf("should receive kind mismatch error but got: %v", err)
+	}
+
+	if nkeys[0] != nil {
+		t.Fatalf("should return the provided keys but got: %v", nkeys)
+	}
+
+	if found, err := db.FindKeys("EntityA", map[string]interface{}{"Data": 1.5}); err != nil || len(found) != 0 {
+		t.Fatalf("should not save any entity but found %v: %v", found, err)
+	}
+
+	// continue saves the first entity regardless
+	if _, err := db.PutMulti(keys, entities, schemalessql.ContinueOnError); err == nil {
+		t.Fatalf("should receive error while replacing entity of another kind")
+	}
+
+	if found, err := db.FindKeys("EntityA", map[string]interface{}{"Data": 1.5}); err != nil || len(found) != 1 {
+		t.Fatalf("should save the first entity but found %v: %v", found, err)
+	}
+}
+
+func TestDeleteMultiAtomic(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(t, db)
+
+	keys, err := db.PutMulti(nil, []EntityA{EntityA{1.5}, EntityA{2.5}}, schemalessql.Atomic)
+	if err != nil {
+		t.Fatalf("error creating entities: %v", err)
+	}
+
+	if err := db.Delete(keys[1]); err != nil {
+		t.Fatalf("error deleting entity: %v", err)
+	}
+
+	if err := db.DeleteMulti(keys, schemalessql.Atomic); err != sql.ErrNoRows {
+		t.Fatalf("should receive no rows error but got: %v", err)
+	}
+
+	var r EntityA
+	if err := db.Get(keys[0], &r); err != nil {
+		t.Fatalf("should not delete any entity: %v", err)
+	}
+}
+
 type EntityCreateHook struct {
 	Data      string
 	LastSaved time.Time
@@ -265,7 +373,7 @@ type EntityCreateHook struct {
 }
 
 func (e *EntityCreateHook) BeforeSave() {
-	e.LastSaved = time.Now()
+	e.LastSaved = time.Now().Round(0)
 }
 
 func (e *EntityCreateHook) AfterSave() {
@@ -304,7 +412,7 @@ func (e *EntityReadHook) BeforeLoad() {
 }
 
 func (e *EntityReadHook) AfterLoad() {
-	e.LastLoaded = time.Now()
+	e.LastLoaded = time.Now().Round(0)
 	e.Loaded = true
 }
 
@@ -333,11 +441,12 @@ func TestQueryMulti(t *testing.T) {
 	defer closeDB(t, db)
 
 	entities := []interface{}{
-		Entity{123, 123.456, true, []byte{12, 34, 56}, "foo", time.Now(), time.Duration(3) * time.Minute},
+		Entity{123, 123.456, true, []byte{12, 34, 56}, "foo", time.Now().Round(0), time.Duration(3) * time.Minute},
 		Entity{456, 456.789, true, []byte{21, 43, 65}, "bar", time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC), time.Duration(10) * time.Second},
 	}
 
-	if _, err := db.PutMulti(nil, entities, true); err != nil {
+	keys, err := db.PutMulti(nil, entities, schemalessql.StopOnError)
+	if err != nil {
 		t.Fatalf("error creating entities: %v", err)
 	}
 
@@ -347,12 +456,13 @@ func TestQueryMulti(t *testing.T) {
 		"C": true,
 	}
 
-	results, err := db.Find(query, Entity{})
+	var results []Entity
+	found, err := db.Find(query, &results)
 	if err != nil {
 		t.Fatalf("error finding entities: %v", err)
 	}
 
-	if n := len(results); n != 1 {
+	if n := len(results); n != 1 || len(found) != 1 || *found[0] != *keys[0] {
 		t.Fatalf("error finding entities, number of results: %v", n)
 	}
 
@@ -361,8 +471,8 @@ func TestQueryMulti(t *testing.T) {
 	}
 
 	// find two
-	results, err = db.Find(map[string]interface{}{"C": true}, Entity{})
-	if err != nil {
+	results = nil
+	if _, err := db.Find(map[string]interface{}{"C": true}, &results); err != nil {
 		t.Fatalf("error finding entities: %v", err)
 	}
 
@@ -375,8 +485,8 @@ func TestQueryMulti(t *testing.T) {
 	}
 
 	// find nothing
-	results, err = db.Find(map[string]interface{}{"C": false}, Entity{})
-	if err != nil {
+	results = nil
+	if _, err := db.Find(map[string]interface{}{"C": false}, &results); err != nil {
 		t.Fatalf("error finding entities: %v", err)
 	}
 
@@ -391,11 +501,11 @@ func TestQuery(t *testing.T) {
 	defer closeDB(t, db)
 
 	entities := []interface{}{
-		Entity{123, 123.456, true, []byte{12, 34, 56}, "foo", time.Now(), time.Duration(3) * time.Minute},
+		Entity{123, 123.456, true, []byte{12, 34, 56}, "foo", time.Now().Round(0), time.Duration(3) * time.Minute},
 		Entity{456, 456.789, true, []byte{21, 43, 65}, "bar", time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC), time.Duration(10) * time.Second},
 	}
 
-	if _, err := db.PutMulti(nil, entities, true); err != nil {
+	if _, err := db.PutMulti(nil, entities, schemalessql.StopOnError); err != nil {
 		t.Fatalf("error creating entities: %v", err)
 	}
 
@@ -420,3 +530,234 @@ func TestQuery(t *testing.T) {
 	}
 
 }
+
+type EntityC struct {
+	Data float64
+}
+
+type EntityKind struct {
+	Data float64
+}
+
+func (e EntityKind) Kind() string {
+	return "Renamed"
+}
+
+func TestKindMismatch(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(t, db)
+
+	key, err := db.Put(nil, EntityA{1.5})
+	if err != nil {
+		t.Fatalf("error creating entity: %v", err)
+	}
+
+	var r EntityC
+	err = db.Get(key, &r)
+	if kerr, ok := err.(*schemalessql.KindMismatchError); !ok || kerr.Kind != "EntityA" || kerr.Requested != "EntityC" {
+		t.Fatalf("should receive kind mismatch error but got: %v", err)
+	}
+
+	if _, err := db.Put(key, EntityC{2.5}); err == nil {
+		t.Fatalf("should receive error while replacing entity of another kind")
+	}
+}
+
+func TestKinder(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(t, db)
+
+	key, err := db.Put(nil, EntityKind{1.5})
+	if err != nil {
+		t.Fatalf("error creating entity: %v", err)
+	}
+
+	keys, err := db.FindKeys("Renamed", map[string]interface{}{"Data": 1.5})
+	if err != nil {
+		t.Fatalf("error finding entities: %v", err)
+	}
+
+	if len(keys) != 1 || *keys[0] != *key {
+		t.Fatalf("error finding entities, keys do not match: %v %v", keys, key)
+	}
+}
+
+func TestQueryKind(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(t, db)
+
+	if _, err := db.Put(nil, EntityA{1.5}); err != nil {
+		t.Fatalf("error creating entity: %v", err)
+	}
+
+	if _, err := db.Put(nil, EntityC{1.5}); err != nil {
+		t.Fatalf("error creating entity: %v", err)
+	}
+
+	var results []*EntityC
+	if _, err := db.Find(map[string]interface{}{"Data": 1.5}, &results); err != nil {
+		t.Fatalf("error finding entities: %v", err)
+	}
+
+	if n := len(results); n != 1 || results[0].Data != 1.5 {
+		t.Fatalf("error finding entities, number of results: %v", n)
+	}
+
+	if _, err := db.Find(map[string]interface{}{"Data": 1.5}, results); err == nil {
+		t.Fatalf("should receive error for destination that is no pointer to a slice")
+	}
+}
+
+type EntityChanged struct {
+	Data string
+}
+
+func (e EntityChanged) Kind() string {
+	return "EntityA"
+}
+
+func TestSchemaPersistence(t *testing.T) {
+	driver, dsn := testDSN(t)
+
+	db, err := schemalessql.Open(driver, dsn)
+	if err != nil {
+		t.Fatalf("error connecting to database: %v", err)
+	}
+
+	key, err := db.Put(nil, EntityA{1.5})
+	if err != nil {
+		t.Fatalf("error creating entity: %v", err)
+	}
+	closeDB(t, db)
+
+	// reopen without registering any entity
+	db, err = schemalessql.Open(driver, dsn)
+	if err != nil {
+		t.Fatalf("error connecting to database: %v", err)
+	}
+	defer closeDB(t, db)
+
+	keys, err := db.FindKeys("EntityA", map[string]interface{}{"Data": 1.5})
+	if err != nil {
+		t.Fatalf("error finding entities after reopening: %v", err)
+	}
+
+	if len(keys) != 1 || *keys[0] != *key {
+		t.Fatalf("error finding entities, keys do not match: %v %v", keys, key)
+	}
+
+	var c EntityChanged
+	if err := db.Register(&c); err == nil {
+		t.Fatalf("should receive error while registering changed entity but got: %v", err)
+	}
+}
+
+type EntityPartial struct {
+	Title string
+	Tags  map[string]int
+}
+
+type EntityCompleted struct {
+	Title string
+	Tags  string
+}
+
+func (e EntityCompleted) Kind() string {
+	return "EntityPartial"
+}
+
+func TestRegisterFailure(t *testing.T) {
+	driver, dsn := testDSN(t)
+
+	db, err := schemalessql.Open(driver, dsn)
+	if err != nil {
+		t.Fatalf("error connecting to database: %v", err)
+	}
+	defer closeDB(t, db)
+
+	// the first field is defined before the second fails
+	if err := db.Register(EntityPartial{}); err == nil {
+		t.Fatalf("should receive error for unsupported field")
+	}
+
+	if err := db.Register(EntityCompleted{}); err != nil {
+		t.Fatalf("error registering entity after failed registration: %v", err)
+	}
+
+	key, err := db.Put(nil, EntityCompleted{"title", "tags"})
+	if err != nil {
+		t.Fatalf("error creating entity: %v", err)
+	}
+
+	keys, err := db.FindKeys("EntityPartial", map[string]interface{}{"Title": "title", "Tags": "tags"})
+	if err != nil || len(keys) != 1 || *keys[0] != *key {
+		t.Fatalf("error finding entity %v: %v %v", key, keys, err)
+	}
+}
+
+func TestKindMigration(t *testing.T) {
+	driver, dsn := testDSN(t)
+	dialect := dialects[driver]
+
+	// entity table of a datastore created before kinds
+	old, err := sql.Open(driver, dsn)
+	if err != nil {
+		t.Fatalf("error connecting to database: %v", err)
+	}
+
+	stmts := dialect.CreateTable(schemalessql.Table{
+		Name: "entities",
+		Columns: []schemalessql.Column{
+			{Name: "id", Type: "SERIAL"},
+			{Name: "data", Type: "BLOB", Constraints: "NOT NULL"},
+		},
+	})
+
+	for _, stmt := range stmts {
+		if _, err := old.Exec(stmt); err != nil {
+			t.Fatalf("error creating entity table: %v", err)
+		}
+	}
+
+	if _, err := old.Exec(dialect.Rebind(`INSERT INTO entities (data) VALUES (?)`), []byte{1, 2, 3}); err != nil {
+		t.Fatalf("error creating entity: %v", err)
+	}
+	old.Close()
+
+	db, err := schemalessql.Open(driver, dsn)
+	if err != nil {
+		t.Fatalf("error migrating database: %v", err)
+	}
+	defer closeDB(t, db)
+
+	key, err := db.Put(nil, EntityA{1.5})
+	if err != nil {
+		t.Fatalf("error creating entity: %v", err)
+	}
+
+	var r EntityA
+	if err := db.Get(key, &r); err != nil || r.Data != 1.5 {
+		t.Fatalf("error reading entity %v: %v", r, err)
+	}
+
+	// the kind of the old entity is unknown
+	rows, err := db.Query(`SELECT kind FROM entities ORDER BY id`)
+	if err != nil {
+		t.Fatalf("error reading kinds: %v", err)
+	}
+	defer rows.Close()
+
+	var kinds []string
+	for rows.Next() {
+		var kind string
+		if err := rows.Scan(&kind); err != nil {
+			t.Fatalf("error reading kinds: %v", err)
+		}
+
+		kinds = append(kinds, kind)
+	}
+
+	if !reflect.DeepEqual(kinds, []string{"", "EntityA"}) {
+		t.Fatalf("error migrating database, kinds do not match: %q", kinds)
+	}
+}
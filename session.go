@@ -0,0 +1,30 @@
+package schemalessql
+
+import (
+	"context"
+	"reflect"
+)
+
+// session executes one or more operations within a single transaction of the backend.
+type session struct {
+	txn
+	ctx context.Context
+
+	// types registered within the transaction
+	registered []reflect.Type
+}
+
+// begin starts a new transaction.
+func (d *datastore) begin(ctx context.Context) (*session, error) {
+	return d.beginTx(ctx, false)
+}
+
+// beginTx starts a new transaction, which is serializable if requested.
+func (d *datastore) beginTx(ctx context.Context, serializable bool) (*session, error) {
+	t, err := d.backend.begin(ctx, serializable)
+	if err != nil {
+		return nil, err
+	}
+
+	return &session{txn: t, ctx: ctx}, nil
+}
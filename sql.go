@@ -0,0 +1,560 @@
+package schemalessql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// queryer is satisfied by *sql.DB and *sql.Tx.
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// sqlBackend stores the entities in the tables of a SQL database.
+type sqlBackend struct {
+	db      *sql.DB
+	dialect Dialect
+}
+
+// setup creates the entity, name, ancestor and schema tables.
+func (b *sqlBackend) setup(ctx context.Context) error {
+	entities := Table{
+		Name: EntityTable,
+		Columns: []Column{
+			{"id", "SERIAL", ""},
+			{"kind", "TEXT", "NOT NULL"},
+			{"data", "BLOB", "NOT NULL"},
+			{"version", "INTEGER", "NOT NULL DEFAULT 1"},
+			{"codec", "VARCHAR(32)", "NOT NULL DEFAULT 'gob'"},
+			{"document", "JSON", ""},
+			{"compression", "VARCHAR(16)", "NOT NULL DEFAULT ''"},
+			{"key_id", "VARCHAR(255)", "NOT NULL DEFAULT ''"},
+			{"parent", "TEXT", ""},
+		},
+		Indexes: []Index{
+			{"id_index", true, []string{"id"}},
+			{"kind_index", false, []string{"kind", "id"}},
+		},
+	}
+
+	schema := Table{
+		Name: SchemaTable,
+		Columns: []Column{
+			{"kind", "TEXT", "NOT NULL"},
+			{"field", "TEXT", "NOT NULL"},
+			{"type", "TEXT", "NOT NULL"},
+			{"options", "TEXT", "NOT NULL"},
+		},
+		PrimaryKey: []string{"kind", "field"},
+	}
+
+	names := Table{
+		Name: NameTable,
+		Columns: []Column{
+			{"kind", "TEXT", "NOT NULL"},
+			{"name", "TEXT", "NOT NULL"},
+			{"entity_id", "INTEGER", "NOT NULL"},
+		},
+		PrimaryKey: []string{"kind", "name"},
+		Indexes: []Index{
+			{"name_entity_index", true, []string{"entity_id"}},
+		},
+	}
+
+	ancestors := Table{
+		Name: AncestorTable,
+		Columns: []Column{
+			{"entity_id", "INTEGER", "NOT NULL"},
+			{"ancestor_id", "INTEGER", "NOT NULL"},
+		},
+		PrimaryKey: []string{"entity_id", "ancestor_id"},
+		Indexes: []Index{
+			{"ancestor_entity_index", false, []string{"ancestor_id", "entity_id"}},
+		},
+	}
+
+	// entity tables created before kinds, versioning, codecs, documents, compression, encryption or parent keys
+	// get their missing columns before the indexes on them are created
+	if err := b.migrate(ctx, entities); err != nil {
+		return fmt.Errorf("schemalessql: required tables/indices could not be created: %w", err)
+	}
+
+	tx, err := b.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("schemalessql: required tables/indices could not be created: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, table := range []Table{entities, schema, names, ancestors} {
+		for _, stmt := range b.dialect.CreateTable(table) {
+			if _, err := tx.ExecContext(ctx, stmt); err != nil {
+				return fmt.Errorf("schemalessql: required tables/indices could not be created: %w", err)
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("schemalessql: required tables/indices could not be created: %w", err)
+	}
+
+	return nil
+}
+
+// migrate adds the missing columns to the table if it already exists.
+func (b *sqlBackend) migrate(ctx context.Context, table Table) error {
+	rows, err := b.db.QueryContext(ctx, b.dialect.Rebind(b.dialect.Columns()), table.Name)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	existing := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		existing[name] = true
+	}
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	// the table does not exist yet
+	if len(existing) == 0 {
+		return nil
+	}
+
+	for _, column := range table.Columns[1:] {
+		if existing[column.Name] {
+			continue
+		}
+
+		if column.Name != "kind" {
+			if _, err := b.db.ExecContext(ctx, `ALTER TABLE `+b.dialect.Quote(table.Name)+` ADD COLUMN `+column.Name+` `+b.dialect.ColumnType(column.Type)+` `+column.Constraints); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		// the kinds of the stored entities are unknown and TEXT columns of MySQL can not have a default value
+		if _, err := b.db.ExecContext(ctx, `ALTER TABLE `+b.dialect.Quote(table.Name)+` ADD COLUMN kind `+b.dialect.ColumnType(column.Type)); err != nil {
+			return err
+		}
+
+		if _, err := b.db.ExecContext(ctx, `UPDATE `+b.dialect.Quote(table.Name)+` SET kind='' WHERE kind IS NULL`); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (b *sqlBackend) reader(ctx context.Context) reader {
+	return &sqlReader{b: b, ctx: ctx, q: b.db}
+}
+
+func (b *sqlBackend) begin(ctx context.Context, serializable bool) (txn, error) {
+	var opts *sql.TxOptions
+	if serializable {
+		opts = &sql.TxOptions{Isolation: b.dialect.Isolation()}
+	}
+
+	tx, err := b.db.BeginTx(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sqlTxn{sqlReader: sqlReader{b: b, ctx: ctx, q: tx}, tx: tx, stmts: make(map[string]*sql.Stmt)}, nil
+}
+
+func (b *sqlBackend) transactionalDDL() bool {
+	return b.dialect.TransactionalDDL()
+}
+
+func (b *sqlBackend) retryable(err error) bool {
+	return b.dialect.IsRetryable(err)
+}
+
+func (b *sqlBackend) schema(ctx context.Context) (map[string]map[string]fieldCodec, error) {
+	rows, err := b.db.QueryContext(ctx, `SELECT kind, field, type, options FROM `+b.dialect.Quote(SchemaTable))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	schema := make(map[string]map[string]fieldCodec)
+	for rows.Next() {
+		var kind, fieldname, fieldtype, options string
+		if err := rows.Scan(&kind, &fieldname, &fieldtype, &options); err != nil {
+			return nil, err
+		}
+
+		codec, found := schema[kind]
+		if !found {
+			codec = make(map[string]fieldCodec)
+			schema[kind] = codec
+		}
+
+		codec[fieldname] = newFieldCodec(fieldtype, options)
+	}
+
+	return schema, rows.Err()
+}
+
+// sqlReader reads the entities without a transaction or within a transaction.
+type sqlReader struct {
+	b   *sqlBackend
+	ctx context.Context
+	q   queryer
+}
+
+func (r *sqlReader) entity(id int64, data bool) (entityRow, error) {
+	row := entityRow{id: id}
+	if !data {
+		err := scanParent(r.q.QueryRowContext(r.ctx, r.b.dialect.Rebind(`SELECT kind, version, parent FROM `+r.b.dialect.Quote(EntityTable)+` WHERE id=?`), id), &row)
+		return row, err
+	}
+
+	err := scanEntity(r.q.QueryRowContext(r.ctx, r.b.dialect.Rebind(`SELECT kind, data, document, version, codec, compression, key_id, parent FROM `+r.b.dialect.Quote(EntityTable)+` WHERE id=?`), id), &row)
+	return row, err
+}
+
+func (r *sqlReader) lookup(kind, name string) (int64, error) {
+	var id int64
+	err := r.q.QueryRowContext(r.ctx, r.b.dialect.Rebind(`SELECT entity_id FROM `+r.b.dialect.Quote(NameTable)+` WHERE kind=? AND name=?`), kind, name).Scan(&id)
+	return id, err
+}
+
+func (r *sqlReader) descendants(id int64) ([]int64, error) {
+	return r.ids(`SELECT entity_id FROM `+r.b.dialect.Quote(AncestorTable)+` WHERE ancestor_id=? ORDER BY entity_id`, id)
+}
+
+func (r *sqlReader) stale(keyID string, after int64, limit int) ([]int64, error) {
+	limitClause, args := r.b.dialect.Limit(limit, 0)
+	return r.ids(`SELECT id FROM `+r.b.dialect.Quote(EntityTable)+` WHERE key_id<>? AND id>? ORDER BY id`+limitClause, append([]interface{}{keyID, after}, args...)...)
+}
+
+// ids returns the ids selected by the query.
+func (r *sqlReader) ids(query string, args ...interface{}) ([]int64, error) {
+	result, err := r.q.QueryContext(r.ctx, r.b.dialect.Rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+
+	var ids []int64
+	for result.Next() {
+		var id int64
+		if err := result.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, result.Err()
+}
+
+func (r *sqlReader) query(q *Query) (rows, error) {
+	stmt, args := r.b.compile(q, true)
+	result, err := r.q.QueryContext(r.ctx, stmt, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return documentRows{result}, nil
+}
+
+// scanEntity scans the kind, data, document, version, codec, compression, key id and parent of the entity.
+func scanEntity(r *sql.Row, row *entityRow) error {
+	var document []byte
+	var parent sql.NullString
+	if err := r.Scan(&row.kind, &row.data, &document, &row.version, &row.codec, &row.compression, &row.keyID, &parent); err != nil {
+		return err
+	}
+
+	if document != nil {
+		row.data = document
+	}
+
+	if parent.String == "" {
+		return nil
+	}
+
+	var err error
+	row.parent, err = DecodeKey(parent.String)
+	return err
+}
+
+// scanParent scans the kind, version and parent of the entity.
+func scanParent(r *sql.Row, row *entityRow) error {
+	var parent sql.NullString
+	if err := r.Scan(&row.kind, &row.version, &parent); err != nil {
+		return err
+	}
+
+	if parent.String == "" {
+		return nil
+	}
+
+	var err error
+	row.parent, err = DecodeKey(parent.String)
+	return err
+}
+
+// parentColumn returns the value of the parent column of the row, the encoded parent key or NULL.
+func parentColumn(row entityRow) interface{} {
+	if row.parent == nil {
+		return nil
+	}
+
+	return row.parent.Encode()
+}
+
+// documentRows scans the document selected after the data, version, codec, compression and key id of the query results into the data.
+type documentRows struct {
+	*sql.Rows
+}
+
+func (r documentRows) Scan(dest ...interface{}) error {
+	var document []byte
+	if err := r.Rows.Scan(append(dest, &document)...); err != nil {
+		return err
+	}
+
+	if document != nil {
+		*dest[len(dest)-5].(*[]byte) = document
+	}
+
+	return nil
+}
+
+// splitDocument splits the data of the row into the data and document columns,
+// unencrypted entities encoded by the JSON codec are stored as document.
+func splitDocument(row entityRow) ([]byte, interface{}) {
+	if row.codec != JSON.Name() || row.keyID != "" {
+		return row.data, nil
+	}
+
+	return []byte{}, string(row.data)
+}
+
+// sqlTxn executes the statements of one or more operations within a single transaction and reuses their prepared statements.
+type sqlTxn struct {
+	sqlReader
+	tx    *sql.Tx
+	stmts map[string]*sql.Stmt
+}
+
+// prepare returns the prepared statement of the query, it is prepared only once per transaction.
+func (t *sqlTxn) prepare(query string) (*sql.Stmt, error) {
+	if stmt, found := t.stmts[query]; found {
+		return stmt, nil
+	}
+
+	stmt, err := t.tx.PrepareContext(t.ctx, t.b.dialect.Rebind(query))
+	if err != nil {
+		return nil, err
+	}
+
+	t.stmts[query] = stmt
+	return stmt, nil
+}
+
+// exec executes the query with the arguments.
+func (t *sqlTxn) exec(query string, args ...interface{}) (sql.Result, error) {
+	stmt, err := t.prepare(query)
+	if err != nil {
+		return nil, err
+	}
+
+	return stmt.ExecContext(t.ctx, args...)
+}
+
+// queryRow executes the query that is expected to return at most one row.
+func (t *sqlTxn) queryRow(query string, args ...interface{}) *sql.Row {
+	stmt, err := t.prepare(query)
+	if err != nil {
+		// reports the error on Scan
+		return t.tx.QueryRowContext(t.ctx, t.b.dialect.Rebind(query), args...)
+	}
+
+	return stmt.QueryRowContext(t.ctx, args...)
+}
+
+func (t *sqlTxn) entity(id int64, data bool) (entityRow, error) {
+	row := entityRow{id: id}
+	if !data {
+		err := scanParent(t.queryRow(`SELECT kind, version, parent FROM `+t.b.dialect.Quote(EntityTable)+` WHERE id=?`, id), &row)
+		return row, err
+	}
+
+	err := scanEntity(t.queryRow(`SELECT kind, data, document, version, codec, compression, key_id, parent FROM `+t.b.dialect.Quote(EntityTable)+` WHERE id=?`, id), &row)
+	return row, err
+}
+
+func (t *sqlTxn) lookup(kind, name string) (int64, error) {
+	var id int64
+	err := t.queryRow(`SELECT entity_id FROM `+t.b.dialect.Quote(NameTable)+` WHERE kind=? AND name=?`, kind, name).Scan(&id)
+	return id, err
+}
+
+func (t *sqlTxn) insert(row entityRow) (int64, error) {
+	id, err := t.insertEntity(row)
+	if err != nil {
+		return 0, err
+	}
+
+	if row.name != "" {
+		if _, err := t.exec(`INSERT INTO `+t.b.dialect.Quote(NameTable)+` (kind, name, entity_id) VALUES (?, ?, ?)`, row.kind, row.name, id); err != nil {
+			return 0, err
+		}
+	}
+
+	for _, ancestor := range row.ancestors {
+		if _, err := t.exec(`INSERT INTO `+t.b.dialect.Quote(AncestorTable)+` (entity_id, ancestor_id) VALUES (?, ?)`, id, ancestor); err != nil {
+			return 0, err
+		}
+	}
+
+	return id, nil
+}
+
+// insertEntity inserts the row into the entity table and returns its id.
+func (t *sqlTxn) insertEntity(row entityRow) (int64, error) {
+	data, document := splitDocument(row)
+	if row.id != 0 {
+		// insert data with the provided id
+		if _, err := t.exec(`INSERT INTO `+t.b.dialect.Quote(EntityTable)+` (kind, data, document, codec, compression, key_id, parent, version, id) VALUES (?, ?, ?, ?, ?, ?, ?, 1, ?)`, row.kind, data, document, row.codec, row.compression, row.keyID, parentColumn(row), row.id); err != nil {
+			return 0, err
+		}
+
+		if stmt := t.b.dialect.SyncSequence(EntityTable, "id"); stmt != "" {
+			if _, err := t.exec(stmt, row.id); err != nil {
+				return 0, err
+			}
+		}
+
+		return row.id, nil
+	}
+
+	query := `INSERT INTO ` + t.b.dialect.Quote(EntityTable) + ` (kind, data, document, codec, compression, key_id, parent, version) VALUES (?, ?, ?, ?, ?, ?, ?, 1)`
+	if returning := t.b.dialect.Returning("id"); returning != "" {
+		var id int64
+		err := t.queryRow(query+returning, row.kind, data, document, row.codec, row.compression, row.keyID, parentColumn(row)).Scan(&id)
+		return id, err
+	}
+
+	result, err := t.exec(query, row.kind, data, document, row.codec, row.compression, row.keyID, parentColumn(row))
+	if err != nil {
+		return 0, err
+	}
+
+	return result.LastInsertId()
+}
+
+func (t *sqlTxn) update(row entityRow) (bool, error) {
+	data, document := splitDocument(row)
+	stmt, args := `UPDATE `+t.b.dialect.Quote(EntityTable)+` SET data=?, document=?, codec=?, compression=?, key_id=?, version=version+1 WHERE id=?`, []interface{}{data, document, row.codec, row.compression, row.keyID, row.id}
+	if row.version != anyVersion {
+		stmt, args = stmt+` AND version=?`, append(args, row.version)
+	}
+
+	result, err := t.exec(stmt, args...)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+func (t *sqlTxn) rewrite(row entityRow) (bool, error) {
+	data, document := splitDocument(row)
+	result, err := t.exec(`UPDATE `+t.b.dialect.Quote(EntityTable)+` SET data=?, document=?, key_id=? WHERE id=? AND version=?`, data, document, row.keyID, row.id, row.version)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+func (t *sqlTxn) remove(id int64) error {
+	if _, err := t.exec(`DELETE FROM `+t.b.dialect.Quote(EntityTable)+` WHERE id=?`, id); err != nil {
+		return err
+	}
+
+	if _, err := t.exec(`DELETE FROM `+t.b.dialect.Quote(NameTable)+` WHERE entity_id=?`, id); err != nil {
+		return err
+	}
+
+	_, err := t.exec(`DELETE FROM `+t.b.dialect.Quote(AncestorTable)+` WHERE entity_id=?`, id)
+	return err
+}
+
+func (t *sqlTxn) index(kind, fieldname string, id int64, value interface{}) error {
+	_, err := t.exec(t.b.dialect.Upsert(indexTable(kind, fieldname), "entitiy_id", "value"), id, value)
+	return err
+}
+
+func (t *sqlTxn) unindex(kind, fieldname string, id int64) error {
+	_, err := t.exec(`DELETE FROM `+t.b.dialect.Quote(indexTable(kind, fieldname))+` WHERE entitiy_id=?`, id)
+	return err
+}
+
+func (t *sqlTxn) define(kind, fieldname string, field fieldCodec) error {
+	// the field is recorded after its index table has been created, databases without transactional DDL commit
+	// the statements of a failed registration and the field may have been recorded by an earlier registration
+	if !field.noindex {
+		table := indexTable(kind, fieldname)
+		index := Table{
+			Name: table,
+			Columns: []Column{
+				{"entitiy_id", "INTEGER", "NOT NULL UNIQUE"},
+				{"value", field.sqltype, ""},
+			},
+			Indexes: []Index{
+				{table + "_id_value_index", false, []string{"entitiy_id", "value"}},
+				{table + "_value_id_index", false, []string{"value", "entitiy_id"}},
+			},
+		}
+
+		for _, stmt := range t.b.dialect.CreateTable(index) {
+			if _, err := t.exec(stmt); err != nil {
+				return err
+			}
+		}
+	}
+
+	var sqltype, options string
+	err := t.queryRow(`SELECT type, options FROM `+t.b.dialect.Quote(SchemaTable)+` WHERE kind=? AND field=?`, kind, fieldname).Scan(&sqltype, &options)
+	if err == sql.ErrNoRows {
+		_, err = t.exec(`INSERT INTO `+t.b.dialect.Quote(SchemaTable)+` (kind, field, type, options) VALUES (?, ?, ?, ?)`, kind, fieldname, field.sqltype, field.options())
+		return err
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if recorded := newFieldCodec(sqltype, options); recorded != field {
+		return fmt.Errorf("field %v of kind %v already recorded as %v (%v)", fieldname, kind, recorded.sqltype, recorded.options())
+	}
+
+	return nil
+}
+
+// commit commits the transaction, its prepared statements are closed.
+func (t *sqlTxn) commit() error {
+	return t.tx.Commit()
+}
+
+// rollback aborts the transaction unless it has been committed, its prepared statements are closed.
+func (t *sqlTxn) rollback() error {
+	return t.tx.Rollback()
+}
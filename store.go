@@ -0,0 +1,161 @@
+package schemalessql
+
+import (
+	"context"
+)
+
+// Store is implemented by Datastore, which saves the entities in a SQL database, and by MemoryStore, which keeps them in memory.
+// Both behave identically, so that code using a Store can be tested with a MemoryStore.
+type Store interface {
+	Register(src interface{}) error
+	RegisterContext(ctx context.Context, src interface{}) error
+
+	Put(key *Key, src interface{}) (*Key, error)
+	PutContext(ctx context.Context, key *Key, src interface{}) (*Key, error)
+	PutIfVersion(key *Key, src interface{}, version int64) (*Key, error)
+	PutIfVersionContext(ctx context.Context, key *Key, src interface{}, version int64) (*Key, error)
+	PutMulti(keys []*Key, srcs interface{}, mode MultiMode) ([]*Key, error)
+	PutMultiContext(ctx context.Context, keys []*Key, srcs interface{}, mode MultiMode) ([]*Key, error)
+
+	Get(key *Key, dst interface{}) error
+	GetContext(ctx context.Context, key *Key, dst interface{}) error
+	GetMulti(keys []*Key, dsts interface{}, mode MultiMode) error
+	GetMultiContext(ctx context.Context, keys []*Key, dsts interface{}, mode MultiMode) error
+
+	Delete(key *Key) error
+	DeleteContext(ctx context.Context, key *Key) error
+	DeleteCascade(key *Key) error
+	DeleteCascadeContext(ctx context.Context, key *Key) error
+	DeleteMulti(keys []*Key, mode MultiMode) error
+	DeleteMultiContext(ctx context.Context, keys []*Key, mode MultiMode) error
+
+	FindKeys(kind string, query map[string]interface{}) ([]*Key, error)
+	FindKeysContext(ctx context.Context, kind string, query map[string]interface{}) ([]*Key, error)
+	Find(query map[string]interface{}, dst interface{}) ([]*Key, error)
+	FindContext(ctx context.Context, query map[string]interface{}, dst interface{}) ([]*Key, error)
+	FindOne(query map[string]interface{}, dst interface{}) error
+	FindOneContext(ctx context.Context, query map[string]interface{}, dst interface{}) error
+
+	NewQuery(kind string) *Query
+	FindAllKeys(q *Query) ([]*Key, error)
+	FindAllKeysContext(ctx context.Context, q *Query) ([]*Key, error)
+	FindPage(q *Query) ([]*Key, Cursor, error)
+	FindPageContext(ctx context.Context, q *Query) ([]*Key, Cursor, error)
+	FindAll(q *Query, dst interface{}) ([]*Key, error)
+	FindAllContext(ctx context.Context, q *Query, dst interface{}) ([]*Key, error)
+	Run(q *Query) *Iterator
+	RunContext(ctx context.Context, q *Query) *Iterator
+
+	RunInTransaction(ctx context.Context, f func(tx *Tx) error) error
+
+	Reencrypt(ctx context.Context) (int, error)
+
+	Close() error
+}
+
+var (
+	_ Store = (*Datastore)(nil)
+	_ Store = (*MemoryStore)(nil)
+)
+
+// backend stores the rows of the entity table, the index tables and the schema table.
+type backend interface {
+	// reader returns a reader of the committed rows.
+	reader(ctx context.Context) reader
+
+	// begin starts a transaction, which is serializable if requested by RunInTransaction.
+	begin(ctx context.Context, serializable bool) (txn, error)
+
+	// transactionalDDL reports whether kinds can be defined within a transaction without committing it.
+	transactionalDDL() bool
+
+	// retryable reports whether a transaction failed because of concurrent transactions and can be retried.
+	retryable(err error) bool
+
+	// schema reads the fields of all defined kinds.
+	schema(ctx context.Context) (map[string]map[string]fieldCodec, error)
+}
+
+// reader reads entities, either committed ones or within a transaction.
+type reader interface {
+	// entity reads the row of the entity, with its data or with its parent. If it does not exist, sql.ErrNoRows is returned.
+	entity(id int64, data bool) (entityRow, error)
+
+	// lookup returns the id of the entity of the kind with the name. If it does not exist, sql.ErrNoRows is returned.
+	lookup(kind, name string) (int64, error)
+
+	// descendants returns the ids of all entities that have the entity as ancestor.
+	descendants(id int64) ([]int64, error)
+
+	// query returns the id, the name, the encoded parent, the sort values, the data, the version, the codec, the compression and the key id of the entities matching the query.
+	// The query has been validated against the codec of its kind.
+	query(q *Query) (rows, error)
+
+	// stale returns the ids following after of at most limit entities, which are not encrypted with the key, in ascending order.
+	stale(keyID string, after int64, limit int) ([]int64, error)
+}
+
+// txn modifies the rows within a transaction.
+type txn interface {
+	reader
+
+	// insert inserts the row at version 1 and returns its id, which is generated unless provided by the row.
+	// The name of the row is recorded unless it is empty, as well as the ancestors of the row.
+	insert(row entityRow) (int64, error)
+
+	// update replaces the data, the codec, the compression and the key id of the row and increments its version,
+	// unless the stored version differs from the version of the row, which is not checked for anyVersion.
+	// It reports whether the row has been updated.
+	update(row entityRow) (bool, error)
+
+	// rewrite replaces the data and the key id of the row without incrementing its version,
+	// unless the stored version differs from the version of the row. It reports whether the row has been rewritten.
+	rewrite(row entityRow) (bool, error)
+
+	// remove deletes the row of the entity, its name and its ancestors.
+	remove(id int64) error
+
+	// index inserts or replaces the index value of a field of the entity.
+	index(kind, fieldname string, id int64, value interface{}) error
+
+	// unindex deletes the index value of a field of the entity.
+	unindex(kind, fieldname string, id int64) error
+
+	// define records a new field of the kind and creates its index table unless it is not indexed.
+	define(kind, fieldname string, field fieldCodec) error
+
+	commit() error
+	rollback() error
+}
+
+// entityRow is a row of the entity table.
+type entityRow struct {
+	id      int64
+	kind    string
+	data    []byte
+	version int64
+	codec   string
+
+	// compression of the data, empty if it is not compressed
+	compression string
+
+	// id of the key encrypting the data key, empty if the data is not encrypted
+	keyID string
+
+	// name of the key, empty for numeric keys
+	name string
+
+	// parent key, nil if the entity has no parent
+	parent *Key
+
+	// ids of the parent and all of its ancestors, only used by insert
+	ancestors []int64
+}
+
+// rows is satisfied by *sql.Rows.
+type rows interface {
+	Next() bool
+	Scan(dest ...interface{}) error
+	Err() error
+	Close() error
+}
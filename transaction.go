@@ -0,0 +1,220 @@
+package schemalessql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"time"
+)
+
+// TransactionRetries is the number of times RunInTransaction retries a transaction that failed because of concurrent transactions.
+var TransactionRetries = 3
+
+// Tx is a transaction started by RunInTransaction.
+// All of its operations are executed within the same database transaction.
+type Tx struct {
+	d     *datastore
+	s     *session
+	saved []interface{}
+}
+
+// RunInTransaction runs f within a transaction, which is committed if f returns nil and rolled back otherwise.
+// If the database driver reports that the database is busy or the transaction could not be serialized, it is retried up to TransactionRetries times,
+// therefore f may be called multiple times and should not have side effects besides the operations of the transaction.
+// The AfterSave hooks of saved entities are called once the transaction has been committed.
+func (d *datastore) RunInTransaction(ctx context.Context, f func(tx *Tx) error) error {
+	return d.retry(ctx, func() error {
+		return d.runInTransaction(ctx, f)
+	})
+}
+
+// retry calls f until it succeeds or fails with an error that is not retryable, at most TransactionRetries+1 times.
+func (d *datastore) retry(ctx context.Context, f func() error) error {
+	var err error
+	for attempt := 0; attempt <= TransactionRetries; attempt++ {
+		if err = f(); !d.backend.retryable(err) || attempt == TransactionRetries {
+			return err
+		}
+
+		// randomized backoff, so that the conflicting transactions do not collide again
+		select {
+		case <-time.After(time.Duration(rand.Int63n(int64(attempt+1) * int64(10*time.Millisecond)))):
+		case <-ctx.Done():
+			return err
+		}
+	}
+
+	return err
+}
+
+// runInTransaction runs f within a single transaction attempt.
+func (d *datastore) runInTransaction(ctx context.Context, f func(tx *Tx) error) error {
+	s, err := d.beginTx(ctx, true)
+	if err != nil {
+		return fmt.Errorf("schemalessql: could not begin transaction: %w", err)
+	}
+
+	committed := false
+	defer func() {
+		if !committed {
+			s.rollback()
+			d.forget(context.WithoutCancel(ctx), s.registered)
+		}
+	}()
+
+	tx := &Tx{d: d, s: s}
+	if err := f(tx); err != nil {
+		return err
+	}
+
+	if err := s.commit(); err != nil {
+		return fmt.Errorf("schemalessql: could not commit transaction: %w", err)
+	}
+	committed = true
+
+	for _, src := range tx.saved {
+		afterSave(ctx, src)
+	}
+
+	return nil
+}
+
+// Get is identical to Datastore.Get, but reads within the transaction.
+func (tx *Tx) Get(key *Key, dst interface{}) error {
+	if key == nil {
+		return sql.ErrNoRows
+	}
+
+	beforeLoad(tx.s.ctx, dst)
+
+	kind, err := tx.d.registerIn(tx.s.ctx, tx.s, dst)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.d.get(tx.s, kind, key, dst); err != nil {
+		return err
+	}
+
+	afterLoad(tx.s.ctx, dst)
+
+	return nil
+}
+
+// GetMulti is identical to Get, except that it takes multiple keys. It returns the first error.
+func (tx *Tx) GetMulti(keys []*Key, dsts interface{}) error {
+	vdsts := reflect.ValueOf(dsts)
+	if vdsts.Kind() != reflect.Slice {
+		return fmt.Errorf("schemalessql: destination must be a slice")
+	}
+
+	if len(keys) != vdsts.Len() {
+		return fmt.Errorf("schemalessql: keys and destination slices must have equal length")
+	}
+
+	for i, key := range keys {
+		if err := tx.Get(key, vdsts.Index(i).Addr().Interface()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Put is identical to Datastore.Put, but saves within the transaction.
+// Until the transaction has been committed, a new Key is only valid within the transaction.
+func (tx *Tx) Put(key *Key, src interface{}) (*Key, error) {
+	return tx.put(key, src, anyVersion)
+}
+
+// PutIfVersion is identical to Datastore.PutIfVersion, but saves within the transaction.
+func (tx *Tx) PutIfVersion(key *Key, src interface{}, version int64) (*Key, error) {
+	if version < 0 {
+		return key, fmt.Errorf("schemalessql: invalid version %v", version)
+	}
+
+	return tx.put(key, src, version)
+}
+
+// put saves the entity within the transaction.
+func (tx *Tx) put(key *Key, src interface{}, version int64) (*Key, error) {
+	beforeSave(tx.s.ctx, src)
+
+	kind, err := tx.d.registerIn(tx.s.ctx, tx.s, src)
+	if err != nil {
+		return key, err
+	}
+
+	nkey, err := tx.d.put(tx.s, kind, key, src, version)
+	if err != nil {
+		return key, err
+	}
+
+	tx.saved = append(tx.saved, src)
+
+	return nkey, nil
+}
+
+// PutMulti is identical to Put, except that it takes multiple entities and keys. It returns the first error.
+func (tx *Tx) PutMulti(keys []*Key, srcs interface{}) ([]*Key, error) {
+	vsrcs := reflect.ValueOf(srcs)
+	if vsrcs.Kind() != reflect.Slice {
+		return keys, fmt.Errorf("schemalessql: source must be a slice")
+	}
+
+	if keys == nil {
+		keys = make([]*Key, vsrcs.Len())
+	} else if len(keys) != vsrcs.Len() {
+		return keys, fmt.Errorf("schemalessql: keys and source slices must have equal length")
+	}
+
+	nkeys := make([]*Key, len(keys))
+	for i, key := range keys {
+		var err error
+		if nkeys[i], err = tx.Put(key, vsrcs.Index(i).Interface()); err != nil {
+			return nkeys, err
+		}
+	}
+
+	return nkeys, nil
+}
+
+// Delete is identical to Datastore.Delete, but deletes within the transaction.
+func (tx *Tx) Delete(key *Key) error {
+	return tx.d.delete(tx.s, key, false)
+}
+
+// DeleteCascade is identical to Datastore.DeleteCascade, but deletes within the transaction.
+func (tx *Tx) DeleteCascade(key *Key) error {
+	return tx.d.delete(tx.s, key, true)
+}
+
+// DeleteMulti is identical to Delete, except that it takes multiple keys. It returns the first error.
+func (tx *Tx) DeleteMulti(keys []*Key) error {
+	for _, key := range keys {
+		if err := tx.Delete(key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Run is identical to Datastore.Run, but queries within the transaction.
+// The iterator must be closed before the transaction function returns.
+func (tx *Tx) Run(q *Query) *Iterator {
+	return tx.d.run(tx.s.ctx, tx.s, q)
+}
+
+// FindAllKeys is identical to Datastore.FindAllKeys, but queries within the transaction.
+func (tx *Tx) FindAllKeys(q *Query) ([]*Key, error) {
+	keys, _, err := findPage(tx.Run(q))
+	return keys, err
+}
+
+// FindAll is identical to Datastore.FindAll, but queries within the transaction.
+func (tx *Tx) FindAll(q *Query, dst interface{}) ([]*Key, error) {
+	return findAll(tx.Run(q), dst)
+}
@@ -0,0 +1,193 @@
+package schemalessql_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/der-antikeks/schemalessql"
+)
+
+type Account struct {
+	Owner   string
+	Balance int64
+}
+
+func transfer(ctx context.Context, db schemalessql.Store, from, to *schemalessql.Key, amount int64) error {
+	return db.RunInTransaction(ctx, func(tx *schemalessql.Tx) error {
+		accounts := make([]Account, 2)
+		if err := tx.GetMulti([]*schemalessql.Key{from, to}, accounts); err != nil {
+			return err
+		}
+
+		if accounts[0].Balance < amount {
+			return fmt.Errorf("insufficient balance of %v: %v", accounts[0].Owner, accounts[0].Balance)
+		}
+
+		accounts[0].Balance -= amount
+		accounts[1].Balance += amount
+
+		_, err := tx.PutMulti([]*schemalessql.Key{from, to}, accounts)
+		return err
+	})
+}
+
+func balances(t *testing.T, db schemalessql.Store, keys []*schemalessql.Key) []int64 {
+	accounts := make([]Account, len(keys))
+	if err := db.GetMulti(keys, accounts, schemalessql.Atomic); err != nil {
+		t.Fatalf("error reading accounts: %v", err)
+	}
+
+	result := make([]int64, len(accounts))
+	for i, a := range accounts {
+		result[i] = a.Balance
+	}
+
+	return result
+}
+
+func TestTransaction(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(t, db)
+
+	ctx := context.Background()
+	keys, err := db.PutMulti(nil, []Account{{"alice", 100}, {"bob", 50}}, schemalessql.Atomic)
+	if err != nil {
+		t.Fatalf("error creating accounts: %v", err)
+	}
+
+	if err := transfer(ctx, db, keys[0], keys[1], 30); err != nil {
+		t.Fatalf("error transferring balance: %v", err)
+	}
+
+	if b := balances(t, db, keys); b[0] != 70 || b[1] != 80 {
+		t.Fatalf("wrong balances after transfer: %v", b)
+	}
+
+	// rolled back
+	if err := transfer(ctx, db, keys[1], keys[0], 100); err == nil {
+		t.Fatalf("should receive error for insufficient balance")
+	}
+
+	if b := balances(t, db, keys); b[0] != 70 || b[1] != 80 {
+		t.Fatalf("wrong balances after failed transfer: %v", b)
+	}
+
+	// changes are visible within the transaction
+	err = db.RunInTransaction(ctx, func(tx *schemalessql.Tx) error {
+		if _, err := tx.Put(nil, Account{"carol", 10}); err != nil {
+			return err
+		}
+
+		var found []Account
+		if _, err := tx.FindAll(db.NewQuery("Account").Filter("Owner =", "carol"), &found); err != nil {
+			return err
+		}
+
+		if len(found) != 1 {
+			t.Errorf("should find entity saved within the transaction but got: %v", found)
+		}
+
+		return errors.New("abort")
+	})
+	if err == nil || err.Error() != "abort" {
+		t.Fatalf("should receive error of the transaction function but got: %v", err)
+	}
+
+	if found, err := db.FindAllKeys(db.NewQuery("Account").Filter("Owner =", "carol")); err != nil || len(found) != 0 {
+		t.Fatalf("should not find entity of rolled back transaction but found %v: %v", found, err)
+	}
+}
+
+type EntityTransaction struct {
+	Data string
+}
+
+func TestTransactionRegister(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(t, db)
+
+	// registration is rolled back together with the transaction
+	err := db.RunInTransaction(context.Background(), func(tx *schemalessql.Tx) error {
+		if _, err := tx.Put(nil, EntityTransaction{"foo"}); err != nil {
+			return err
+		}
+
+		return errors.New("abort")
+	})
+	if err == nil {
+		t.Fatalf("should receive error of the transaction function")
+	}
+
+	key, err := db.Put(nil, EntityTransaction{"bar"})
+	if err != nil {
+		t.Fatalf("error creating entity after rolled back registration: %v", err)
+	}
+
+	keys, err := db.FindKeys("EntityTransaction", map[string]interface{}{"Data": "bar"})
+	if err != nil || len(keys) != 1 || *keys[0] != *key {
+		t.Fatalf("error finding entity after rolled back registration %v: %v", keys, err)
+	}
+}
+
+func TestTransactionRetry(t *testing.T) {
+	defer func(retries int) { schemalessql.TransactionRetries = retries }(schemalessql.TransactionRetries)
+	schemalessql.TransactionRetries = 20
+
+	driver, dsn := testDSN(t)
+	if driver == "sqlite3" {
+		dsn += "?_busy_timeout=1000"
+	}
+
+	db, err := schemalessql.Open(driver, dsn)
+	if err != nil {
+		t.Fatalf("error connecting to database: %v", err)
+	}
+	defer closeDB(t, db)
+
+	ctx := context.Background()
+	keys, err := db.PutMulti(nil, []Account{{"alice", 100}, {"bob", 0}}, schemalessql.Atomic)
+	if err != nil {
+		t.Fatalf("error creating accounts: %v", err)
+	}
+
+	// concurrent transactions conflict when upgrading their read locks
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- transfer(ctx, db, keys[0], keys[1], 10)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("error transferring balance: %v", err)
+		}
+	}
+
+	if b := balances(t, db, keys); b[0] != 0 || b[1] != 100 {
+		t.Fatalf("wrong balances after concurrent transfers: %v", b)
+	}
+}
+
+func TestTransactionNoRetry(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(t, db)
+
+	// errors of the transaction function are not classified by their message
+	calls := 0
+	err := db.RunInTransaction(context.Background(), func(tx *schemalessql.Tx) error {
+		calls++
+		return errors.New("account is busy")
+	})
+	if err == nil || calls != 1 {
+		t.Fatalf("should receive error of the transaction function without retrying but got %v after %v calls", err, calls)
+	}
+}
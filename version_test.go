@@ -0,0 +1,160 @@
+package schemalessql_test
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+
+	"github.com/der-antikeks/schemalessql"
+)
+
+type EntityVersioned struct {
+	Data string
+
+	version int64
+}
+
+func (e *EntityVersioned) Version() int64 {
+	return e.version
+}
+
+func (e *EntityVersioned) SetVersion(version int64) {
+	e.version = version
+}
+
+func TestVersioned(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(t, db)
+
+	e := &EntityVersioned{Data: "foo"}
+	key, err := db.Put(nil, e)
+	if err != nil {
+		t.Fatalf("error creating entity: %v", err)
+	}
+
+	if e.Version() != 1 {
+		t.Fatalf("wrong version of created entity: %v", e.Version())
+	}
+
+	var a, b EntityVersioned
+	if err := db.Get(key, &a); err != nil {
+		t.Fatalf("error reading entity: %v", err)
+	}
+
+	if err := db.Get(key, &b); err != nil {
+		t.Fatalf("error reading entity: %v", err)
+	}
+
+	if a.Version() != 1 {
+		t.Fatalf("wrong version of read entity: %v", a.Version())
+	}
+
+	a.Data = "bar"
+	if _, err := db.Put(key, &a); err != nil {
+		t.Fatalf("error updating entity: %v", err)
+	}
+
+	if a.Version() != 2 {
+		t.Fatalf("wrong version of updated entity: %v", a.Version())
+	}
+
+	// b is outdated
+	b.Data = "baz"
+	_, err = db.PutIfVersion(key, &b, b.Version())
+	if !errors.Is(err, schemalessql.ErrConflict) {
+		t.Fatalf("should receive conflict error but got: %v", err)
+	}
+
+	if cerr := err.(*schemalessql.ConflictError); cerr.Version != 1 || cerr.Stored != 2 {
+		t.Fatalf("wrong versions of conflict error: %v", cerr)
+	}
+
+	var results []*EntityVersioned
+	if _, err := db.FindAll(db.NewQuery("EntityVersioned"), &results); err != nil {
+		t.Fatalf("error finding entities: %v", err)
+	}
+
+	if len(results) != 1 || results[0].Data != "bar" || results[0].Version() != 2 {
+		t.Fatalf("wrong entity found: %v", results)
+	}
+}
+
+func TestPutIfVersion(t *testing.T) {
+	db := newDB(t)
+	defer closeDB(t, db)
+
+	key, err := db.PutIfVersion(nil, EntityA{1.5}, 0)
+	if err != nil {
+		t.Fatalf("error creating entity: %v", err)
+	}
+
+	if _, err := db.PutIfVersion(key, EntityA{2.5}, 0); !errors.Is(err, schemalessql.ErrConflict) {
+		t.Fatalf("should receive conflict error for existing entity but got: %v", err)
+	}
+
+	if _, err := db.PutIfVersion(key, EntityA{2.5}, 1); err != nil {
+		t.Fatalf("error updating entity: %v", err)
+	}
+
+	if _, err := db.PutIfVersion(key, EntityA{3.5}, 1); !errors.Is(err, schemalessql.ErrConflict) {
+		t.Fatalf("should receive conflict error for outdated version but got: %v", err)
+	}
+
+	var r EntityA
+	if err := db.Get(key, &r); err != nil || r.Data != 2.5 {
+		t.Fatalf("error reading entity %v: %v", r, err)
+	}
+
+	// unconditional puts ignore the version
+	if _, err := db.Put(key, EntityA{4.5}); err != nil {
+		t.Fatalf("error updating entity: %v", err)
+	}
+
+	if _, err := db.PutIfVersion(key, EntityA{5.5}, 3); err != nil {
+		t.Fatalf("error updating entity: %v", err)
+	}
+}
+
+func TestVersionMigration(t *testing.T) {
+	driver, dsn := testDSN(t)
+	dialect := dialects[driver]
+
+	// entity table of a datastore created before versioning and codecs
+	old, err := sql.Open(driver, dsn)
+	if err != nil {
+		t.Fatalf("error connecting to database: %v", err)
+	}
+
+	stmts := dialect.CreateTable(schemalessql.Table{
+		Name: "entities",
+		Columns: []schemalessql.Column{
+			{Name: "id", Type: "SERIAL"},
+			{Name: "kind", Type: "TEXT", Constraints: "NOT NULL"},
+			{Name: "data", Type: "BLOB", Constraints: "NOT NULL"},
+		},
+	})
+
+	for _, stmt := range stmts {
+		if _, err := old.Exec(stmt); err != nil {
+			t.Fatalf("error creating entity table: %v", err)
+		}
+	}
+	old.Close()
+
+	db, err := schemalessql.Open(driver, dsn)
+	if err != nil {
+		t.Fatalf("error migrating database: %v", err)
+	}
+	defer closeDB(t, db)
+
+	e := &EntityVersioned{Data: "foo"}
+	key, err := db.Put(nil, e)
+	if err != nil || e.Version() != 1 {
+		t.Fatalf("error creating entity at version %v: %v", e.Version(), err)
+	}
+
+	var r EntityVersioned
+	if err := db.Get(key, &r); err != nil || r.Data != "foo" {
+		t.Fatalf("error reading entity %v: %v", r, err)
+	}
+}